@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jfmow/at-trains-api/metrics"
 	"github.com/labstack/echo/v5"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
@@ -33,6 +34,8 @@ func RequestLoggerMiddleware() echo.MiddlewareFunc {
 			stop := time.Now()
 			latency := stop.Sub(start)
 
+			metrics.ObserveRequest(c.Path(), c.Request().Method, metrics.ResponseStatus(c, err), latency)
+
 			entry := logrus.WithFields(logrus.Fields{
 				"time":      stop.Format(time.RFC3339),
 				"method":    c.Request().Method,
@@ -1,16 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jfmow/at-trains-api/basemap"
+	"github.com/jfmow/at-trains-api/metrics"
 	"github.com/jfmow/at-trains-api/providers"
 	"github.com/jfmow/gtfs"
 	rt "github.com/jfmow/gtfs/realtime"
@@ -38,17 +43,33 @@ var rateLimiterConfig = middleware.RateLimiterConfig{
 	},
 }
 
-var localTimeZone, _ = time.LoadLocation("Pacific/Auckland")
-
-//var aestZone, _ = time.LoadLocation("Australia/Brisbane")
+const (
+	// How long in-flight requests get to finish once a shutdown signal is received
+	shutdownTimeout = 30 * time.Second
+	// How long running notification jobs get to finish, counted from the same signal
+	jobsShutdownTimeout = 30 * time.Second
+)
 
 func main() {
+	var httpAddr string
+	flag.StringVar(&httpAddr, "http", "0.0.0.0:8090", "HTTP server address (IP:Port)")
+	var providersConfigPath string
+	flag.StringVar(&providersConfigPath, "providers", filepath.Join(getWorkDir(), "providers.json"), "Path to the provider config file")
+
+	// Parse command line flags
+	flag.Parse()
+
 	//Loads a .env file in the current dir
 	err := godotenv.Load()
 	if err != nil {
 		fmt.Println("Error loading .env file")
 	}
 
+	providerConfigs, err := providers.LoadProviderConfigs(providersConfigPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	logrus.SetOutput(&lumberjack.Logger{
 		Filename:   filepath.Join(getWorkDir(), "logs", "api.log"),
 		MaxSize:    100, // megabytes
@@ -76,104 +97,179 @@ func main() {
 	}))
 
 	//e.GET("/logs", GetLogsHandler)
+	e.GET("/metrics", metrics.Handler())
 
-	atApi := e.Group("/at")
-	atApi.Use(middleware.RateLimiterWithConfig(rateLimiterConfig))
-	mlApi := e.Group("/wel")
-	//seqAPI := e.Group("/seq")
-	christchurchApi := e.Group("/christ")
+	var registry []*providers.Provider
+	for _, cfg := range providerConfigs {
+		registry = append(registry, registerProvider(e, cfg))
+	}
 
-	//Auckland Transport
-	atApiKey, found := os.LookupEnv("AT_APIKEY")
-	if !found {
-		panic("Auckland transport api key Env not found")
+	providers.SetupHealthRoutes(e, registry)
+	providers.SetupDiscoveryRoutes(e, registry)
+
+	// Split the address into IP and port
+	httpParts := strings.Split(httpAddr, ":")
+	if len(httpParts) != 2 {
+		log.Fatal("Invalid --http address format. Use IP:PORT")
 	}
 
-	AucklandTransportGTFSData, err := gtfs.New("https://gtfs.at.govt.nz/gtfs.zip", gtfs.ApiKey{Header: "", Value: ""}, "atfgtfs", localTimeZone, "hi@suddsy.dev")
-	if err != nil {
-		fmt.Println("Error loading at gtfs db")
+	var port = httpParts[1]
+
+	ip := httpParts[0] // Extract the IP address
+
+	portEnv, found := os.LookupEnv("port")
+	if found {
+		port = portEnv
 	}
 
-	AucklandTransportRealtimeData, err := rt.NewClient(atApiKey, "Ocp-Apim-Subscription-Key", 17*time.Second, "https://api.at.govt.nz/realtime/legacy/vehiclelocations", "https://api.at.govt.nz/realtime/legacy/tripupdates", "https://api.at.govt.nz/realtime/legacy/servicealerts", *localTimeZone)
-	if err != nil {
-		panic(err)
+	// Start server using the extracted IP and port
+	fmt.Println("Server is running on: http://" + ip + ":" + port + "/")
+	s := http.Server{Addr: ip + ":" + port, Handler: e}
+	// Streaming clients never finish by themselves, end them so the in-flight requests can drain
+	s.RegisterOnShutdown(func() {
+		for _, provider := range registry {
+			provider.CloseStreams()
+		}
+	})
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- s.ListenAndServe()
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+
+	select {
+	case err := <-serverErr:
+		if err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	case <-signals.Done():
+		shutdown(&s, registry)
 	}
+}
 
-	providers.SetupProvider(atApi, AucklandTransportGTFSData, AucklandTransportRealtimeData, "at", localTimeZone)
+/*
+Shuts the api down:
 
-	//MetLink
-	metlinkApiKey, found := os.LookupEnv("WEL_APIKEY")
-	if !found {
-		panic("metlink api key Env not found")
+ 1. stop the notification cron jobs starting, running jobs get jobsShutdownTimeout to finish
+ 2. at the same time stop accepting connections, disconnect live streams and let in-flight requests finish within shutdownTimeout
+ 3. stop each providers background work and close its databases, a notification database is left open if its jobs didn't finish
+*/
+func shutdown(s *http.Server, registry []*providers.Provider) {
+	fmt.Println("Shutting down...")
+	logrus.Info("Shutting down")
+
+	for _, provider := range registry {
+		provider.DrainJobs()
 	}
+	jobsCtx, cancelJobs := context.WithTimeout(context.Background(), jobsShutdownTimeout)
+	defer cancelJobs()
 
-	MetLinkGTFSData, err := gtfs.New("https://static.opendata.metlink.org.nz/v1/gtfs/full.zip", gtfs.ApiKey{Header: "", Value: ""}, "welgtfs", localTimeZone, "hi@suddsy.dev")
-	if err != nil {
-		fmt.Println("Error loading at gtfs db")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != nil {
+		logrus.WithError(err).Error("Failed to drain http requests")
 	}
 
-	MetLinkRealtimeData, err := rt.NewClient(metlinkApiKey, "x-api-key", 5*time.Second, "https://api.opendata.metlink.org.nz/v1/gtfs-rt/vehiclepositions", "https://api.opendata.metlink.org.nz/v1/gtfs-rt/tripupdates", "https://api.opendata.metlink.org.nz/v1/gtfs-rt/servicealerts", *localTimeZone)
-	if err != nil {
-		panic(err)
+	var wg sync.WaitGroup
+	for _, provider := range registry {
+		wg.Add(1)
+		go func(provider *providers.Provider) {
+			defer wg.Done()
+			if err := provider.Shutdown(jobsCtx); err != nil {
+				logrus.WithError(err).WithField("provider", provider.Config.Prefix).Error("Failed to shut down provider")
+			}
+		}(provider)
 	}
+	wg.Wait()
+
+	fmt.Println("Shutdown complete")
+	logrus.Info("Shutdown complete")
+}
 
-	providers.SetupProvider(mlApi, MetLinkGTFSData, MetLinkRealtimeData, "wel", localTimeZone)
+/*
+Builds the gtfs + realtime clients for a provider from its config and mounts its routes under /{prefix}
 
-	christchurchApiKey, found := os.LookupEnv("CHRISTCHURCH_APIKEY")
-	if !found {
-		panic("Christchurch api key Env not found")
+A provider that fails to start never takes down the api, instead it is:
+
+- disabled (not mounted) if its static gtfs can't be loaded
+- degraded (static only, /realtime/* returns 503) if its realtime client can't be created
+*/
+func registerProvider(e *echo.Echo, cfg providers.ProviderConfig) *providers.Provider {
+	if !cfg.Enabled {
+		return disableProvider(cfg, "disabled in config")
 	}
 
-	ChristChurchGTFSData, err := gtfs.New("https://apis.metroinfo.co.nz/rti/gtfs/v1/gtfs.zip", gtfs.ApiKey{Header: "Ocp-Apim-Subscription-Key", Value: christchurchApiKey}, "christgtfs", localTimeZone, "hi@suddsy.dev")
-	if err != nil {
-		fmt.Println("Error loading at gtfs db")
+	// Already checked when the config was loaded
+	timeZone, _ := cfg.Location()
+	pollInterval, _ := cfg.Realtime.Interval()
+
+	staticKey, found := cfg.Static.AuthKey()
+	if !found {
+		return disableProvider(cfg, "static feed api key env ("+cfg.Static.AuthKeyEnv+") not found")
 	}
 
-	ChristChurchRealtimeData, err := rt.NewClient(christchurchApiKey, "Ocp-Apim-Subscription-Key", 20*time.Second, "https://apis.metroinfo.co.nz/rti/gtfsrt/v1/vehicle-positions.pb", "https://apis.metroinfo.co.nz/rti/gtfsrt/v1/trip-updates.pb", "https://apis.metroinfo.co.nz/rti/gtfsrt/v1/service-alerts.pb", *localTimeZone)
+	gtfsData, err := gtfs.New(cfg.Static.URL, gtfs.ApiKey{Header: cfg.Static.AuthHeader, Value: staticKey}, cfg.DatabaseName(), timeZone, cfg.ContactEmail)
 	if err != nil {
-		panic(err)
+		return disableProvider(cfg, "failed to load static gtfs: "+err.Error())
 	}
-
-	providers.SetupProvider(christchurchApi, ChristChurchGTFSData, ChristChurchRealtimeData, "christ", localTimeZone)
-	/*
-		SEQGTFSData, err := gtfs.New("https://gtfsrt.api.translink.com.au/GTFS/SEQ_GTFS.zip", gtfs.ApiKey{Header: "", Value: ""}, "seqGTFS", aestZone, "hi@suddsy.dev")
-		if err != nil {
-			fmt.Println("Error loading at gtfs db")
-		}
-
-		SEQRealtimeData, err := rt.NewClient("", "", 15*time.Second, "https://gtfsrt.api.translink.com.au/api/realtime/SEQ/VehiclePositions", "https://gtfsrt.api.translink.com.au/api/realtime/SEQ/TripUpdates", "https://gtfsrt.api.translink.com.au/api/realtime/SEQ/alerts")
+	staticLoadedAt := time.Now()
+
+	state := providers.ProviderReady
+	reason := ""
+
+	var realtimeData rt.Realtime
+	realtimeKey, found := cfg.Realtime.AuthKey()
+	switch {
+	case cfg.Realtime.VehiclePositionsURL == "" && cfg.Realtime.TripUpdatesURL == "" && cfg.Realtime.AlertsURL == "":
+		state, reason = providers.ProviderDegraded, "no realtime feeds configured"
+	case !found:
+		state, reason = providers.ProviderDegraded, "realtime api key env ("+cfg.Realtime.AuthKeyEnv+") not found"
+	default:
+		client, err := rt.NewClient(realtimeKey, cfg.Realtime.AuthHeader, pollInterval, cfg.Realtime.VehiclePositionsURL, cfg.Realtime.TripUpdatesURL, cfg.Realtime.AlertsURL, *timeZone)
 		if err != nil {
-			panic(err)
+			state, reason = providers.ProviderDegraded, "failed to create realtime client: "+err.Error()
+		} else {
+			realtimeData = client
 		}
+	}
 
-		providers.SetupProvider(seqAPI, SEQGTFSData, SEQRealtimeData, aestZone)
-	*/
-	var httpAddr string
-	flag.StringVar(&httpAddr, "http", "0.0.0.0:8090", "HTTP server address (IP:Port)")
-
-	// Parse command line flags
-	flag.Parse()
-
-	// Split the address into IP and port
-	httpParts := strings.Split(httpAddr, ":")
-	if len(httpParts) != 2 {
-		log.Fatal("Invalid --http address format. Use IP:PORT")
+	providerApi := e.Group("/" + cfg.Prefix)
+	if cfg.RateLimited {
+		providerApi.Use(middleware.RateLimiterWithConfig(rateLimiterConfig))
 	}
 
-	var port = httpParts[1]
+	provider := providers.SetupProvider(providerApi, gtfsData, realtimeData, cfg, state, reason)
+	provider.StaticLoadedAt = staticLoadedAt
+	logProviderState(cfg, state, reason)
 
-	ip := httpParts[0] // Extract the IP address
+	return provider
+}
 
-	portEnv, found := os.LookupEnv("port")
-	if found {
-		port = portEnv
+func disableProvider(cfg providers.ProviderConfig, reason string) *providers.Provider {
+	logProviderState(cfg, providers.ProviderDisabled, reason)
+	return providers.NewDisabledProvider(cfg, reason)
+}
+
+func logProviderState(cfg providers.ProviderConfig, state providers.ProviderState, reason string) {
+	entry := logrus.WithFields(logrus.Fields{
+		"provider": cfg.Prefix,
+		"state":    state,
+	})
+	if reason != "" {
+		entry = entry.WithField("reason", reason)
 	}
 
-	// Start server using the extracted IP and port
-	fmt.Println("Server is running on: http://" + ip + ":" + port + "/")
-	s := http.Server{Addr: ip + ":" + port, Handler: e}
-	if err := s.ListenAndServe(); err != http.ErrServerClosed {
-		log.Fatal(err)
+	switch state {
+	case providers.ProviderReady:
+		entry.Info("Provider started")
+		fmt.Printf("Provider %s: %s\n", cfg.Prefix, state)
+	default:
+		entry.Warn("Provider started without full data")
+		fmt.Printf("Provider %s: %s (%s)\n", cfg.Prefix, state, reason)
 	}
 }
 
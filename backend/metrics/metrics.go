@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "trains"
+
+// HTTP
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests handled, by route template, method and status code.",
+	}, []string{"route", "method", "status"})
+
+	httpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency, by route template and method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method"})
+)
+
+/*
+Records a finished request.
+
+route should be the registered route template (c.Path()) not the raw url, so stop/trip ids don't explode the label set.
+*/
+func ObserveRequest(route, method string, status int, latency time.Duration) {
+	if route == "" {
+		route = "unmatched"
+	}
+	httpRequests.WithLabelValues(route, method, strconv.Itoa(status)).Inc()
+	httpRequestDuration.WithLabelValues(route, method).Observe(latency.Seconds())
+}
+
+/*
+Works out the status code that will be sent for a request.
+
+When a handler returns an error the response hasn't been written yet when the middleware sees it,
+so the code is taken from the error instead.
+*/
+func ResponseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+	var httpErr *echo.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// Realtime feeds
+
+var (
+	feedFetches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "realtime_feed_fetches_total",
+		Help:      "Realtime feed reads, by provider, feed and result (success/error).",
+	}, []string{"provider", "feed", "result"})
+
+	feedLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realtime_feed_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful feed read. Age is time() - this.",
+	}, []string{"provider", "feed"})
+
+	feedNewestEntity = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realtime_feed_newest_entity_timestamp_seconds",
+		Help:      "Unix time reported by the newest entity in the feed. Data age is time() - this.",
+	}, []string{"provider", "feed"})
+
+	feedEntities = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "realtime_feed_entities",
+		Help:      "Entities (vehicles, trip updates, alerts) in the last successful feed read.",
+	}, []string{"provider", "feed"})
+)
+
+// Records a realtime feed read, newestEntity is ignored if it's zero
+func ObserveFeedFetch(provider, feed string, err error, at time.Time, entities int, newestEntity time.Time) {
+	if err != nil {
+		feedFetches.WithLabelValues(provider, feed, "error").Inc()
+		return
+	}
+	feedFetches.WithLabelValues(provider, feed, "success").Inc()
+	feedLastSuccess.WithLabelValues(provider, feed).Set(float64(at.Unix()))
+	feedEntities.WithLabelValues(provider, feed).Set(float64(entities))
+	if !newestEntity.IsZero() {
+		feedNewestEntity.WithLabelValues(provider, feed).Set(float64(newestEntity.Unix()))
+	}
+}
+
+// Caches
+
+var cacheRebuildDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Name:      "cache_rebuild_duration_seconds",
+	Help:      "Time taken to rebuild a gtfs cache, by provider and cache.",
+	Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+}, []string{"provider", "cache"})
+
+func ObserveCacheRebuild(provider, cache string, duration time.Duration) {
+	cacheRebuildDuration.WithLabelValues(provider, cache).Observe(duration.Seconds())
+}
+
+// Push notifications
+
+var (
+	pushSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_notifications_total",
+		Help:      "Web push sends, by result (success/failure).",
+	}, []string{"result"})
+
+	pushClientsDeleted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_clients_deleted_total",
+		Help:      "Notification clients deleted because the push service returned 410 Gone.",
+	})
+
+	remindersFired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reminders_fired_total",
+		Help:      "Trip reminders sent, by reminder type.",
+	}, []string{"type"})
+)
+
+func PushSent() {
+	pushSends.WithLabelValues("success").Inc()
+}
+
+func PushFailed() {
+	pushSends.WithLabelValues("failure").Inc()
+}
+
+func PushClientDeleted() {
+	pushClientsDeleted.Inc()
+}
+
+func ReminderFired(reminderType string) {
+	remindersFired.WithLabelValues(reminderType).Inc()
+}
+
+// Serves the default registry in the prometheus text format
+func Handler() echo.HandlerFunc {
+	return echo.WrapHandler(promhttp.Handler())
+}
@@ -0,0 +1,416 @@
+package providers
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jfmow/at-trains-api/providers/alerttext"
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/notifications"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+	"github.com/labstack/echo/v5"
+)
+
+type AlertDetails struct {
+	ID               string                `json:"id"`
+	Cause            string                `json:"cause"`
+	Effect           string                `json:"effect"`
+	Severity         string                `json:"severity"`
+	Title            string                `json:"title"`
+	Description      string                `json:"description"`
+	Language         string                `json:"language"` // Of the title and description, empty if the feed didn't say
+	URL              string                `json:"url"`
+	Image            *AlertImage           `json:"image"`
+	StartDate        int                   `json:"start_date"` // Earliest start of the active periods, 0 if there are none
+	EndDate          int                   `json:"end_date"`   // Latest end, 0 if there is no end
+	ActivePeriods    []AlertActivePeriod   `json:"active_periods"`
+	InformedEntities []AlertInformedEntity `json:"informed_entities"`
+}
+
+type AlertImage struct {
+	URL             string `json:"url"`
+	MediaType       string `json:"media_type"`
+	AlternativeText string `json:"alternative_text"`
+}
+
+// Unix seconds, 0 means open ended
+type AlertActivePeriod struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Who an alert is for, the ids from the feed with their names looked up from the schedule
+type AlertInformedEntity struct {
+	AgencyId       string  `json:"agency_id,omitempty"`
+	RouteId        string  `json:"route_id,omitempty"`
+	RouteShortName string  `json:"route_short_name,omitempty"`
+	DirectionId    *uint32 `json:"direction_id,omitempty"`
+	TripId         string  `json:"trip_id,omitempty"`
+	StopId         string  `json:"stop_id,omitempty"`
+	StopName       string  `json:"stop_name,omitempty"`
+}
+
+// The supported languages in the requests Accept-Language header, most preferred first and always ending in the default
+func acceptedAlertLanguages(c echo.Context) []string {
+	return alerttext.Accepted(c.Request().Header.Get("Accept-Language"))
+}
+
+func alertImage(alert *proto.Alert, languages []string) *AlertImage {
+	images := alert.GetImage().GetLocalizedImage()
+	if len(images) == 0 {
+		return nil
+	}
+
+	image := images[0]
+	for _, language := range languages {
+		index := slices.IndexFunc(images, func(localized *proto.TranslatedImage_LocalizedImage) bool {
+			return alerttext.Matches(localized.GetLanguage(), language)
+		})
+		if index != -1 {
+			image = images[index]
+			break
+		}
+	}
+
+	alternativeText, _ := alerttext.Translation(alert.GetImageAlternativeText(), languages)
+	return &AlertImage{
+		URL:             image.GetUrl(),
+		MediaType:       image.GetMediaType(),
+		AlternativeText: alternativeText,
+	}
+}
+
+// Converts a realtime alert, alerts without an active period are skipped (ok is false)
+func newAlertResponseData(alert *proto.Alert, languages []string) (AlertResponseData, bool) {
+	activePeriods := alert.GetActivePeriod()
+	if len(activePeriods) == 0 {
+		return AlertResponseData{}, false
+	}
+
+	smallestStart := activePeriods[0].GetStart()
+	biggestEnd := activePeriods[0].GetEnd()
+
+	for _, period := range activePeriods {
+		if period.GetStart() < smallestStart {
+			smallestStart = period.GetStart()
+		}
+		if period.GetEnd() > biggestEnd {
+			biggestEnd = period.GetEnd()
+		}
+	}
+
+	title, _ := alerttext.Translation(alert.GetHeaderText(), languages)
+	description, _ := alerttext.Translation(alert.GetDescriptionText(), languages)
+
+	return AlertResponseData{
+		StartDate:   int(smallestStart),
+		EndDate:     int(biggestEnd),
+		Cause:       alert.GetCause().String(),
+		Effect:      alert.GetEffect().String(),
+		Title:       title,
+		Description: description,
+		Severity:    alert.GetSeverityLevel().String(),
+	}, true
+}
+
+// Builds the full alerts responses, looking up the names of the stops and routes alerts inform
+type alertDetailsBuilder struct {
+	gtfsData  gtfs.Database
+	routes    map[string]gtfs.Route
+	languages []string
+	stopNames map[string]string
+}
+
+func newAlertDetailsBuilder(gtfsData gtfs.Database, getRouteCache caches.RouteCache, languages []string) *alertDetailsBuilder {
+	return &alertDetailsBuilder{
+		gtfsData:  gtfsData,
+		routes:    getRouteCache(),
+		languages: languages,
+		stopNames: make(map[string]string),
+	}
+}
+
+func (b *alertDetailsBuilder) stopName(stopID string) string {
+	if name, found := b.stopNames[stopID]; found {
+		return name
+	}
+	var name string
+	if stop, err := b.gtfsData.GetStopByStopID(stopID); err == nil {
+		name = strings.TrimSpace(stop.StopName + " " + stop.StopCode)
+	}
+	b.stopNames[stopID] = name
+	return name
+}
+
+func (b *alertDetailsBuilder) build(id string, alert *proto.Alert) AlertDetails {
+	title, language := alerttext.Translation(alert.GetHeaderText(), b.languages)
+	description, _ := alerttext.Translation(alert.GetDescriptionText(), b.languages)
+	alertURL, _ := alerttext.Translation(alert.GetUrl(), b.languages)
+
+	details := AlertDetails{
+		ID:               id,
+		Cause:            alert.GetCause().String(),
+		Effect:           alert.GetEffect().String(),
+		Severity:         alert.GetSeverityLevel().String(),
+		Title:            title,
+		Description:      description,
+		Language:         language,
+		URL:              alertURL,
+		Image:            alertImage(alert, b.languages),
+		ActivePeriods:    []AlertActivePeriod{},
+		InformedEntities: []AlertInformedEntity{},
+	}
+
+	for i, period := range alert.GetActivePeriod() {
+		start, end := int(period.GetStart()), int(period.GetEnd())
+		details.ActivePeriods = append(details.ActivePeriods, AlertActivePeriod{Start: start, End: end})
+		if i == 0 || start < details.StartDate {
+			details.StartDate = start
+		}
+		// An open ended period means the alert has no end
+		if i == 0 || end == 0 || (details.EndDate != 0 && end > details.EndDate) {
+			details.EndDate = end
+		}
+	}
+
+	for _, entity := range alert.GetInformedEntity() {
+		informed := AlertInformedEntity{
+			AgencyId:    entity.GetAgencyId(),
+			RouteId:     entity.GetRouteId(),
+			DirectionId: entity.DirectionId,
+			TripId:      entity.GetTrip().GetTripId(),
+			StopId:      entity.GetStopId(),
+		}
+		if informed.RouteId == "" {
+			informed.RouteId = entity.GetTrip().GetRouteId()
+		}
+		if informed.RouteId != "" {
+			informed.RouteShortName = b.routes[informed.RouteId].RouteShortName
+		}
+		if informed.StopId != "" {
+			informed.StopName = b.stopName(informed.StopId)
+		}
+		details.InformedEntities = append(details.InformedEntities, informed)
+	}
+
+	return details
+}
+
+// Builds the alerts that have an informed entity matching, sorted by when they start
+func (b *alertDetailsBuilder) matching(alerts rt.AlertMap, matches func(entity *proto.EntitySelector) bool) []AlertDetails {
+	result := []AlertDetails{}
+	for id, alert := range alerts {
+		if matches != nil && !slices.ContainsFunc(alert.GetInformedEntity(), matches) {
+			continue
+		}
+		result = append(result, b.build(id, alert))
+	}
+	slices.SortFunc(result, func(a, b AlertDetails) int {
+		if a.StartDate != b.StartDate {
+			return a.StartDate - b.StartDate
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return result
+}
+
+// Works out which route an informed entity is about, entities that only name a trip have their route looked up
+func newEntityRouteResolver(gtfsData gtfs.Database) func(entity *proto.EntitySelector) string {
+	// trip id -> route id
+	tripRoutes := make(map[string]string)
+	return func(entity *proto.EntitySelector) string {
+		if routeID := entity.GetRouteId(); routeID != "" {
+			return routeID
+		}
+		if routeID := entity.GetTrip().GetRouteId(); routeID != "" {
+			return routeID
+		}
+		tripID := entity.GetTrip().GetTripId()
+		if tripID == "" {
+			return ""
+		}
+		if _, found := tripRoutes[tripID]; !found {
+			trip, _ := gtfsData.GetTripByID(tripID)
+			tripRoutes[tripID] = trip.RouteID
+		}
+		return tripRoutes[tripID]
+	}
+}
+
+func setupAlertsRoutes(realtimeRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, notifier *notifications.Notifier, getRouteCache caches.RouteCache) {
+	//Every alert in the feed
+	realtimeRoute.GET("/alerts", func(c echo.Context) error {
+		alerts, err := realtime.GetAlerts()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No alerts found", "details", err.Error()))
+		}
+
+		builder := newAlertDetailsBuilder(gtfsData, getRouteCache, acceptedAlertLanguages(c))
+		return JsonApiResponse(c, http.StatusOK, "", builder.matching(alerts, nil))
+	})
+
+	/*
+		Searches every alert the notification cron has seen, including ones that have since been removed from the feed.
+
+		Query params (all optional):
+		  routeId - alerts for the route (or a trip on it)
+		  stop - stop name, code or id, alerts for the stop or its platforms
+		  from, to - unix seconds, alerts that were in the feed at some point between them
+		  q - text in the title or description
+		  page, size - pagination, size is at most 100
+	*/
+	realtimeRoute.GET("/alerts/history", func(c echo.Context) error {
+		query := notifications.AlertHistoryQuery{
+			RouteId: c.QueryParam("routeId"),
+			Query:   strings.TrimSpace(c.QueryParam("q")),
+			Page:    1,
+			Size:    20,
+		}
+
+		for param, value := range map[string]*int64{"from": &query.From, "to": &query.To} {
+			if raw := c.QueryParam(param); raw != "" {
+				parsed, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil {
+					return JsonApiResponse(c, http.StatusBadRequest, "invalid "+param, nil, ResponseDetails(param, raw, "details", "Expected unix seconds", "error", err.Error()))
+				}
+				*value = parsed
+			}
+		}
+		if query.From > 0 && query.To > 0 && query.To < query.From {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid time range", nil, ResponseDetails("from", query.From, "to", query.To, "details", "to is before from"))
+		}
+
+		for param, value := range map[string]*int{"page": &query.Page, "size": &query.Size} {
+			if raw := c.QueryParam(param); raw != "" {
+				parsed, err := strconv.Atoi(raw)
+				if err != nil || parsed < 1 {
+					return JsonApiResponse(c, http.StatusBadRequest, "invalid "+param, nil, ResponseDetails(param, raw, "details", "Expected a positive number"))
+				}
+				*value = parsed
+			}
+		}
+
+		if stopName := c.QueryParam("stop"); stopName != "" {
+			stop, err := gtfsData.GetStopByNameOrCode(stopName)
+			if err != nil {
+				stop, err = gtfsData.GetStopByStopID(stopName)
+			}
+			if err != nil {
+				return JsonApiResponse(c, http.StatusNotFound, "no stop found", nil, ResponseDetails("stop", stopName, "details", "Stop not found", "error", err.Error()))
+			}
+			// Alerts name the platform as often as the station
+			query.StopIds = append(query.StopIds, stop.StopId)
+			if childStops, err := gtfsData.GetChildStopsByParentStopID(stop.StopId); err == nil {
+				for _, child := range childStops {
+					query.StopIds = append(query.StopIds, child.StopId)
+				}
+			}
+		}
+
+		history, err := notifier.AlertHistory(query)
+		if err != nil {
+			if errors.Is(err, notifications.ErrArchiveUnavailable) {
+				return JsonApiResponse(c, http.StatusServiceUnavailable, "alerts archive unavailable", nil)
+			}
+			return JsonApiResponse(c, http.StatusInternalServerError, "Database Error", nil, ResponseDetails("error", err.Error()))
+		}
+
+		return JsonApiResponse(c, http.StatusOK, "", history)
+	})
+
+	//Alerts for a route, including ones for a single trip on it. With a .ics suffix the alerts are an icalendar feed
+	realtimeRoute.GET("/alerts/route/:routeId", func(c echo.Context) error {
+		routeIdEncoded := c.PathParam("routeId")
+		routeId, err := url.PathUnescape(routeIdEncoded)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid route id", nil, ResponseDetails("routeId", routeIdEncoded, "details", "Invalid route id format", "error", err.Error()))
+		}
+		routeId, calendar := strings.CutSuffix(routeId, ".ics")
+		if _, found := getRouteCache()[routeId]; !found {
+			return JsonApiResponse(c, http.StatusNotFound, "no route found", nil, ResponseDetails("routeId", routeId, "details", "Route not found"))
+		}
+
+		alerts, err := realtime.GetAlerts()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No alerts found", "details", err.Error()))
+		}
+
+		routeOf := newEntityRouteResolver(gtfsData)
+		matches := func(entity *proto.EntitySelector) bool {
+			return routeOf(entity) == routeId
+		}
+
+		builder := newAlertDetailsBuilder(gtfsData, getRouteCache, acceptedAlertLanguages(c))
+		if calendar {
+			return writeAlertsCalendar(c, "Alerts for "+getRouteCache()[routeId].RouteShortName, "", builder.matching(alerts, matches))
+		}
+		return JsonApiResponse(c, http.StatusOK, "", builder.matching(alerts, matches))
+	})
+
+	//Alerts that affect a trip, see tripAlertMatcher
+	realtimeRoute.GET("/alerts/trip/:tripId", func(c echo.Context) error {
+		tripIdEncoded := c.PathParam("tripId")
+		tripId, err := url.PathUnescape(tripIdEncoded)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip id", nil, ResponseDetails("tripId", tripIdEncoded, "details", "Invalid trip id format", "error", err.Error()))
+		}
+
+		trip, err := gtfsData.GetTripByID(tripId)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusNotFound, "no trip found", nil, ResponseDetails("tripId", tripId, "details", "Trip not found", "error", err.Error()))
+		}
+
+		stopTimes, err := gtfsData.GetStopTimesForTripID(tripId)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("tripId", tripId, "details", "Failed to get stops for trip", "error", err.Error()))
+		}
+
+		alerts, err := realtime.GetAlerts()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No alerts found", "details", err.Error()))
+		}
+
+		builder := newAlertDetailsBuilder(gtfsData, getRouteCache, acceptedAlertLanguages(c))
+		return JsonApiResponse(c, http.StatusOK, "", builder.matching(alerts, tripAlertMatcher(trip, stopTimes)))
+	})
+}
+
+/*
+Matches the alerts that affect a trip.
+
+That's ones for the trip itself, its route, or a stop it calls at (as long as they aren't about some other trip or route)
+*/
+func tripAlertMatcher(trip gtfs.Trip, stopTimes []gtfs.TripStopTime) func(entity *proto.EntitySelector) bool {
+	// Alerts can name the platform or the station
+	tripStops := make(map[string]struct{}, len(stopTimes)*2)
+	for _, stopTime := range stopTimes {
+		tripStops[stopTime.StopId] = struct{}{}
+		if stopTime.ParentStation != "" {
+			tripStops[stopTime.ParentStation] = struct{}{}
+		}
+	}
+
+	return func(entity *proto.EntitySelector) bool {
+		if entityTrip := entity.GetTrip().GetTripId(); entityTrip != "" {
+			return entityTrip == trip.TripID
+		}
+		if routeID := entity.GetRouteId(); routeID != "" && routeID != trip.RouteID {
+			return false
+		}
+		if entity.DirectionId != nil && int(entity.GetDirectionId()) != trip.DirectionID {
+			return false
+		}
+		if stopID := entity.GetStopId(); stopID != "" {
+			if _, found := tripStops[stopID]; !found {
+				return false
+			}
+		}
+		return entity.GetRouteId() != "" || entity.GetStopId() != ""
+	}
+}
@@ -0,0 +1,99 @@
+/*
+Package alerttext picks which translation of a gtfs-realtime alerts text to show.
+
+Feeds can have an alert in several languages, tagged (en, mi, en-NZ) or untagged. Untagged text is taken to be in the
+default language.
+*/
+package alerttext
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// The languages alert text can be picked in, the first is the default
+var Languages = []string{"en", "mi"}
+
+/*
+The supported languages in an Accept-Language header, most preferred first.
+
+Region subtags are ignored (en-NZ is en), and the default language is always last so there is something to fall back to.
+*/
+func Accepted(header string) []string {
+	type weightedLanguage struct {
+		language string
+		quality  float64
+	}
+
+	var weighted []weightedLanguage
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if !slices.Contains(Languages, language) {
+			continue
+		}
+
+		quality := 1.0
+		if value, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil || parsed <= 0 {
+				continue
+			}
+			quality = parsed
+		}
+		weighted = append(weighted, weightedLanguage{language: language, quality: quality})
+	}
+
+	slices.SortStableFunc(weighted, func(a, b weightedLanguage) int {
+		switch {
+		case a.quality > b.quality:
+			return -1
+		case a.quality < b.quality:
+			return 1
+		}
+		return 0
+	})
+
+	languages := make([]string, 0, len(weighted)+1)
+	for _, language := range weighted {
+		if !slices.Contains(languages, language.language) {
+			languages = append(languages, language.language)
+		}
+	}
+	if !slices.Contains(languages, Languages[0]) {
+		languages = append(languages, Languages[0])
+	}
+	return languages
+}
+
+// Matches a feed language tag against a supported language, untagged text is in the default language
+func Matches(tag string, language string) bool {
+	if tag == "" {
+		return language == Languages[0]
+	}
+	primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+	return primary == language
+}
+
+/*
+Picks the translation in the most preferred language, falling back to the first one.
+
+Returns the language tag from the feed with it, both are empty if there is no text at all.
+*/
+func Translation(text *proto.TranslatedString, languages []string) (string, string) {
+	translations := text.GetTranslation()
+	if len(translations) == 0 {
+		return "", ""
+	}
+	for _, language := range languages {
+		for _, translation := range translations {
+			if Matches(translation.GetLanguage(), language) {
+				return translation.GetText(), translation.GetLanguage()
+			}
+		}
+	}
+	return translations[0].GetText(), translations[0].GetLanguage()
+}
@@ -0,0 +1,309 @@
+package providers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/history"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/gtfs"
+	"github.com/labstack/echo/v5"
+)
+
+const (
+	// A departure is on time if it's no more than 1 minute early or 5 minutes late
+	onTimeEarliest = -60
+	onTimeLatest   = 5 * 60
+
+	maxAnalyticsRange = 31 * 24 * time.Hour
+)
+
+type OTPStats struct {
+	Key              string  `json:"key"`
+	Name             string  `json:"name,omitempty"`
+	Departures       int     `json:"departures"` // Departures with an observed time
+	OnTime           int     `json:"on_time"`
+	OnTimeShare      float64 `json:"on_time_share"`
+	MeanDelay        float64 `json:"mean_delay_seconds"`
+	P95Delay         float64 `json:"p95_delay_seconds"`
+	Cancelled        int     `json:"cancelled"`
+	CancellationRate float64 `json:"cancellation_rate"`
+}
+
+type otpAccumulator struct {
+	name      string
+	delays    []int64
+	cancelled int
+}
+
+func (a *otpAccumulator) stats(key string) OTPStats {
+	stats := OTPStats{
+		Key:        key,
+		Name:       a.name,
+		Departures: len(a.delays),
+		Cancelled:  a.cancelled,
+	}
+
+	if total := len(a.delays) + a.cancelled; total > 0 {
+		stats.CancellationRate = float64(a.cancelled) / float64(total)
+	}
+
+	if len(a.delays) == 0 {
+		return stats
+	}
+
+	slices.Sort(a.delays)
+	var sum int64
+	for _, delay := range a.delays {
+		sum += delay
+		if delay >= onTimeEarliest && delay <= onTimeLatest {
+			stats.OnTime++
+		}
+	}
+	stats.OnTimeShare = float64(stats.OnTime) / float64(len(a.delays))
+	stats.MeanDelay = float64(sum) / float64(len(a.delays))
+	stats.P95Delay = float64(a.delays[int(math.Ceil(0.95*float64(len(a.delays))))-1])
+
+	return stats
+}
+
+// One scheduled departure compared against what realtime said happened
+type otpSample struct {
+	routeId   string
+	stopId    string
+	stopName  string
+	scheduled time.Time
+	delay     int64
+	cancelled bool
+}
+
+/*
+Compares recorded trip updates against the schedule.
+
+The scheduled ArrivalTime of each stop comes from the static gtfs stop times, the observed time is the last
+realtime time/delay recorded for that stop.
+*/
+func collectOTPSamples(observations []history.TripObservation, gtfsData gtfs.Database, localTimeZone *time.Location) []otpSample {
+	var samples []otpSample
+	stopTimesByTrip := make(map[string][]gtfs.TripStopTime)
+
+	for _, observation := range observations {
+		stopTimes, found := stopTimesByTrip[observation.TripID]
+		if !found {
+			// A trip that can't be found is cached as nil so it's only looked up once
+			stopTimes, _ = gtfsData.GetStopTimesForTripID(observation.TripID)
+			stopTimesByTrip[observation.TripID] = stopTimes
+		}
+		if len(stopTimes) == 0 {
+			continue
+		}
+
+		if observation.Cancelled {
+			// Every stop of a cancelled trip is a cancelled departure. Cancellations are usually published before the
+			// trip runs, so the run is the first one that starts after (or just before) the cancellation was seen
+			firstStop, ok := servicetime.After(stopTimes[0].ArrivalTime, time.Unix(observation.FirstSeen, 0).Add(-2*time.Hour), localTimeZone)
+			if !ok {
+				continue
+			}
+			firstStopSeconds, _ := servicetime.Seconds(stopTimes[0].ArrivalTime)
+			for _, stopTime := range stopTimes {
+				seconds, err := servicetime.Seconds(stopTime.ArrivalTime)
+				if err != nil {
+					continue
+				}
+				samples = append(samples, otpSample{
+					routeId:   observation.RouteID,
+					stopId:    otpStopId(stopTime),
+					stopName:  stopTime.StopName,
+					scheduled: firstStop.Add(time.Duration(seconds-firstStopSeconds) * time.Second),
+					cancelled: true,
+				})
+			}
+			continue
+		}
+
+		for _, stu := range observation.StopTimeUpdates {
+			stopTime, found := findScheduledStop(stopTimes, stu)
+			if !found {
+				continue
+			}
+
+			sample := otpSample{
+				routeId:  observation.RouteID,
+				stopId:   otpStopId(stopTime),
+				stopName: stopTime.StopName,
+			}
+
+			useDeparture := stu.HasDeparture && !stu.HasArrival
+			if !stu.HasArrival && !stu.HasDeparture {
+				// Recorded before which events an update had was kept
+				useDeparture = stu.ArrivalTime == 0 && stu.ArrivalDelay == 0
+			}
+			observedTime, delay := stu.ArrivalTime, stu.ArrivalDelay
+			if useDeparture {
+				observedTime, delay = stu.DepartureTime, stu.DepartureDelay
+			}
+
+			near := time.Unix(observation.LastSeen, 0)
+			if observedTime != 0 {
+				near = time.Unix(observedTime, 0)
+			}
+			scheduled, ok := servicetime.Near(stopTime.ArrivalTime, near, localTimeZone)
+			if !ok {
+				continue
+			}
+			sample.scheduled = scheduled
+
+			switch {
+			case stu.ScheduleRelationship == "SKIPPED":
+				sample.cancelled = true
+			case observedTime != 0:
+				sample.delay = int64(near.Sub(scheduled).Seconds())
+			case delay != 0 || stu.HasArrival || stu.HasDeparture:
+				// Delay only update, a delay of 0 is on time
+				sample.delay = int64(delay)
+			default:
+				// Nothing was predicted for this stop
+				continue
+			}
+
+			samples = append(samples, sample)
+		}
+	}
+
+	return samples
+}
+
+// Stations are reported as a whole rather than per platform
+func otpStopId(stopTime gtfs.TripStopTime) string {
+	if stopTime.ParentStation != "" {
+		return stopTime.ParentStation
+	}
+	return stopTime.StopId
+}
+
+func findScheduledStop(stopTimes []gtfs.TripStopTime, stu history.StopTimeUpdate) (gtfs.TripStopTime, bool) {
+	for _, stopTime := range stopTimes {
+		if stopTime.Sequence == int(stu.StopSequence) && (stu.StopID == "" || stu.StopID == stopTime.StopId) {
+			return stopTime, true
+		}
+	}
+	if stu.StopID != "" {
+		for _, stopTime := range stopTimes {
+			if stopTime.StopId == stu.StopID {
+				return stopTime, true
+			}
+		}
+	}
+	return gtfs.TripStopTime{}, false
+}
+
+func setupAnalyticsRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, hsdb *history.Database, localTimeZone *time.Location, getRouteCache caches.RouteCache) {
+	analyticsRoute := primaryRoute.Group("/analytics")
+
+	/*
+		On time performance, grouped by route, stop or hour of the day
+
+		?from=YYYY-MM-DD&to=YYYY-MM-DD (inclusive, defaults to the last 7 days)
+		&route= and &stop= (parent station or stop id) narrow the samples down
+	*/
+	analyticsRoute.GET("/otp/:groupBy", func(c echo.Context) error {
+		groupBy := c.PathParam("groupBy")
+		if groupBy != "routes" && groupBy != "stops" && groupBy != "hours" {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid grouping", nil, ResponseDetails("groupBy", groupBy, "details", "must be one of routes, stops or hours"))
+		}
+
+		now := time.Now().In(localTimeZone)
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, localTimeZone)
+		from := today.AddDate(0, 0, -6)
+		to := today
+
+		if fromStr := c.QueryParam("from"); fromStr != "" {
+			parsed, err := time.ParseInLocation("2006-01-02", fromStr, localTimeZone)
+			if err != nil {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid from date", nil, ResponseDetails("from", fromStr, "details", "expected YYYY-MM-DD", "error", err.Error()))
+			}
+			from = parsed
+		}
+		if toStr := c.QueryParam("to"); toStr != "" {
+			parsed, err := time.ParseInLocation("2006-01-02", toStr, localTimeZone)
+			if err != nil {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid to date", nil, ResponseDetails("to", toStr, "details", "expected YYYY-MM-DD", "error", err.Error()))
+			}
+			to = parsed
+		}
+
+		// to is inclusive
+		end := to.AddDate(0, 0, 1)
+		if !end.After(from) {
+			return JsonApiResponse(c, http.StatusBadRequest, "from must be before to", nil, ResponseDetails("from", from.Format("2006-01-02"), "to", to.Format("2006-01-02")))
+		}
+		if end.Sub(from) > maxAnalyticsRange {
+			return JsonApiResponse(c, http.StatusBadRequest, "date range too large", nil, ResponseDetails("details", "the range can be at most 31 days"))
+		}
+
+		routeFilter := c.QueryParam("route")
+		stopFilter := c.QueryParam("stop")
+
+		// Trips after midnight are recorded on the next day, so look a few hours either side
+		observations, err := hsdb.GetTripObservations(from.Add(-6*time.Hour).Unix(), end.Add(6*time.Hour).Unix(), routeFilter)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "failed to load recorded trips", nil, ResponseDetails("error", err.Error()))
+		}
+
+		routes := getRouteCache()
+		groups := make(map[string]*otpAccumulator)
+		for _, sample := range collectOTPSamples(observations, gtfsData, localTimeZone) {
+			if sample.scheduled.Before(from) || !sample.scheduled.Before(end) {
+				continue
+			}
+			if stopFilter != "" && sample.stopId != stopFilter {
+				continue
+			}
+
+			var key, name string
+			switch groupBy {
+			case "routes":
+				key = sample.routeId
+				if route, found := routes[sample.routeId]; found {
+					name = route.RouteShortName
+				}
+			case "stops":
+				key, name = sample.stopId, sample.stopName
+			case "hours":
+				key = fmt.Sprintf("%02d", sample.scheduled.In(localTimeZone).Hour())
+			}
+
+			group, found := groups[key]
+			if !found {
+				group = &otpAccumulator{name: name}
+				groups[key] = group
+			}
+			if sample.cancelled {
+				group.cancelled++
+			} else {
+				group.delays = append(group.delays, sample.delay)
+			}
+		}
+
+		results := make([]OTPStats, 0, len(groups))
+		for key, group := range groups {
+			results = append(results, group.stats(key))
+		}
+		slices.SortFunc(results, func(a, b OTPStats) int {
+			return strings.Compare(a.Key, b.Key)
+		})
+
+		return JsonApiResponse(c, http.StatusOK, "", map[string]any{
+			"from":     from.Format("2006-01-02"),
+			"to":       to.Format("2006-01-02"),
+			"group_by": groupBy,
+			"results":  results,
+		})
+	})
+}
@@ -0,0 +1,205 @@
+package providers
+
+import (
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/delays"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/at-trains-api/providers/staticfeed"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// How often the static feed is read again for its blocks and version, the gtfs database is reloaded about as often
+const staticFeedRefreshInterval = 24 * time.Hour
+
+/*
+Works out where vehicles go after the trip they are running, from the blocks (trips run one after the other by the
+same vehicle) in the static feed.
+
+A vehicle that finishes its trip late starts its next one late too, unless the layover in between absorbs it.
+*/
+type vehicleBlocks struct {
+	gtfsData      gtfs.Database
+	source        *staticfeed.Source
+	localTimeZone *time.Location
+}
+
+// A trip a vehicle is going to run after its current one
+type NextTrip struct {
+	TripId         string `json:"trip_id"`
+	RouteId        string `json:"route_id"`
+	Headsign       string `json:"headsign"`
+	ServiceDate    string `json:"service_date"`    // YYYYMMDD
+	ScheduledStart string `json:"scheduled_start"` // HH:MM:SS
+	PredictedStart string `json:"predicted_start"` // HH:MM:SS
+	Delay          int    `json:"delay"`           // Seconds late it is predicted to start
+}
+
+// Whether the static feed has been read, nil blocks never are
+func (b *vehicleBlocks) loaded() bool {
+	return b != nil && b.source.Feed() != nil
+}
+
+// The service day a trip with realtime data is running on
+func (b *vehicleBlocks) tripDay(tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition, stopTimes []gtfs.TripStopTime, now time.Time) (time.Time, bool) {
+	if len(stopTimes) == 0 {
+		return time.Time{}, false
+	}
+	firstDeparture := stopTimes[0].DepartureTime
+	if firstDeparture == "" {
+		firstDeparture = stopTimes[0].ArrivalTime
+	}
+	return servicetime.TripDay(tripStartDate(tripUpdate, vehicle, ""), firstDeparture, now, b.localTimeZone)
+}
+
+/*
+How late a trip is predicted to reach its last stop, from its trip update or failing that where the vehicle is.
+
+ok is false if nothing is known about how late it is.
+*/
+func (b *vehicleBlocks) endDelay(tripId string, serviceDay time.Time, tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition, stopTimesCache *tripStopTimesCache, now time.Time) (time.Duration, bool) {
+	stopTimes := stopTimesCache.get(tripId)
+	stops := delays.ScheduledStops(stopTimes, serviceDay)
+	if len(stops) == 0 {
+		return 0, false
+	}
+	last := stops[len(stops)-1]
+
+	if tripUpdate != nil {
+		if prediction := delays.Propagate(stops, tripUpdate)[last.Sequence]; prediction.Known {
+			return prediction.Arrival.Sub(last.Arrival), true
+		}
+	}
+	if vehicle != nil {
+		if arrival, passed, ok := estimateArrivalFromPosition(last.Sequence, stopTimes, stopTimesCache.shape(tripId), vehicle, now); ok && !passed {
+			return arrival.Sub(last.Arrival), true
+		}
+	}
+	return 0, false
+}
+
+/*
+The trips after tripId in its block on serviceDay, with the lateness it finishes with carried over. Each trip starts
+at its scheduled time or once the one before it has finished, whichever is later.
+
+limit <= 0 returns all of them. Empty if the trip isn't in a block or the static feed hasn't been read.
+*/
+func (b *vehicleBlocks) nextTrips(tripId string, serviceDay time.Time, endDelay time.Duration, limit int) []NextTrip {
+	if b == nil {
+		return nil
+	}
+	feed := b.source.Feed()
+	current, found := findBlockTrip(feed.Block(tripId, serviceDay), tripId)
+	if !found {
+		return nil
+	}
+
+	serviceDate := servicetime.Date(serviceDay)
+	previousEnd := serviceDay.Add(time.Duration(current.End)*time.Second + endDelay)
+
+	var result []NextTrip
+	for _, trip := range feed.NextTrips(tripId, serviceDay) {
+		if limit > 0 && len(result) >= limit {
+			break
+		}
+		scheduledStart := serviceDay.Add(time.Duration(trip.Start) * time.Second)
+		predictedStart := scheduledStart
+		if previousEnd.After(predictedStart) {
+			predictedStart = previousEnd
+		}
+		delay := predictedStart.Sub(scheduledStart)
+		previousEnd = serviceDay.Add(time.Duration(trip.End)*time.Second + delay)
+
+		next := NextTrip{
+			TripId:         trip.TripId,
+			ServiceDate:    serviceDate,
+			ScheduledStart: servicetime.Format(scheduledStart.Sub(serviceDay)),
+			PredictedStart: servicetime.Format(predictedStart.Sub(serviceDay)),
+			Delay:          int(delay.Seconds()),
+		}
+		if tripData, err := b.gtfsData.GetTripByID(trip.TripId); err == nil {
+			next.RouteId = tripData.RouteID
+			next.Headsign = tripData.TripHeadsign
+		}
+		result = append(result, next)
+	}
+	return result
+}
+
+/*
+The trips a vehicle runs after the one it's on, up to limit (<= 0 for all of them), and how late it is predicted to
+finish the one it's on. Empty if that trip isn't in a block or the static feed hasn't been read.
+*/
+func (b *vehicleBlocks) forVehicle(tripId string, tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition, stopTimesCache *tripStopTimesCache, limit int, now time.Time) (serviceDay time.Time, endDelay time.Duration, next []NextTrip) {
+	if !b.loaded() {
+		return time.Time{}, 0, nil
+	}
+	serviceDay, ok := b.tripDay(tripUpdate, vehicle, stopTimesCache.get(tripId), now)
+	if !ok {
+		return time.Time{}, 0, nil
+	}
+	// Without a prediction it's assumed to finish on time
+	endDelay, _ = b.endDelay(tripId, serviceDay, tripUpdate, vehicle, stopTimesCache, now)
+	return serviceDay, endDelay, b.nextTrips(tripId, serviceDay, endDelay, limit)
+}
+
+func findBlockTrip(block []staticfeed.Trip, tripId string) (staticfeed.Trip, bool) {
+	for _, trip := range block {
+		if trip.TripId == tripId {
+			return trip, true
+		}
+	}
+	return staticfeed.Trip{}, false
+}
+
+/*
+How late a trip without realtime data of its own is predicted to start, from the closest earlier trip in its block
+that does have realtime data for the same service day.
+
+ok is false if no earlier trip in the block is being tracked or the static feed hasn't been read.
+*/
+func (b *vehicleBlocks) inboundDelay(tripId string, serviceDay time.Time, vehicles rt.VehiclesMap, tripUpdates rt.TripUpdatesMap, stopTimesCache *tripStopTimesCache, now time.Time) (time.Duration, bool) {
+	if !b.loaded() {
+		return 0, false
+	}
+	serviceDate := servicetime.Date(serviceDay)
+
+	block := b.source.Feed().Block(tripId, serviceDay)
+	current := -1
+	for i, trip := range block {
+		if trip.TripId == tripId {
+			current = i
+			break
+		}
+	}
+
+	for i := current - 1; i >= 0; i-- {
+		earlier := block[i].TripId
+
+		tripUpdate, err := tripUpdates.ByTripID(earlier)
+		if err != nil || !forServiceDate(tripUpdate.GetTrip().GetStartDate(), serviceDate) {
+			tripUpdate = nil
+		}
+		vehicle, err := vehicles.ByTripID(earlier)
+		if err != nil || !forServiceDate(vehicle.GetTrip().GetStartDate(), serviceDate) {
+			vehicle = nil
+		}
+		if tripUpdate == nil && vehicle == nil {
+			continue
+		}
+
+		endDelay, ok := b.endDelay(earlier, serviceDay, tripUpdate, vehicle, stopTimesCache, now)
+		if !ok {
+			return 0, false
+		}
+		for _, next := range b.nextTrips(earlier, serviceDay, endDelay, 0) {
+			if next.TripId == tripId {
+				return time.Duration(next.Delay) * time.Second, true
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
@@ -2,7 +2,11 @@ package caches
 
 import (
 	"log"
+	"math"
+	"sync/atomic"
+	"time"
 
+	"github.com/jfmow/at-trains-api/metrics"
 	"github.com/jfmow/gtfs"
 )
 
@@ -16,6 +20,15 @@ type ParentStopsCache func() []gtfs.Stop
 type ParentStopsByChildCache func() map[string]gtfs.Stop
 type AllStopsCache func() []gtfs.Stop
 type RouteCache func() map[string]gtfs.Route
+type StopsCoverageCache func() StopsCoverage
+
+// Bounding box and mean position of the parent stops, stops without a location are skipped
+type StopsCoverage struct {
+	Stops                    int // 0 if there are no stops with a location, the rest are unset then
+	MinLat, MinLon           float64
+	MaxLat, MaxLon           float64
+	CentroidLat, CentroidLon float64
+}
 
 type Caches struct {
 	GetStopsForTripCache       StopsForTripCache
@@ -23,10 +36,42 @@ type Caches struct {
 	GetParentStopsByChildCache ParentStopsByChildCache
 	GetAllStopsCache           AllStopsCache
 	GetRouteCache              RouteCache
+	GetStopsCoverageCache      StopsCoverageCache
+
+	rebuiltAt *atomic.Int64
+}
+
+// Last time the route cache was rebuilt from the gtfs database, zero if it never was
+func (c Caches) RebuiltAt() time.Time {
+	if c.rebuiltAt == nil || c.rebuiltAt.Load() == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, c.rebuiltAt.Load())
+}
+
+/*
+gtfs.GenerateACache, with each rebuild recorded in the cache_rebuild_duration metric.
+
+A rebuild is the fetch and the transform, a failed fetch is recorded on its own.
+*/
+func timedCache[T any, R any](provider, cache string, fetch func() (T, error), transform func(T) (R, error), initial R, gtfsData gtfs.Database) (func() R, error) {
+	started := new(atomic.Int64)
+	return gtfs.GenerateACache(func() (T, error) {
+		started.Store(time.Now().UnixNano())
+		result, err := fetch()
+		if err != nil {
+			metrics.ObserveCacheRebuild(provider, cache, time.Since(time.Unix(0, started.Load())))
+		}
+		return result, err
+	}, func(input T) (R, error) {
+		result, err := transform(input)
+		metrics.ObserveCacheRebuild(provider, cache, time.Since(time.Unix(0, started.Load())))
+		return result, err
+	}, initial, gtfsData)
 }
 
-func CreateCaches(gtfsData gtfs.Database) Caches {
-	getStopsForTripCache, err := gtfs.GenerateACache(
+func CreateCaches(provider string, gtfsData gtfs.Database) Caches {
+	getStopsForTripCache, err := timedCache(provider, "stops_for_trip",
 		func() (map[string][]gtfs.Stop, error) {
 			trips, err := gtfsData.GetStopsForTrips(2)
 			return trips, err
@@ -55,7 +100,7 @@ func CreateCaches(gtfsData gtfs.Database) Caches {
 	}
 
 	//Does not include child stops
-	getParentStopsCache, err := gtfs.GenerateACache(func() ([]gtfs.Stop, error) {
+	getParentStopsCache, err := timedCache(provider, "parent_stops", func() ([]gtfs.Stop, error) {
 		stops, err := gtfsData.GetStops(false)
 		return stops, err
 	}, gtfs.Identity[[]gtfs.Stop], nil, gtfsData)
@@ -63,7 +108,7 @@ func CreateCaches(gtfsData gtfs.Database) Caches {
 		log.Fatal(err)
 	}
 
-	getParentStopsByChildCache, err := gtfs.GenerateACache(func() (map[string]gtfs.Stop, error) {
+	getParentStopsByChildCache, err := timedCache(provider, "parent_stops_by_child", func() (map[string]gtfs.Stop, error) {
 		allStops, err := gtfsData.GetStopsMap(true)
 		if err != nil {
 			return nil, err
@@ -88,8 +133,43 @@ func CreateCaches(gtfsData gtfs.Database) Caches {
 		log.Fatal(err)
 	}
 
+	getStopsCoverageCache, err := timedCache(provider, "stops_coverage", func() ([]gtfs.Stop, error) {
+		stops, err := gtfsData.GetStops(false)
+		return stops, err
+	}, func(stops []gtfs.Stop) (StopsCoverage, error) {
+		var (
+			coverage       StopsCoverage
+			sumLat, sumLon float64
+		)
+		for _, stop := range stops {
+			if stop.StopLat == 0 && stop.StopLon == 0 {
+				continue
+			}
+			if coverage.Stops == 0 {
+				coverage.MinLat, coverage.MaxLat = stop.StopLat, stop.StopLat
+				coverage.MinLon, coverage.MaxLon = stop.StopLon, stop.StopLon
+			} else {
+				coverage.MinLat = math.Min(coverage.MinLat, stop.StopLat)
+				coverage.MinLon = math.Min(coverage.MinLon, stop.StopLon)
+				coverage.MaxLat = math.Max(coverage.MaxLat, stop.StopLat)
+				coverage.MaxLon = math.Max(coverage.MaxLon, stop.StopLon)
+			}
+			sumLat += stop.StopLat
+			sumLon += stop.StopLon
+			coverage.Stops++
+		}
+		if coverage.Stops > 0 {
+			coverage.CentroidLat = sumLat / float64(coverage.Stops)
+			coverage.CentroidLon = sumLon / float64(coverage.Stops)
+		}
+		return coverage, nil
+	}, StopsCoverage{}, gtfsData)
+	if err != nil {
+		log.Printf("Failed to init stops coverage cache: %v", err)
+	}
+
 	//Does include child stops
-	getAllStopsCache, err := gtfs.GenerateACache(func() ([]gtfs.Stop, error) {
+	getAllStopsCache, err := timedCache(provider, "all_stops", func() ([]gtfs.Stop, error) {
 		stops, err := gtfsData.GetStops(true)
 		return stops, err
 	}, gtfs.Identity[[]gtfs.Stop], nil, gtfsData)
@@ -97,7 +177,14 @@ func CreateCaches(gtfsData gtfs.Database) Caches {
 		log.Fatal(err)
 	}
 
-	getRouteCache, err := gtfs.GenerateACache(gtfsData.GetRoutes, func(routes []gtfs.Route) (map[string]gtfs.Route, error) {
+	rebuiltAt := new(atomic.Int64)
+	getRouteCache, err := timedCache(provider, "routes", func() ([]gtfs.Route, error) {
+		routes, err := gtfsData.GetRoutes()
+		if err == nil {
+			rebuiltAt.Store(time.Now().UnixNano())
+		}
+		return routes, err
+	}, func(routes []gtfs.Route) (map[string]gtfs.Route, error) {
 		newCache := make(map[string]gtfs.Route)
 		for _, route := range routes {
 			newCache[route.RouteId] = route
@@ -114,5 +201,7 @@ func CreateCaches(gtfsData gtfs.Database) Caches {
 		GetParentStopsByChildCache: getParentStopsByChildCache,
 		GetAllStopsCache:           getAllStopsCache,
 		GetRouteCache:              getRouteCache,
+		GetStopsCoverageCache:      getStopsCoverageCache,
+		rebuiltAt:                  rebuiltAt,
 	}
 }
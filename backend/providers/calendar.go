@@ -0,0 +1,102 @@
+package providers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v5"
+)
+
+const icalendarTimeFormat = "20060102T150405Z"
+
+// Escapes a TEXT value (RFC 5545 3.3.11)
+var icalendarEscaper = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+type icalendarWriter struct {
+	strings.Builder
+}
+
+// Writes a content line, folding it so no line is longer than 75 octets (without splitting a utf-8 character)
+func (w *icalendarWriter) line(name, value string) {
+	content := name + ":" + value
+	width := 75
+	for len(content) > width {
+		cut := width
+		for cut > 0 && !isUtf8Start(content[cut]) {
+			cut--
+		}
+		w.WriteString(content[:cut])
+		w.WriteString("\r\n ")
+		content = content[cut:]
+		// The leading space of a folded line counts towards its length
+		width = 74
+	}
+	w.WriteString(content)
+	w.WriteString("\r\n")
+}
+
+func isUtf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+/*
+Writes alerts as an icalendar feed, with one event per active period so each closure shows up on the days it happens.
+
+Periods that have already ended are left out, and so are alerts without a start (they're about what's happening now, not planned).
+An open ended period becomes an event at its start time.
+*/
+func writeAlertsCalendar(c echo.Context, name string, location string, alerts []AlertDetails) error {
+	now := time.Now()
+	host := c.Request().Host
+
+	var calendar icalendarWriter
+	calendar.line("BEGIN", "VCALENDAR")
+	calendar.line("VERSION", "2.0")
+	calendar.line("PRODID", "-//at-trains-api//alerts//EN")
+	calendar.line("CALSCALE", "GREGORIAN")
+	calendar.line("METHOD", "PUBLISH")
+	calendar.line("X-WR-CALNAME", icalendarEscaper.Replace(name))
+	// Calendar apps refresh subscriptions at this interval
+	calendar.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	calendar.line("X-PUBLISHED-TTL", "PT1H")
+
+	for _, alert := range alerts {
+		for _, period := range alert.ActivePeriods {
+			if period.Start == 0 || (period.End != 0 && int64(period.End) < now.Unix()) {
+				continue
+			}
+
+			summary := alert.Title
+			if summary == "" {
+				summary = strings.ReplaceAll(alert.Effect, "_", " ")
+			}
+
+			calendar.line("BEGIN", "VEVENT")
+			calendar.line("UID", icalendarEscaper.Replace(fmt.Sprintf("%s-%d@%s", alert.ID, period.Start, host)))
+			calendar.line("DTSTAMP", now.UTC().Format(icalendarTimeFormat))
+			calendar.line("DTSTART", time.Unix(int64(period.Start), 0).UTC().Format(icalendarTimeFormat))
+			if period.End != 0 {
+				calendar.line("DTEND", time.Unix(int64(period.End), 0).UTC().Format(icalendarTimeFormat))
+			}
+			calendar.line("SUMMARY", icalendarEscaper.Replace(summary))
+			if alert.Description != "" {
+				calendar.line("DESCRIPTION", icalendarEscaper.Replace(alert.Description))
+			}
+			if location != "" {
+				calendar.line("LOCATION", icalendarEscaper.Replace(location))
+			}
+			if alert.URL != "" {
+				calendar.line("URL", alert.URL)
+			}
+			calendar.line("CATEGORIES", icalendarEscaper.Replace(alert.Effect))
+			calendar.line("TRANSP", "TRANSPARENT")
+			calendar.line("END", "VEVENT")
+		}
+	}
+
+	calendar.line("END", "VCALENDAR")
+
+	return c.Blob(http.StatusOK, "text/calendar; charset=utf-8", []byte(calendar.String()))
+}
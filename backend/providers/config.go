@@ -0,0 +1,184 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ProviderConfig describes a single region/agency served under /{prefix}.
+//
+// Secrets are never stored in the config file, instead the *_env fields name the
+// environment variable that holds the key.
+type ProviderConfig struct {
+	Prefix       string             `json:"prefix"`
+	Name         string             `json:"name"`
+	Enabled      bool               `json:"enabled"`
+	TimeZone     string             `json:"timezone"`
+	ContactEmail string             `json:"contact_email"`
+	Database     string             `json:"database"`
+	RateLimited  bool               `json:"rate_limited"`
+	Static       StaticFeedConfig   `json:"static"`
+	Realtime     RealtimeFeedConfig `json:"realtime"`
+	History      HistoryConfig      `json:"history"`
+}
+
+type StaticFeedConfig struct {
+	URL        string `json:"url"`
+	AuthHeader string `json:"auth_header"`
+	AuthKeyEnv string `json:"auth_key_env"`
+}
+
+type RealtimeFeedConfig struct {
+	VehiclePositionsURL string `json:"vehicle_positions_url"`
+	TripUpdatesURL      string `json:"trip_updates_url"`
+	AlertsURL           string `json:"alerts_url"`
+	AuthHeader          string `json:"auth_header"`
+	AuthKeyEnv          string `json:"auth_key_env"`
+	PollInterval        string `json:"poll_interval"` // e.g "17s"
+}
+
+// Recording of realtime trip updates and vehicle positions, served under /{prefix}/hs
+type HistoryConfig struct {
+	Enabled   bool   `json:"enabled"`
+	Retention string `json:"retention"` // e.g "168h"
+}
+
+type providersFile struct {
+	Providers []ProviderConfig `json:"providers"`
+}
+
+// LoadProviderConfigs reads and validates the provider registry file
+func LoadProviderConfigs(path string) ([]ProviderConfig, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read provider config: %w", err)
+	}
+
+	var file providersFile
+	if err := json.Unmarshal(raw, &file); err != nil {
+		return nil, fmt.Errorf("parse provider config: %w", err)
+	}
+
+	if len(file.Providers) == 0 {
+		return nil, errors.New("provider config has no providers")
+	}
+
+	seen := make(map[string]struct{}, len(file.Providers))
+	for i, cfg := range file.Providers {
+		if err := cfg.validate(); err != nil {
+			return nil, fmt.Errorf("provider %d (%q): %w", i, cfg.Prefix, err)
+		}
+		if _, exists := seen[cfg.Prefix]; exists {
+			return nil, fmt.Errorf("duplicate provider prefix %q", cfg.Prefix)
+		}
+		seen[cfg.Prefix] = struct{}{}
+	}
+
+	return file.Providers, nil
+}
+
+func (cfg ProviderConfig) validate() error {
+	if cfg.Prefix == "" || strings.ContainsAny(cfg.Prefix, "/ ") {
+		return errors.New("prefix must be a non empty path segment")
+	}
+	if cfg.Static.URL == "" {
+		return errors.New("missing static feed url")
+	}
+	if _, err := cfg.Location(); err != nil {
+		return err
+	}
+	if _, err := cfg.Realtime.Interval(); err != nil {
+		return err
+	}
+	if _, err := cfg.History.RetentionPeriod(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Location returns the providers time zone, defaults to Pacific/Auckland
+func (cfg ProviderConfig) Location() (*time.Location, error) {
+	name := cfg.TimeZone
+	if name == "" {
+		name = "Pacific/Auckland"
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %w", name, err)
+	}
+	return loc, nil
+}
+
+// DatabaseName is the name of the local gtfs db, defaults to {prefix}gtfs
+func (cfg ProviderConfig) DatabaseName() string {
+	if cfg.Database != "" {
+		return cfg.Database
+	}
+	return cfg.Prefix + "gtfs"
+}
+
+// DisplayName falls back to the prefix when no name is set
+func (cfg ProviderConfig) DisplayName() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return cfg.Prefix
+}
+
+/*
+Returns the value of the static feed key env var.
+
+A static feed without auth_key_env is public, so "" is returned with found = true
+*/
+func (s StaticFeedConfig) AuthKey() (key string, found bool) {
+	if s.AuthKeyEnv == "" {
+		return "", true
+	}
+	return os.LookupEnv(s.AuthKeyEnv)
+}
+
+/*
+Returns the value of the realtime key env var.
+
+A realtime feed without auth_key_env is public, so "" is returned with found = true
+*/
+func (r RealtimeFeedConfig) AuthKey() (key string, found bool) {
+	if r.AuthKeyEnv == "" {
+		return "", true
+	}
+	return os.LookupEnv(r.AuthKeyEnv)
+}
+
+// Interval is how often the realtime feeds are refreshed, defaults to 15s
+func (r RealtimeFeedConfig) Interval() (time.Duration, error) {
+	if r.PollInterval == "" {
+		return 15 * time.Second, nil
+	}
+	interval, err := time.ParseDuration(r.PollInterval)
+	if err != nil {
+		return 0, fmt.Errorf("invalid poll_interval %q: %w", r.PollInterval, err)
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("poll_interval must be positive, got %q", r.PollInterval)
+	}
+	return interval, nil
+}
+
+// RetentionPeriod is how long recorded history is kept, defaults to 7 days
+func (h HistoryConfig) RetentionPeriod() (time.Duration, error) {
+	if h.Retention == "" {
+		return 7 * 24 * time.Hour, nil
+	}
+	retention, err := time.ParseDuration(h.Retention)
+	if err != nil {
+		return 0, fmt.Errorf("invalid history retention %q: %w", h.Retention, err)
+	}
+	if retention <= 0 {
+		return 0, fmt.Errorf("history retention must be positive, got %q", h.Retention)
+	}
+	return retention, nil
+}
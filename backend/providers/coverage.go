@@ -0,0 +1,394 @@
+package providers
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+const (
+	// Realtime data older than this (or missing) for a running trip means tracking has gone silent
+	trackingSilentAfter = 5 * time.Minute
+	// Trips are forgotten this long after their realtime was last seen
+	sightingRetention = 12 * time.Hour
+	// A running trip is found by looking for it at the stops it will reach within this long
+	coverageLookahead = 15 * time.Minute
+	// The schedule sweep behind /realtime/coverage queries every stop, so it is reused for this long
+	coverageSweepTTL = 2 * time.Minute
+	// Trips get this long after their scheduled start before they are expected to show up in realtime
+	trackingStartGrace = 2 * time.Minute
+)
+
+// How much a departures realtime data can be trusted
+const (
+	TrackingHigh        = "high"        // fresh vehicle position and trip update
+	TrackingMedium      = "medium"      // only one of them is fresh
+	TrackingLow         = "low"         // the trip should be running but realtime is missing or went silent
+	TrackingScheduled   = "scheduled"   // the trip hasn't started, no realtime is expected yet
+	TrackingUnavailable = "unavailable" // the provider has no realtime
+)
+
+/*
+realtimeSightings remembers when each trip was last seen with fresh data in the realtime feeds,
+so a trip that drops out of the feeds part way through a run can be told apart from one that never had realtime.
+
+It is fed by the FeedMonitor every poll.
+*/
+type realtimeSightings struct {
+	mu       sync.RWMutex
+	lastSeen map[string]time.Time
+}
+
+func newRealtimeSightings() *realtimeSightings {
+	return &realtimeSightings{lastSeen: make(map[string]time.Time)}
+}
+
+func (s *realtimeSightings) observeVehicles(vehicles rt.VehiclesMap) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, vehicle := range vehicles {
+		s.record(vehicle.GetTrip().GetTripId(), entityTime(vehicle.GetTimestamp(), now))
+	}
+	s.prune(now)
+}
+
+func (s *realtimeSightings) observeTripUpdates(tripUpdates rt.TripUpdatesMap) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tripUpdate := range tripUpdates {
+		s.record(tripUpdate.GetTrip().GetTripId(), entityTime(tripUpdate.GetTimestamp(), now))
+	}
+	s.prune(now)
+}
+
+// s.mu must be held
+func (s *realtimeSightings) record(tripID string, at time.Time) {
+	if tripID == "" {
+		return
+	}
+	if at.After(s.lastSeen[tripID]) {
+		s.lastSeen[tripID] = at
+	}
+}
+
+// s.mu must be held
+func (s *realtimeSightings) prune(now time.Time) {
+	for tripID, lastSeen := range s.lastSeen {
+		if now.Sub(lastSeen) > sightingRetention {
+			delete(s.lastSeen, tripID)
+		}
+	}
+}
+
+// When the trip was last seen in the realtime feeds, zero if it hasn't been
+func (s *realtimeSightings) LastSeen(tripID string) time.Time {
+	if s == nil {
+		return time.Time{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.lastSeen[tripID]
+}
+
+// Entities without a timestamp are treated as fresh
+func entityTime(timestamp uint64, now time.Time) time.Time {
+	if timestamp == 0 {
+		return now
+	}
+	return time.Unix(int64(timestamp), 0)
+}
+
+// Whether a trip has fresh vehicle position and trip update data
+func realtimeFreshness(vehicle *proto.VehiclePosition, tripUpdate *proto.TripUpdate, now time.Time) (freshPosition, freshUpdate bool) {
+	if vehicle != nil {
+		freshPosition = now.Sub(entityTime(vehicle.GetTimestamp(), now)) <= trackingSilentAfter
+	}
+	if tripUpdate != nil {
+		freshUpdate = now.Sub(entityTime(tripUpdate.GetTimestamp(), now)) <= trackingSilentAfter
+	}
+	return freshPosition, freshUpdate
+}
+
+/*
+Rates how much the realtime data for a departure can be trusted.
+
+realtimeAvailable is false for providers without realtime, scheduledStart is when the trip leaves its first stop
+and is only called if the trip has no fresh realtime (it reads the trips stop times).
+*/
+func trackingConfidence(realtimeAvailable bool, vehicle *proto.VehiclePosition, tripUpdate *proto.TripUpdate, lastSeen time.Time, scheduledStart func() time.Time, now time.Time) string {
+	if !realtimeAvailable {
+		return TrackingUnavailable
+	}
+
+	freshPosition, freshUpdate := realtimeFreshness(vehicle, tripUpdate, now)
+	switch {
+	case freshPosition && freshUpdate:
+		return TrackingHigh
+	case freshPosition || freshUpdate:
+		return TrackingMedium
+	case !lastSeen.IsZero():
+		// Realtime went silent part way through the run
+		return TrackingLow
+	}
+
+	// Should have started by now but nothing has been seen
+	if start := scheduledStart(); !start.IsZero() && now.After(start.Add(trackingStartGrace)) {
+		return TrackingLow
+	}
+	return TrackingScheduled
+}
+
+type CoverageTrip struct {
+	TripID         string `json:"trip_id"`
+	RouteID        string `json:"route_id"`
+	RouteShortName string `json:"route_short_name"`
+	Headsign       string `json:"headsign"`
+	NextStopID     string `json:"next_stop_id"`
+	NextStopTime   string `json:"next_stop_time"`            // Scheduled, HH:MM:SS
+	LastSeen       int64  `json:"last_seen,omitempty"`       // Unix seconds, silent trips only
+	SilentFor      int64  `json:"silent_for,omitempty"`      // Seconds, silent trips only
+	HasPosition    bool   `json:"has_position,omitempty"`    // Silent trips can still be in the feed with stale data
+	HasTripUpdate  bool   `json:"has_trip_update,omitempty"` // ^
+}
+
+type RouteCoverage struct {
+	RouteID            string  `json:"route_id"`
+	RouteShortName     string  `json:"route_short_name"`
+	Expected           int     `json:"expected"`
+	Tracked            int     `json:"tracked"`
+	WithPosition       int     `json:"with_position"`
+	WithTripUpdate     int     `json:"with_trip_update"`
+	TrackingPercentage float64 `json:"tracking_percentage"`
+}
+
+type CoverageResponse struct {
+	GeneratedAt        int64           `json:"generated_at"`
+	ScheduleSweptAt    int64           `json:"schedule_swept_at"`
+	ExpectedTrips      int             `json:"expected_trips"`
+	TrackedTrips       int             `json:"tracked_trips"`
+	TrackingPercentage float64         `json:"tracking_percentage"`
+	Routes             []RouteCoverage `json:"routes"`
+	GhostTrips         []CoverageTrip  `json:"ghost_trips"`  // Running by the schedule, but never seen in realtime
+	SilentTrips        []CoverageTrip  `json:"silent_trips"` // Seen in realtime earlier in the run, but not any more
+}
+
+/*
+coverageReport compares the trips the timetable says are running against the realtime feeds.
+
+Finding the running trips means asking every stop what will arrive there in the next coverageLookahead,
+so the result of that is kept for coverageSweepTTL.
+*/
+type coverageReport struct {
+	gtfsData             gtfs.Database
+	realtime             rt.Realtime
+	localTimeZone        *time.Location
+	sightings            *realtimeSightings
+	getAllStopsCache     caches.AllStopsCache
+	getStopsForTripCache caches.StopsForTripCache
+	getRouteCache        caches.RouteCache
+
+	mu       sync.Mutex
+	sweptAt  time.Time
+	expected map[string]gtfs.StopTimes // trip id -> the next stop it will reach
+	// Closed when the running sweep finishes, nil when there isn't one
+	sweeping chan struct{}
+}
+
+/*
+The last sweep of expected trips, sweeping again once it's older than coverageSweepTTL.
+
+The sweep reads every stop so it runs without the lock held, and only one runs at a time. Requests that come in while
+it's running get the previous sweep, or wait for it if there isn't one yet.
+*/
+func (r *coverageReport) expectedTrips(now time.Time) (map[string]gtfs.StopTimes, time.Time) {
+	r.mu.Lock()
+	for {
+		if r.expected != nil && (now.Sub(r.sweptAt) < coverageSweepTTL || r.sweeping != nil) {
+			expected, sweptAt := r.expected, r.sweptAt
+			r.mu.Unlock()
+			return expected, sweptAt
+		}
+		if r.sweeping == nil {
+			break
+		}
+		sweeping := r.sweeping
+		r.mu.Unlock()
+		<-sweeping
+		r.mu.Lock()
+	}
+	done := make(chan struct{})
+	r.sweeping = done
+	r.mu.Unlock()
+
+	expected := r.sweep(now)
+
+	r.mu.Lock()
+	r.expected = expected
+	r.sweptAt = now
+	r.sweeping = nil
+	r.mu.Unlock()
+	close(done)
+
+	return expected, now
+}
+
+/*
+Trips that have left their first stop and have a stop in the next coverageLookahead.
+
+A trip whose next stop is further away than that is missed, which only really happens on long express runs.
+*/
+func (r *coverageReport) sweep(now time.Time) map[string]gtfs.StopTimes {
+	local := now.In(r.localTimeZone)
+	lookaheadEnd := local.Add(coverageLookahead)
+	stopsForTrip := r.getStopsForTripCache()
+
+	expected := make(map[string]gtfs.StopTimes)
+	// trip id -> sequence of the earliest stop it was found at
+	earliest := make(map[string]int)
+
+	for _, stop := range r.getAllStopsCache() {
+		// Stations don't have services, their platforms do
+		if stop.LocationType == 1 {
+			continue
+		}
+		// After midnight the previous service days trips are still running, on times past 24:00:00
+		for _, serviceDay := range runningServiceDays(local, r.localTimeZone) {
+			from := servicetime.Format(local.Sub(serviceDay))
+			services, err := r.gtfsData.GetActiveTrips(stop.StopId, from, serviceDay.Add(12*time.Hour), 10)
+			if err != nil {
+				continue
+			}
+			for _, service := range services {
+				arrival, ok := servicetime.At(service.ArrivalTime, serviceDay)
+				if !ok || arrival.Before(local) || arrival.After(lookaheadEnd) {
+					continue
+				}
+				if sequence, found := earliest[service.TripID]; found && sequence <= service.StopSequence {
+					continue
+				}
+				earliest[service.TripID] = service.StopSequence
+				expected[service.TripID] = service
+			}
+		}
+	}
+
+	// Trips only found at their first stop haven't left yet
+	for tripID, sequence := range earliest {
+		trip, found := stopsForTrip[tripID]
+		if !found || sequence <= trip.LowestSequence {
+			delete(expected, tripID)
+		}
+	}
+
+	return expected
+}
+
+func (r *coverageReport) build(now time.Time) CoverageResponse {
+	expected, sweptAt := r.expectedTrips(now)
+
+	vehicles, _ := r.realtime.GetVehicles()
+	tripUpdates, _ := r.realtime.GetTripUpdates()
+	routeCache := r.getRouteCache()
+
+	response := CoverageResponse{
+		GeneratedAt:     now.Unix(),
+		ScheduleSweptAt: sweptAt.Unix(),
+		ExpectedTrips:   len(expected),
+		Routes:          []RouteCoverage{},
+		GhostTrips:      []CoverageTrip{},
+		SilentTrips:     []CoverageTrip{},
+	}
+
+	routes := make(map[string]*RouteCoverage)
+	for tripID, service := range expected {
+		routeID := service.TripData.RouteID
+
+		route, found := routes[routeID]
+		if !found {
+			route = &RouteCoverage{RouteID: routeID, RouteShortName: routeCache[routeID].RouteShortName}
+			routes[routeID] = route
+		}
+		route.Expected++
+
+		vehicle, _ := vehicles.ByTripID(tripID)
+		tripUpdate, _ := tripUpdates.ByTripID(tripID)
+		freshPosition, freshUpdate := realtimeFreshness(vehicle, tripUpdate, now)
+		if freshPosition {
+			route.WithPosition++
+		}
+		if freshUpdate {
+			route.WithTripUpdate++
+		}
+		if freshPosition || freshUpdate {
+			route.Tracked++
+			response.TrackedTrips++
+			continue
+		}
+
+		headsign := service.StopHeadsign
+		if headsign == "" {
+			headsign = service.TripData.TripHeadsign
+		}
+		coverageTrip := CoverageTrip{
+			TripID:         tripID,
+			RouteID:        routeID,
+			RouteShortName: route.RouteShortName,
+			Headsign:       headsign,
+			NextStopID:     service.StopId,
+			NextStopTime:   service.ArrivalTime,
+		}
+
+		if lastSeen := r.sightings.LastSeen(tripID); !lastSeen.IsZero() {
+			coverageTrip.LastSeen = lastSeen.Unix()
+			coverageTrip.SilentFor = int64(now.Sub(lastSeen).Seconds())
+			coverageTrip.HasPosition = vehicle != nil
+			coverageTrip.HasTripUpdate = tripUpdate != nil
+			response.SilentTrips = append(response.SilentTrips, coverageTrip)
+		} else {
+			response.GhostTrips = append(response.GhostTrips, coverageTrip)
+		}
+	}
+
+	for _, route := range routes {
+		route.TrackingPercentage = percentage(route.Tracked, route.Expected)
+		response.Routes = append(response.Routes, *route)
+	}
+	response.TrackingPercentage = percentage(response.TrackedTrips, response.ExpectedTrips)
+
+	// Worst tracked routes first
+	slices.SortFunc(response.Routes, func(a, b RouteCoverage) int {
+		if a.TrackingPercentage != b.TrackingPercentage {
+			if a.TrackingPercentage < b.TrackingPercentage {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.RouteID, b.RouteID)
+	})
+	byRoute := func(a, b CoverageTrip) int {
+		if routeOrder := strings.Compare(a.RouteID, b.RouteID); routeOrder != 0 {
+			return routeOrder
+		}
+		return strings.Compare(a.NextStopTime, b.NextStopTime)
+	}
+	slices.SortFunc(response.GhostTrips, byRoute)
+	slices.SortFunc(response.SilentTrips, byRoute)
+
+	return response
+}
+
+func percentage(part, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total) * 100
+}
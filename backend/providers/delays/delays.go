@@ -0,0 +1,200 @@
+/*
+Package delays predicts when a trip will reach each of its stops from a gtfs-realtime trip update.
+
+Feeds often only have an update for the next stop, or just a delay for the whole trip. Like the gtfs-realtime spec says,
+the delay at a stop carries on to the stops after it until the next stop with an update. Where the timetable has the vehicle
+waiting at a stop (dwell or recovery time) a late vehicle leaves as soon as it can, so some of the lateness is made up, and
+an early vehicle waits for its scheduled departure.
+*/
+package delays
+
+import (
+	"slices"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// A stop of a trip with its scheduled times
+type Stop struct {
+	Sequence  int
+	StopId    string
+	Arrival   time.Time
+	Departure time.Time
+}
+
+type Prediction struct {
+	Scheduled Stop
+	Arrival   time.Time
+	Departure time.Time
+	// False when nothing is known about the stop, the times are then the scheduled ones
+	Known bool
+	// The times are from an update for this stop, not carried on from an earlier one
+	Explicit bool
+	Skipped  bool
+}
+
+/*
+The scheduled times for a trips stops on a service day (from servicetime.DayStart).
+
+Stops with a time that can't be parsed are left out.
+*/
+func ScheduledStops(stopTimes []gtfs.TripStopTime, serviceDay time.Time) []Stop {
+	stops := make([]Stop, 0, len(stopTimes))
+	for _, stopTime := range stopTimes {
+		arrival, ok := servicetime.At(stopTime.ArrivalTime, serviceDay)
+		if !ok {
+			continue
+		}
+		departure, ok := servicetime.At(stopTime.DepartureTime, serviceDay)
+		if !ok {
+			departure = arrival
+		}
+		stops = append(stops, Stop{
+			Sequence:  stopTime.Sequence,
+			StopId:    stopTime.StopId,
+			Arrival:   arrival,
+			Departure: departure,
+		})
+	}
+	return stops
+}
+
+/*
+The service day a trip is running on, from the start_date in its realtime data (can be empty) or else the day that puts
+its first departure closest to now.
+*/
+func TripServiceDay(stopTimes []gtfs.TripStopTime, startDate string, now time.Time, localTimeZone *time.Location) time.Time {
+	if len(stopTimes) == 0 {
+		if day, ok := servicetime.ParseDate(startDate, localTimeZone); ok {
+			return day
+		}
+		return servicetime.DayStart(now, localTimeZone)
+	}
+
+	firstStop := slices.MinFunc(stopTimes, func(a, b gtfs.TripStopTime) int {
+		return a.Sequence - b.Sequence
+	})
+	firstDeparture := firstStop.DepartureTime
+	if firstDeparture == "" {
+		firstDeparture = firstStop.ArrivalTime
+	}
+	if day, ok := servicetime.TripDay(startDate, firstDeparture, now, localTimeZone); ok {
+		return day
+	}
+	return servicetime.DayStart(now, localTimeZone)
+}
+
+/*
+Predicted times for every stop, by stop sequence.
+
+update can be nil. Stop time updates are matched to stops by stop_sequence, or by stop_id when they don't have one.
+The trips own delay is used for the stops before the first update. Stops after a NO_DATA update have nothing known
+about them until the next update, and skipped stops don't change the delay carried on past them.
+*/
+func Propagate(stops []Stop, update *proto.TripUpdate) map[int]Prediction {
+	ordered := slices.Clone(stops)
+	slices.SortFunc(ordered, func(a, b Stop) int {
+		return a.Sequence - b.Sequence
+	})
+
+	bySequence := make(map[int]*proto.TripUpdate_StopTimeUpdate)
+	byStopId := make(map[string][]*proto.TripUpdate_StopTimeUpdate)
+	for _, stopUpdate := range update.GetStopTimeUpdate() {
+		if stopUpdate.StopSequence != nil {
+			bySequence[int(stopUpdate.GetStopSequence())] = stopUpdate
+		} else if stopUpdate.GetStopId() != "" {
+			byStopId[stopUpdate.GetStopId()] = append(byStopId[stopUpdate.GetStopId()], stopUpdate)
+		}
+	}
+
+	var (
+		delay time.Duration
+		known bool
+	)
+	if update != nil && update.Delay != nil {
+		delay = time.Duration(update.GetDelay()) * time.Second
+		known = true
+	}
+
+	predictions := make(map[int]Prediction, len(ordered))
+	for _, stop := range ordered {
+		stopUpdate, found := bySequence[stop.Sequence]
+		if !found {
+			// A stop visited twice on a loop has an update for each visit, in order
+			if pending := byStopId[stop.StopId]; len(pending) > 0 {
+				stopUpdate, found = pending[0], true
+				byStopId[stop.StopId] = pending[1:]
+			}
+		}
+
+		prediction := Prediction{Scheduled: stop, Arrival: stop.Arrival, Departure: stop.Departure}
+		if known {
+			prediction.Arrival = stop.Arrival.Add(delay)
+			prediction.Departure = departAfter(stop, prediction.Arrival)
+			prediction.Known = true
+		}
+
+		if found {
+			switch stopUpdate.GetScheduleRelationship().String() {
+			case "SKIPPED":
+				prediction.Skipped = true
+				predictions[stop.Sequence] = prediction
+				continue
+			case "NO_DATA":
+				known = false
+				predictions[stop.Sequence] = Prediction{Scheduled: stop, Arrival: stop.Arrival, Departure: stop.Departure}
+				continue
+			}
+
+			arrival, hasArrival := eventTime(stopUpdate.GetArrival(), stop.Arrival)
+			departure, hasDeparture := eventTime(stopUpdate.GetDeparture(), stop.Departure)
+			switch {
+			case hasArrival && hasDeparture:
+			case hasArrival:
+				departure = departAfter(stop, arrival)
+			case hasDeparture:
+				arrival = departure
+				if known && prediction.Arrival.Before(departure) {
+					arrival = prediction.Arrival
+				}
+			}
+			if hasArrival || hasDeparture {
+				prediction = Prediction{Scheduled: stop, Arrival: arrival, Departure: departure, Known: true, Explicit: true}
+			}
+		}
+
+		if prediction.Known {
+			delay = prediction.Departure.Sub(stop.Departure)
+			known = true
+		}
+		predictions[stop.Sequence] = prediction
+	}
+
+	return predictions
+}
+
+// The time of an arrival/departure, from its time or its delay. A time of 0 means there isn't one
+func eventTime(event *proto.TripUpdate_StopTimeEvent, scheduled time.Time) (time.Time, bool) {
+	if event.GetTime() > 0 {
+		return time.Unix(event.GetTime(), 0).In(scheduled.Location()), true
+	}
+	if event != nil && event.Delay != nil {
+		return scheduled.Add(time.Duration(event.GetDelay()) * time.Second), true
+	}
+	return time.Time{}, false
+}
+
+/*
+When a vehicle arriving at a stop will leave it.
+
+If the timetable has it waiting there, the wait absorbs lateness and an early vehicle holds until its scheduled departure.
+*/
+func departAfter(stop Stop, arrival time.Time) time.Time {
+	if stop.Departure.After(stop.Arrival) && arrival.Before(stop.Departure) {
+		return stop.Departure
+	}
+	return arrival
+}
@@ -0,0 +1,189 @@
+package delays
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// gtfs-realtime StopTimeUpdate schedule relationships
+const (
+	skipped = 1
+	noData  = 2
+)
+
+var serviceDay = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+func clock(value string) time.Time {
+	parsed, err := time.Parse("15:04:05", value)
+	if err != nil {
+		panic(err)
+	}
+	return serviceDay.Add(time.Duration(parsed.Hour())*time.Hour + time.Duration(parsed.Minute())*time.Minute + time.Duration(parsed.Second())*time.Second)
+}
+
+func stop(sequence int, stopId, arrival, departure string) Stop {
+	return Stop{Sequence: sequence, StopId: stopId, Arrival: clock(arrival), Departure: clock(departure)}
+}
+
+func delayed(sequence uint32, seconds int32) *proto.TripUpdate_StopTimeUpdate {
+	return &proto.TripUpdate_StopTimeUpdate{
+		StopSequence: &sequence,
+		Departure:    &proto.TripUpdate_StopTimeEvent{Delay: &seconds},
+	}
+}
+
+func withRelationship(sequence uint32, relationship int32) *proto.TripUpdate_StopTimeUpdate {
+	value := proto.TripUpdate_StopTimeUpdate_ScheduleRelationship(relationship)
+	return &proto.TripUpdate_StopTimeUpdate{StopSequence: &sequence, ScheduleRelationship: &value}
+}
+
+// A trip with 5 minutes of dwell time at B
+var dwellTrip = []Stop{
+	stop(1, "A", "08:00:00", "08:00:00"),
+	stop(2, "B", "08:10:00", "08:15:00"),
+	stop(3, "C", "08:25:00", "08:25:00"),
+}
+
+func checkTimes(t *testing.T, name string, predictions map[int]Prediction, sequence int, arrival, departure string) {
+	t.Helper()
+	prediction, found := predictions[sequence]
+	if !found {
+		t.Errorf("%s: no prediction for stop %d", name, sequence)
+		return
+	}
+	if !prediction.Arrival.Equal(clock(arrival)) || !prediction.Departure.Equal(clock(departure)) {
+		t.Errorf("%s: stop %d = %s-%s, want %s-%s", name, sequence,
+			prediction.Arrival.Format("15:04:05"), prediction.Departure.Format("15:04:05"), arrival, departure)
+	}
+}
+
+func TestPropagateDwellAbsorbsDelay(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay int32
+		// Predicted arrival-departure at B and C
+		b, c [2]string
+	}{
+		{name: "late by less than the dwell", delay: 180, b: [2]string{"08:13:00", "08:15:00"}, c: [2]string{"08:25:00", "08:25:00"}},
+		{name: "late by more than the dwell", delay: 420, b: [2]string{"08:17:00", "08:17:00"}, c: [2]string{"08:27:00", "08:27:00"}},
+		{name: "early waits for its departure", delay: -120, b: [2]string{"08:08:00", "08:15:00"}, c: [2]string{"08:25:00", "08:25:00"}},
+	}
+	for _, test := range tests {
+		update := &proto.TripUpdate{StopTimeUpdate: []*proto.TripUpdate_StopTimeUpdate{delayed(1, test.delay)}}
+		predictions := Propagate(dwellTrip, update)
+
+		checkTimes(t, test.name, predictions, 2, test.b[0], test.b[1])
+		checkTimes(t, test.name, predictions, 3, test.c[0], test.c[1])
+		if predictions[2].Explicit || !predictions[2].Known {
+			t.Errorf("%s: stop 2 should be known from the carried delay, got %+v", test.name, predictions[2])
+		}
+		if !predictions[1].Explicit {
+			t.Errorf("%s: stop 1 has its own update and should be explicit", test.name)
+		}
+	}
+}
+
+func TestPropagateTripDelay(t *testing.T) {
+	delay := int32(300)
+	predictions := Propagate(dwellTrip, &proto.TripUpdate{Delay: &delay})
+
+	checkTimes(t, "trip delay", predictions, 1, "08:05:00", "08:05:00")
+	checkTimes(t, "trip delay", predictions, 2, "08:15:00", "08:15:00")
+	checkTimes(t, "trip delay", predictions, 3, "08:25:00", "08:25:00")
+}
+
+func TestPropagateNoDataResets(t *testing.T) {
+	stops := []Stop{
+		stop(1, "A", "08:00:00", "08:00:00"),
+		stop(2, "B", "08:10:00", "08:10:00"),
+		stop(3, "C", "08:20:00", "08:20:00"),
+		stop(4, "D", "08:30:00", "08:30:00"),
+		stop(5, "E", "08:40:00", "08:40:00"),
+	}
+	update := &proto.TripUpdate{StopTimeUpdate: []*proto.TripUpdate_StopTimeUpdate{
+		delayed(1, 300),
+		withRelationship(2, noData),
+		delayed(4, 60),
+	}}
+	predictions := Propagate(stops, update)
+
+	checkTimes(t, "no data", predictions, 1, "08:05:00", "08:05:00")
+	for _, sequence := range []int{2, 3} {
+		if predictions[sequence].Known {
+			t.Errorf("stop %d after NO_DATA should be unknown, got %+v", sequence, predictions[sequence])
+		}
+		checkTimes(t, "no data", predictions, sequence, stops[sequence-1].Arrival.Format("15:04:05"), stops[sequence-1].Departure.Format("15:04:05"))
+	}
+	checkTimes(t, "no data", predictions, 4, "08:31:00", "08:31:00")
+	checkTimes(t, "no data", predictions, 5, "08:41:00", "08:41:00")
+}
+
+func TestPropagateSkippedCarriesDelay(t *testing.T) {
+	stops := []Stop{
+		stop(1, "A", "08:00:00", "08:00:00"),
+		stop(2, "B", "08:10:00", "08:10:00"),
+		stop(3, "C", "08:20:00", "08:20:00"),
+	}
+	update := &proto.TripUpdate{StopTimeUpdate: []*proto.TripUpdate_StopTimeUpdate{
+		delayed(1, 240),
+		withRelationship(2, skipped),
+	}}
+	predictions := Propagate(stops, update)
+
+	if !predictions[2].Skipped {
+		t.Errorf("stop 2 should be skipped, got %+v", predictions[2])
+	}
+	checkTimes(t, "skipped", predictions, 3, "08:24:00", "08:24:00")
+	if !predictions[3].Known {
+		t.Errorf("stop 3 after a skipped stop should still be known")
+	}
+}
+
+// Loops visit a stop twice, updates without a stop sequence go to the visits in order
+func TestPropagateMatchesLoopsByStopId(t *testing.T) {
+	stops := []Stop{
+		stop(1, "A", "08:00:00", "08:00:00"),
+		stop(2, "B", "08:10:00", "08:10:00"),
+		stop(3, "A", "08:20:00", "08:20:00"),
+	}
+	first, second := int32(60), int32(120)
+	stopId := "A"
+	update := &proto.TripUpdate{StopTimeUpdate: []*proto.TripUpdate_StopTimeUpdate{
+		{StopId: &stopId, Departure: &proto.TripUpdate_StopTimeEvent{Delay: &first}},
+		{StopId: &stopId, Departure: &proto.TripUpdate_StopTimeEvent{Delay: &second}},
+	}}
+	predictions := Propagate(stops, update)
+
+	checkTimes(t, "loop", predictions, 1, "08:01:00", "08:01:00")
+	checkTimes(t, "loop", predictions, 2, "08:11:00", "08:11:00")
+	// A departure only update keeps the earlier arrival carried on from the last stop
+	checkTimes(t, "loop", predictions, 3, "08:21:00", "08:22:00")
+}
+
+func TestPropagateWithoutUpdate(t *testing.T) {
+	predictions := Propagate(dwellTrip, nil)
+	for _, stop := range dwellTrip {
+		prediction := predictions[stop.Sequence]
+		if prediction.Known || !prediction.Arrival.Equal(stop.Arrival) || !prediction.Departure.Equal(stop.Departure) {
+			t.Errorf("stop %d without an update should be the scheduled times, got %+v", stop.Sequence, prediction)
+		}
+	}
+}
+
+func TestScheduledStops(t *testing.T) {
+	stopTimes := []gtfs.TripStopTime{
+		{StopId: "A", Sequence: 1, ArrivalTime: "23:50:00", DepartureTime: "23:50:00"},
+		{StopId: "B", Sequence: 2, ArrivalTime: "24:10:00", DepartureTime: ""},
+		{StopId: "C", Sequence: 3, ArrivalTime: "bad", DepartureTime: "bad"},
+	}
+	stops := ScheduledStops(stopTimes, serviceDay)
+	if len(stops) != 2 {
+		t.Fatalf("expected the stop with an invalid time to be left out, got %d stops", len(stops))
+	}
+	if want := serviceDay.Add(24*time.Hour + 10*time.Minute); !stops[1].Arrival.Equal(want) || !stops[1].Departure.Equal(want) {
+		t.Errorf("stop B = %v-%v, want %v for both", stops[1].Arrival, stops[1].Departure, want)
+	}
+}
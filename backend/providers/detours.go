@@ -0,0 +1,339 @@
+package providers
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+)
+
+const (
+	// A vehicle further than this from its trip shape is off course
+	offCourseDistance = 500.0
+	// Off course segments closer than this on the same route are treated as the same diversion
+	detourGroupDistance = 300.0
+	// How long finished off course segments are kept for grouping
+	detourHistoryWindow = 3 * time.Hour
+	// Positions kept per off course vehicle
+	maxDetourPoints = 50
+)
+
+// A vehicle that is (or was) away from its trip shape
+type VehicleDetour struct {
+	TripID       string   `json:"trip_id"`
+	RouteID      string   `json:"route_id"`
+	VehicleID    string   `json:"vehicle_id"`
+	VehicleLabel string   `json:"vehicle_label"`
+	Since        int64    `json:"since"`     // Unix seconds the vehicle was first seen off course
+	LastSeen     int64    `json:"last_seen"` // Unix seconds of the latest position
+	OffCourseFor int64    `json:"off_course_for"`
+	Distance     float64  `json:"distance"` // Meters from the shape at the latest position
+	MaxDistance  float64  `json:"max_distance"`
+	Lat          float64  `json:"lat"`
+	Lon          float64  `json:"lon"`
+	Path         []LatLng `json:"path"` // The latest maxDetourPoints positions
+
+	start        LatLng // Where the vehicle left its shape
+	observations int
+}
+
+// Off course segments on a route that happened in the same place, most likely an unannounced diversion if there is more than one trip
+type RouteDetour struct {
+	RouteID   string   `json:"route_id"`
+	TripIDs   []string `json:"trip_ids"`
+	Segments  int      `json:"segments"`
+	Active    int      `json:"active"` // Vehicles still off course here
+	FirstSeen int64    `json:"first_seen"`
+	LastSeen  int64    `json:"last_seen"`
+	Lat       float64  `json:"lat"` // Where the first vehicle left its shape
+	Lon       float64  `json:"lon"`
+	Repeated  bool     `json:"repeated"`
+}
+
+type DetoursResponse struct {
+	Vehicles []VehicleDetour `json:"vehicles"`
+	Routes   []RouteDetour   `json:"routes"`
+}
+
+/*
+detourDetector checks every vehicle in the feed against its trip shape each time the feed is read,
+and remembers which ones are off course and where.
+
+Checking is done on its own goroutine as loading the shapes for a whole fleet is slow,
+if it falls behind the feed older reads are dropped.
+*/
+type detourDetector struct {
+	gtfsData gtfs.Database
+
+	pending chan rt.VehiclesMap
+	stop    chan struct{}
+	once    sync.Once
+
+	mu     sync.RWMutex
+	shapes map[string]*TripShapeDistance // nil if the trip has no usable shape
+	active map[string]*VehicleDetour     // trip id -> detour
+	ended  []VehicleDetour
+}
+
+func newDetourDetector(gtfsData gtfs.Database) *detourDetector {
+	return &detourDetector{
+		gtfsData: gtfsData,
+		pending:  make(chan rt.VehiclesMap, 1),
+		stop:     make(chan struct{}),
+		shapes:   make(map[string]*TripShapeDistance),
+		active:   make(map[string]*VehicleDetour),
+	}
+}
+
+func (d *detourDetector) Start() {
+	go func() {
+		for {
+			select {
+			case <-d.stop:
+				return
+			case vehicles := <-d.pending:
+				d.check(vehicles, time.Now())
+			}
+		}
+	}()
+}
+
+func (d *detourDetector) Stop() {
+	d.once.Do(func() {
+		close(d.stop)
+	})
+}
+
+// Queues a vehicle feed read to be checked, replacing one that hasn't been checked yet
+func (d *detourDetector) observe(vehicles rt.VehiclesMap) {
+	select {
+	case <-d.pending:
+	default:
+	}
+	select {
+	case d.pending <- vehicles:
+	default:
+	}
+}
+
+func (d *detourDetector) shapeForTrip(tripID string) *TripShapeDistance {
+	d.mu.RLock()
+	cached, found := d.shapes[tripID]
+	d.mu.RUnlock()
+	if found {
+		return cached
+	}
+
+	shape, err := NewTripShapeDistance(tripID, d.gtfsData)
+	if err != nil || len(shape.Line) < 2 {
+		shape = nil
+	}
+
+	d.mu.Lock()
+	d.shapes[tripID] = shape
+	d.mu.Unlock()
+	return shape
+}
+
+func (d *detourDetector) check(vehicles rt.VehiclesMap, now time.Time) {
+	type offCourse struct {
+		distance float64
+		lat, lon float64
+		at       int64
+	}
+
+	// Work out distances without holding the lock, shapes may need loading
+	results := make(map[string]*offCourse, len(vehicles))
+	seen := make(map[string]struct{}, len(vehicles))
+	routes := make(map[string]string, len(vehicles))
+	labels := make(map[string][2]string, len(vehicles))
+	for _, vehicle := range vehicles {
+		tripID := vehicle.GetTrip().GetTripId()
+		position := vehicle.GetPosition()
+		if tripID == "" || position == nil {
+			continue
+		}
+		seen[tripID] = struct{}{}
+		shape := d.shapeForTrip(tripID)
+		if shape == nil {
+			continue
+		}
+
+		lat, lon := float64(position.GetLatitude()), float64(position.GetLongitude())
+		distance, err := shape.DistanceFromLine(lat, lon)
+		if err != nil {
+			continue
+		}
+
+		at := int64(vehicle.GetTimestamp())
+		if at == 0 {
+			at = now.Unix()
+		}
+
+		routes[tripID] = vehicle.GetTrip().GetRouteId()
+		labels[tripID] = [2]string{vehicle.GetVehicle().GetId(), vehicle.GetVehicle().GetLabel()}
+		if distance > offCourseDistance {
+			results[tripID] = &offCourse{distance: distance, lat: lat, lon: lon, at: at}
+		} else {
+			results[tripID] = nil
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for tripID, result := range results {
+		detour, isActive := d.active[tripID]
+		switch {
+		case result == nil && isActive:
+			d.end(tripID)
+		case result != nil && !isActive:
+			routeID := routes[tripID]
+			if routeID == "" {
+				if trip, err := d.gtfsData.GetTripByID(tripID); err == nil {
+					routeID = trip.RouteID
+				}
+			}
+			d.active[tripID] = &VehicleDetour{
+				TripID:       tripID,
+				RouteID:      routeID,
+				VehicleID:    labels[tripID][0],
+				VehicleLabel: labels[tripID][1],
+				Since:        result.at,
+				LastSeen:     result.at,
+				Distance:     result.distance,
+				MaxDistance:  result.distance,
+				Lat:          result.lat,
+				Lon:          result.lon,
+				Path:         []LatLng{{Lat: result.lat, Lng: result.lon}},
+				start:        LatLng{Lat: result.lat, Lng: result.lon},
+				observations: 1,
+			}
+		case result != nil && result.at > detour.LastSeen:
+			detour.LastSeen = result.at
+			detour.OffCourseFor = detour.LastSeen - detour.Since
+			detour.Distance = result.distance
+			detour.MaxDistance = max(detour.MaxDistance, result.distance)
+			detour.Lat, detour.Lon = result.lat, result.lon
+			detour.Path = append(detour.Path, LatLng{Lat: result.lat, Lng: result.lon})
+			if len(detour.Path) > maxDetourPoints {
+				detour.Path = detour.Path[len(detour.Path)-maxDetourPoints:]
+			}
+			detour.observations++
+		}
+	}
+
+	// Trips that have left the feed have finished (or lost tracking)
+	for tripID := range d.active {
+		if _, found := results[tripID]; !found {
+			d.end(tripID)
+		}
+	}
+	for tripID := range d.shapes {
+		if _, found := seen[tripID]; !found {
+			delete(d.shapes, tripID)
+		}
+	}
+
+	cutoff := now.Add(-detourHistoryWindow).Unix()
+	d.ended = slices.DeleteFunc(d.ended, func(detour VehicleDetour) bool {
+		return detour.LastSeen < cutoff
+	})
+}
+
+// Moves an active detour to the history, d.mu must be held
+func (d *detourDetector) end(tripID string) {
+	detour := d.active[tripID]
+	delete(d.active, tripID)
+	// A single off course position is usually a gps glitch
+	if detour.observations > 1 {
+		d.ended = append(d.ended, *detour)
+	}
+}
+
+/*
+The vehicles currently off course, and every route where vehicles went off course in the last detourHistoryWindow
+grouped by where they left their shape.
+
+A vehicle has to be seen off course twice in a row before it is listed.
+*/
+func (d *detourDetector) Detours() DetoursResponse {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	response := DetoursResponse{Vehicles: []VehicleDetour{}, Routes: []RouteDetour{}}
+
+	type detourSegment struct {
+		VehicleDetour
+		active bool
+	}
+
+	segments := make([]detourSegment, 0, len(d.ended)+len(d.active))
+	for _, detour := range d.ended {
+		segments = append(segments, detourSegment{VehicleDetour: detour})
+	}
+	for _, detour := range d.active {
+		if detour.observations < 2 {
+			continue
+		}
+		vehicle := *detour
+		vehicle.Path = slices.Clone(detour.Path)
+		response.Vehicles = append(response.Vehicles, vehicle)
+		segments = append(segments, detourSegment{VehicleDetour: vehicle, active: true})
+	}
+	slices.SortFunc(response.Vehicles, func(a, b VehicleDetour) int {
+		return int(b.OffCourseFor - a.OffCourseFor)
+	})
+
+	slices.SortFunc(segments, func(a, b detourSegment) int {
+		return int(a.Since - b.Since)
+	})
+	for _, segment := range segments {
+		start := segment.start
+		active := 0
+		if segment.active {
+			active = 1
+		}
+
+		index := slices.IndexFunc(response.Routes, func(group RouteDetour) bool {
+			return group.RouteID == segment.RouteID && haversine(group.Lat, group.Lon, start.Lat, start.Lng) <= detourGroupDistance
+		})
+		if index == -1 {
+			response.Routes = append(response.Routes, RouteDetour{
+				RouteID:   segment.RouteID,
+				TripIDs:   []string{segment.TripID},
+				Segments:  1,
+				Active:    active,
+				FirstSeen: segment.Since,
+				LastSeen:  segment.LastSeen,
+				Lat:       start.Lat,
+				Lon:       start.Lng,
+			})
+			continue
+		}
+
+		group := &response.Routes[index]
+		group.Segments++
+		group.Active += active
+		group.LastSeen = max(group.LastSeen, segment.LastSeen)
+		if !slices.Contains(group.TripIDs, segment.TripID) {
+			group.TripIDs = append(group.TripIDs, segment.TripID)
+		}
+		group.Repeated = len(group.TripIDs) > 1
+	}
+
+	slices.SortFunc(response.Routes, func(a, b RouteDetour) int {
+		if a.Repeated != b.Repeated {
+			if a.Repeated {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.RouteID, b.RouteID)
+	})
+
+	return response
+}
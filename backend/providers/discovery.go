@@ -0,0 +1,150 @@
+package providers
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v5"
+)
+
+type BoundingBox struct {
+	MinLat float64 `json:"min_lat"`
+	MinLon float64 `json:"min_lon"`
+	MaxLat float64 `json:"max_lat"`
+	MaxLon float64 `json:"max_lon"`
+}
+
+func (b BoundingBox) Contains(lat, lon float64) bool {
+	return pointInBounds(lat, lon, LatLng{Lat: b.MinLat, Lng: b.MinLon}, LatLng{Lat: b.MaxLat, Lng: b.MaxLon})
+}
+
+type Coordinate struct {
+	Lat float64 `json:"lat"`
+	Lon float64 `json:"lon"`
+}
+
+type ProviderCapabilities struct {
+	Realtime        bool `json:"realtime"`
+	Alerts          bool `json:"alerts"`
+	JourneyPlanning bool `json:"journey_planning"`
+	Notifications   bool `json:"notifications"`
+}
+
+type ProviderInfo struct {
+	Prefix       string               `json:"prefix"`
+	Name         string               `json:"name"`
+	TimeZone     string               `json:"timezone"`
+	State        ProviderState        `json:"state"`
+	BoundingBox  *BoundingBox         `json:"bbox"`
+	Centroid     *Coordinate          `json:"centroid"`
+	Modes        []string             `json:"modes"`
+	Capabilities ProviderCapabilities `json:"capabilities"`
+}
+
+/*
+Describes a mounted provider for clients.
+
+The bbox and centroid are worked out when the stops coverage cache is rebuilt and are nil until it has loaded.
+*/
+func (p *Provider) Info() ProviderInfo {
+	timeZone := "Pacific/Auckland"
+	if loc, err := p.Config.Location(); err == nil {
+		timeZone = loc.String()
+	}
+
+	info := ProviderInfo{
+		Prefix:   p.Config.Prefix,
+		Name:     p.Config.DisplayName(),
+		TimeZone: timeZone,
+		State:    p.State,
+		Modes:    []string{},
+		Capabilities: ProviderCapabilities{
+			Realtime:        p.State == ProviderReady,
+			Alerts:          p.State == ProviderReady && p.Config.Realtime.AlertsURL != "",
+			JourneyPlanning: p.State != ProviderDisabled,
+			Notifications:   p.notifier != nil && p.notifier.Status().Database,
+		},
+	}
+
+	if p.State == ProviderDisabled {
+		return info
+	}
+
+	if coverage := p.caches.GetStopsCoverageCache(); coverage.Stops > 0 {
+		info.BoundingBox = &BoundingBox{MinLat: coverage.MinLat, MinLon: coverage.MinLon, MaxLat: coverage.MaxLat, MaxLon: coverage.MaxLon}
+		info.Centroid = &Coordinate{Lat: coverage.CentroidLat, Lon: coverage.CentroidLon}
+	}
+
+	for _, route := range p.caches.GetRouteCache() {
+		mode := strings.ToLower(route.VehicleType)
+		if mode != "" && !slices.Contains(info.Modes, mode) {
+			info.Modes = append(info.Modes, mode)
+		}
+	}
+	slices.Sort(info.Modes)
+
+	return info
+}
+
+/*
+Registers the provider discovery endpoints
+
+/providers lists every mounted provider
+
+/providers/locate?lat=&lon= picks the provider that covers a location, when more than one does the one with the closest centroid wins
+*/
+func SetupDiscoveryRoutes(e *echo.Echo, providers []*Provider) {
+	mounted := make([]*Provider, 0, len(providers))
+	for _, provider := range providers {
+		if provider.State != ProviderDisabled {
+			mounted = append(mounted, provider)
+		}
+	}
+
+	e.GET("/providers", func(c echo.Context) error {
+		infos := make([]ProviderInfo, 0, len(mounted))
+		for _, provider := range mounted {
+			infos = append(infos, provider.Info())
+		}
+		return JsonApiResponse(c, http.StatusOK, "", infos)
+	})
+
+	e.GET("/providers/locate", func(c echo.Context) error {
+		latStr := c.QueryParam("lat")
+		lonStr := c.QueryParam("lon")
+
+		lat, err := strconv.ParseFloat(latStr, 64)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid latitude", nil, ResponseDetails("lat", latStr, "error", err.Error()))
+		}
+		lon, err := strconv.ParseFloat(lonStr, 64)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid longitude", nil, ResponseDetails("lon", lonStr, "error", err.Error()))
+		}
+
+		var (
+			best         *ProviderInfo
+			bestDistance = math.Inf(1)
+		)
+		for _, provider := range mounted {
+			info := provider.Info()
+			if info.BoundingBox == nil || !info.BoundingBox.Contains(lat, lon) {
+				continue
+			}
+			distance := haversine(lat, lon, info.Centroid.Lat, info.Centroid.Lon)
+			if distance < bestDistance {
+				best = &info
+				bestDistance = distance
+			}
+		}
+
+		if best == nil {
+			return JsonApiResponse(c, http.StatusNotFound, "no provider covers this location", nil, ResponseDetails("lat", lat, "lon", lon))
+		}
+
+		return JsonApiResponse(c, http.StatusOK, "", best)
+	})
+}
@@ -0,0 +1,123 @@
+package providers
+
+import (
+	"slices"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// Where a services arrival time came from
+const (
+	ArrivalSourceScheduled  = "scheduled"
+	ArrivalSourceTripUpdate = "trip_update"
+	ArrivalSourcePosition   = "position"
+	// The delay from an update for an earlier stop, carried on
+	ArrivalSourcePropagated = "propagated"
+	// The lateness of the vehicles earlier trip in its block, carried over
+	ArrivalSourceBlock = "block"
+)
+
+const (
+	// Vehicles further than this from their shape can't be placed on it
+	maxEtaOffShapeDistance = 500.0
+	// GPS noise, a vehicle this close past a stop hasn't left it yet
+	etaStopTolerance = 30.0
+)
+
+type scheduledStopPosition struct {
+	sequence int
+	distance float64 // along the shape, meters
+	arrival  int     // seconds since the start of the service day
+	depart   int
+}
+
+/*
+Estimates when the vehicle running a trip will reach a stop, for trips whose updates don't predict that stop.
+
+The vehicle is placed on the trip shape between the two stops it is travelling between, and the scheduled
+time at that point is interpolated from theirs. The time left until the stop is then the scheduled
+time between there and the stop, so each segment is assumed to take as long as the timetable says it does.
+
+The stop is picked by its stop sequence, loops visit the same stop more than once. stopTimes are the trips stop times in
+stop sequence order and shape its shape, nil if it doesn't have one. passed is true if the vehicle is already beyond the
+stop. ok is false if no estimate can be made.
+*/
+func estimateArrivalFromPosition(stopSequence int, stopTimes []gtfs.TripStopTime, shape *TripShapeDistance, vehicle *proto.VehiclePosition, now time.Time) (arrival time.Time, passed bool, ok bool) {
+	position := vehicle.GetPosition()
+	if position == nil {
+		return time.Time{}, false, false
+	}
+	vehicleLat, vehicleLon := float64(position.GetLatitude()), float64(position.GetLongitude())
+
+	if len(stopTimes) < 2 {
+		return time.Time{}, false, false
+	}
+
+	if shape == nil || len(shape.Line) < 2 {
+		return time.Time{}, false, false
+	}
+	if offShape, err := shape.DistanceFromLine(vehicleLat, vehicleLon); err != nil || offShape > maxEtaOffShapeDistance {
+		return time.Time{}, false, false
+	}
+
+	stops := make([]scheduledStopPosition, 0, len(stopTimes))
+	for _, stopTime := range stopTimes {
+		arrivalSeconds, err := servicetime.Seconds(stopTime.ArrivalTime)
+		if err != nil {
+			continue
+		}
+		departSeconds, err := servicetime.Seconds(stopTime.DepartureTime)
+		if err != nil {
+			departSeconds = arrivalSeconds
+		}
+		stops = append(stops, scheduledStopPosition{
+			sequence: stopTime.Sequence,
+			distance: shape.DistanceAlong(stopTime.StopLat, stopTime.StopLon),
+			arrival:  arrivalSeconds,
+			depart:   departSeconds,
+		})
+	}
+
+	target := slices.IndexFunc(stops, func(stop scheduledStopPosition) bool { return stop.sequence == stopSequence })
+	if target == -1 {
+		return time.Time{}, false, false
+	}
+
+	vehicleDistance := shape.DistanceAlong(vehicleLat, vehicleLon)
+	if vehicleDistance > stops[target].distance+etaStopTolerance {
+		return time.Time{}, true, true
+	}
+
+	// The first stop at or ahead of the vehicle
+	next := slices.IndexFunc(stops, func(stop scheduledStopPosition) bool { return stop.distance+etaStopTolerance >= vehicleDistance })
+	if next == -1 || next > target {
+		return time.Time{}, false, false
+	}
+
+	// Scheduled time (seconds into the service day) at the vehicles position
+	var scheduledAtVehicle float64
+	if next == 0 || stops[next].distance-stops[next-1].distance <= 0 {
+		scheduledAtVehicle = float64(stops[next].arrival)
+	} else {
+		previous := stops[next-1]
+		progress := (vehicleDistance - previous.distance) / (stops[next].distance - previous.distance)
+		progress = min(max(progress, 0), 1)
+		scheduledAtVehicle = float64(previous.depart) + progress*float64(stops[next].arrival-previous.depart)
+	}
+
+	remaining := time.Duration((float64(stops[target].arrival) - scheduledAtVehicle) * float64(time.Second))
+
+	observedAt := now
+	if timestamp := vehicle.GetTimestamp(); timestamp > 0 {
+		observedAt = time.Unix(int64(timestamp), 0).In(now.Location())
+	}
+
+	arrival = observedAt.Add(max(remaining, 0))
+	if arrival.Before(now) {
+		arrival = now
+	}
+	return arrival, false, true
+}
@@ -0,0 +1,254 @@
+package providers
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+	"github.com/labstack/echo/v5"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+const gtfsRealtimeVersion = "2.0"
+
+// The query filters for the /realtime/feed/*.pb endpoints
+type feedFilters struct {
+	tripID    string
+	routeID   string
+	hasBounds bool
+	boundA    LatLng
+	boundB    LatLng
+
+	// trip id -> route id, for trips the feed leaves the route out of. Only made when filtering by route
+	tripRoutes map[string]string
+}
+
+/*
+Reads the tripId, routeId and bounds query params.
+
+If they are invalid the returned func writes the bad request response.
+*/
+func parseFeedFilters(c echo.Context) (feedFilters, func() error) {
+	var filters feedFilters
+
+	for param, value := range map[string]*string{"tripId": &filters.tripID, "routeId": &filters.routeID} {
+		unescaped, err := url.PathUnescape(c.QueryParam(param))
+		if err != nil {
+			return filters, func() error {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid "+param, nil,
+					ResponseDetails(param, c.QueryParam(param), "error", err.Error()))
+			}
+		}
+		*value = unescaped
+	}
+
+	boundsStr, err := url.PathUnescape(c.QueryParam("bounds"))
+	if err != nil {
+		return filters, func() error {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid bounds", nil,
+				ResponseDetails("bounds", c.QueryParam("bounds"), "error", err.Error()))
+		}
+	}
+	if boundsStr != "" {
+		filters.hasBounds = true
+		filters.boundA, filters.boundB, err = parseBounds(boundsStr)
+		if err != nil {
+			return filters, func() error {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid bounds format", nil,
+					ResponseDetails("bounds", boundsStr, "details", "Expected [[lat1,lng1],[lat2,lng2]]"))
+			}
+		}
+	}
+
+	return filters, nil
+}
+
+/*
+Fills in the trip -> route map once for the request, from whichever of the feeds names the route for each trip.
+Either can be nil. Trips neither feed has a route for are looked up from the schedule as they're matched.
+*/
+func (f *feedFilters) loadTripRoutes(vehicles rt.VehiclesMap, tripUpdates rt.TripUpdatesMap) {
+	if f.routeID == "" {
+		return
+	}
+	f.tripRoutes = make(map[string]string)
+	for _, vehicle := range vehicles {
+		if trip := vehicle.GetTrip(); trip.GetRouteId() != "" {
+			f.tripRoutes[trip.GetTripId()] = trip.GetRouteId()
+		}
+	}
+	for _, tripUpdate := range tripUpdates {
+		if trip := tripUpdate.GetTrip(); trip.GetRouteId() != "" {
+			f.tripRoutes[trip.GetTripId()] = trip.GetRouteId()
+		}
+	}
+}
+
+// Checks a trip against the tripId and routeId filters, the route is looked up if the feed left it out
+func (f feedFilters) matchesTrip(trip *proto.TripDescriptor, gtfsData gtfs.Database) bool {
+	if f.tripID != "" && trip.GetTripId() != f.tripID {
+		return false
+	}
+	if f.routeID != "" {
+		routeID := trip.GetRouteId()
+		if routeID == "" {
+			var found bool
+			routeID, found = f.tripRoutes[trip.GetTripId()]
+			if !found {
+				scheduledTrip, err := gtfsData.GetTripByID(trip.GetTripId())
+				if err != nil {
+					return false
+				}
+				routeID = scheduledTrip.RouteID
+				if f.tripRoutes != nil {
+					f.tripRoutes[trip.GetTripId()] = routeID
+				}
+			}
+		}
+		if routeID != f.routeID {
+			return false
+		}
+	}
+	return true
+}
+
+func (f feedFilters) matchesPosition(position *proto.Position) bool {
+	if !f.hasBounds {
+		return true
+	}
+	if position == nil {
+		return false
+	}
+	return pointInBounds(float64(position.GetLatitude()), float64(position.GetLongitude()), f.boundA, f.boundB)
+}
+
+func vehiclePositionsFeed(vehicles rt.VehiclesMap, gtfsData gtfs.Database, filters feedFilters) []*proto.FeedEntity {
+	var entities []*proto.FeedEntity
+	for id, vehicle := range vehicles {
+		if !filters.matchesTrip(vehicle.GetTrip(), gtfsData) || !filters.matchesPosition(vehicle.GetPosition()) {
+			continue
+		}
+		entities = append(entities, &proto.FeedEntity{Id: protobuf.String(id), Vehicle: vehicle})
+	}
+	return entities
+}
+
+// Trip updates have no position, when filtering by bounds the position of the vehicle running the trip is used
+func tripUpdatesFeed(tripUpdates rt.TripUpdatesMap, vehicles rt.VehiclesMap, gtfsData gtfs.Database, filters feedFilters) []*proto.FeedEntity {
+	var entities []*proto.FeedEntity
+	for id, tripUpdate := range tripUpdates {
+		if !filters.matchesTrip(tripUpdate.GetTrip(), gtfsData) {
+			continue
+		}
+		if filters.hasBounds {
+			vehicle, err := vehicles.ByTripID(tripUpdate.GetTrip().GetTripId())
+			if err != nil || !filters.matchesPosition(vehicle.GetPosition()) {
+				continue
+			}
+		}
+		entities = append(entities, &proto.FeedEntity{Id: protobuf.String(id), TripUpdate: tripUpdate})
+	}
+	return entities
+}
+
+/*
+An alert is kept if any of its informed entities matches every filter.
+
+Informed entities without a trip/route are treated as matching the tripId/routeId filters (e.g a stop closure),
+and ones without a stop never match bounds.
+*/
+func alertsFeed(alerts rt.AlertMap, gtfsData gtfs.Database, filters feedFilters) []*proto.FeedEntity {
+	// stop id -> in bounds, stops are shared between a lot of alerts
+	stopsInBounds := make(map[string]bool)
+	stopInBounds := func(stopID string) bool {
+		if inBounds, found := stopsInBounds[stopID]; found {
+			return inBounds
+		}
+		stop, err := gtfsData.GetStopByStopID(stopID)
+		inBounds := err == nil && pointInBounds(stop.StopLat, stop.StopLon, filters.boundA, filters.boundB)
+		stopsInBounds[stopID] = inBounds
+		return inBounds
+	}
+
+	var entities []*proto.FeedEntity
+	for id, alert := range alerts {
+		matched := slices.ContainsFunc(alert.GetInformedEntity(), func(entity *proto.EntitySelector) bool {
+			if filters.tripID != "" && entity.GetTrip().GetTripId() != "" && entity.GetTrip().GetTripId() != filters.tripID {
+				return false
+			}
+			if filters.routeID != "" {
+				routeID := entity.GetRouteId()
+				if routeID == "" {
+					routeID = entity.GetTrip().GetRouteId()
+				}
+				if routeID != "" && routeID != filters.routeID {
+					return false
+				}
+			}
+			if filters.hasBounds && (entity.GetStopId() == "" || !stopInBounds(entity.GetStopId())) {
+				return false
+			}
+			return true
+		})
+		if !matched {
+			continue
+		}
+		entities = append(entities, &proto.FeedEntity{Id: protobuf.String(id), Alert: alert})
+	}
+	return entities
+}
+
+// The newest timestamp of any vehicle in the feed, zero if none have one
+func newestVehicleTimestamp(vehicles rt.VehiclesMap) time.Time {
+	var newest uint64
+	for _, vehicle := range vehicles {
+		newest = max(newest, vehicle.GetTimestamp())
+	}
+	return unixOrZero(newest)
+}
+
+// The newest timestamp of any trip update in the feed, zero if none have one
+func newestTripUpdateTimestamp(tripUpdates rt.TripUpdatesMap) time.Time {
+	var newest uint64
+	for _, tripUpdate := range tripUpdates {
+		newest = max(newest, tripUpdate.GetTimestamp())
+	}
+	return unixOrZero(newest)
+}
+
+/*
+Writes the entities as a full dataset gtfs-realtime FeedMessage.
+
+generatedAt is when the upstream feed was generated (its newest entity), the header uses now if it's zero.
+*/
+func writeFeedMessage(c echo.Context, entities []*proto.FeedEntity, generatedAt time.Time) error {
+	// Map order is random, keep the output stable for clients that diff it
+	slices.SortFunc(entities, func(a, b *proto.FeedEntity) int {
+		return strings.Compare(a.GetId(), b.GetId())
+	})
+
+	if generatedAt.IsZero() {
+		generatedAt = time.Now()
+	}
+
+	message := &proto.FeedMessage{
+		Header: &proto.FeedHeader{
+			GtfsRealtimeVersion: protobuf.String(gtfsRealtimeVersion),
+			// Incrementality is left out, it defaults to FULL_DATASET
+			Timestamp: protobuf.Uint64(uint64(generatedAt.Unix())),
+		},
+		Entity: entities,
+	}
+
+	encoded, err := protobuf.Marshal(message)
+	if err != nil {
+		return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "failed to encode feed", "details", err.Error()))
+	}
+
+	return c.Blob(http.StatusOK, "application/x-protobuf", encoded)
+}
@@ -0,0 +1,326 @@
+package providers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jfmow/at-trains-api/metrics"
+	"github.com/jfmow/at-trains-api/providers/notifications"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/labstack/echo/v5"
+)
+
+type FeedKind string
+
+const (
+	FeedVehiclePositions FeedKind = "vehicle_positions"
+	FeedTripUpdates      FeedKind = "trip_updates"
+	FeedAlerts           FeedKind = "alerts"
+)
+
+var feedKinds = []FeedKind{FeedVehiclePositions, FeedTripUpdates, FeedAlerts}
+
+// The outcome of the most recent reads of a realtime feed
+type FeedHealth struct {
+	LastSuccess time.Time
+	LastAttempt time.Time
+	LastError   string
+	Entities    int
+	// Newest timestamp reported by an entity in the feed, zero if the feed has none (alerts)
+	NewestEntity time.Time
+}
+
+/*
+FeedMonitor reads a providers realtime feeds every poll interval and records
+when each one was last read successfully and how old the data in it is.
+
+This is what lets us tell a feed that is still being served but has stopped
+updating apart from a healthy one.
+*/
+type FeedMonitor struct {
+	provider string
+	realtime rt.Realtime
+	interval time.Duration
+	// Given every successful feed read, registered before Start
+	vehicleObservers    []func(rt.VehiclesMap)
+	tripUpdateObservers []func(rt.TripUpdatesMap)
+	alertObservers      []func(rt.AlertMap)
+
+	mu    sync.RWMutex
+	feeds map[FeedKind]FeedHealth
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newFeedMonitor(provider string, realtime rt.Realtime, interval time.Duration) *FeedMonitor {
+	return &FeedMonitor{
+		provider: provider,
+		realtime: realtime,
+		interval: interval,
+		feeds:    make(map[FeedKind]FeedHealth),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Calls observe with every successful vehicle feed read, must be called before Start
+func (m *FeedMonitor) OnVehicles(observe func(rt.VehiclesMap)) {
+	m.vehicleObservers = append(m.vehicleObservers, observe)
+}
+
+// Calls observe with every successful trip updates feed read, must be called before Start
+func (m *FeedMonitor) OnTripUpdates(observe func(rt.TripUpdatesMap)) {
+	m.tripUpdateObservers = append(m.tripUpdateObservers, observe)
+}
+
+// Calls observe with every successful alerts feed read, must be called before Start
+func (m *FeedMonitor) OnAlerts(observe func(rt.AlertMap)) {
+	m.alertObservers = append(m.alertObservers, observe)
+}
+
+func (m *FeedMonitor) Start() {
+	go func() {
+		ticker := time.NewTicker(m.interval)
+		defer ticker.Stop()
+
+		m.poll()
+		for {
+			select {
+			case <-m.stop:
+				return
+			case <-ticker.C:
+				m.poll()
+			}
+		}
+	}()
+}
+
+func (m *FeedMonitor) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *FeedMonitor) poll() {
+	now := time.Now()
+
+	vehicles, err := m.realtime.GetVehicles()
+	m.record(FeedVehiclePositions, now, err, len(vehicles), func() time.Time {
+		return newestVehicleTimestamp(vehicles)
+	})
+	if err == nil {
+		for _, observe := range m.vehicleObservers {
+			observe(vehicles)
+		}
+	}
+
+	tripUpdates, err := m.realtime.GetTripUpdates()
+	m.record(FeedTripUpdates, now, err, len(tripUpdates), func() time.Time {
+		return newestTripUpdateTimestamp(tripUpdates)
+	})
+	if err == nil {
+		for _, observe := range m.tripUpdateObservers {
+			observe(tripUpdates)
+		}
+	}
+
+	alerts, err := m.realtime.GetAlerts()
+	m.record(FeedAlerts, now, err, len(alerts), func() time.Time {
+		return time.Time{}
+	})
+	if err == nil {
+		for _, observe := range m.alertObservers {
+			observe(alerts)
+		}
+	}
+}
+
+func (m *FeedMonitor) record(kind FeedKind, now time.Time, err error, entities int, newestEntity func() time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	health := m.feeds[kind]
+	health.LastAttempt = now
+	if err != nil {
+		health.LastError = err.Error()
+	} else {
+		health.LastSuccess = now
+		health.LastError = ""
+		health.Entities = entities
+		health.NewestEntity = newestEntity()
+	}
+	m.feeds[kind] = health
+
+	metrics.ObserveFeedFetch(m.provider, string(kind), err, now, health.Entities, health.NewestEntity)
+}
+
+func (m *FeedMonitor) Feed(kind FeedKind) FeedHealth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.feeds[kind]
+}
+
+// A feed is stale once it hasn't been read, or hasn't had new data, for a few poll intervals
+func (m *FeedMonitor) staleAfter() time.Duration {
+	return max(5*m.interval, time.Minute)
+}
+
+func unixOrZero(ts uint64) time.Time {
+	if ts == 0 {
+		return time.Time{}
+	}
+	return time.Unix(int64(ts), 0)
+}
+
+// Status responses
+
+type FeedStatus struct {
+	LastSuccess    *time.Time `json:"last_success"`
+	LastSuccessAge *float64   `json:"last_success_age_seconds"`
+	DataAge        *float64   `json:"data_age_seconds,omitempty"`
+	Entities       int        `json:"entities"`
+	Stale          bool       `json:"stale"`
+	Error          string     `json:"error,omitempty"`
+}
+
+type StaticStatus struct {
+	Loaded bool `json:"loaded"`
+	// When the gtfs database finished loading at startup
+	LoadedAt *time.Time `json:"loaded_at,omitempty"`
+	// Last time the caches were rebuilt from the gtfs database
+	CachesRebuiltAt *time.Time `json:"caches_rebuilt_at,omitempty"`
+	Routes          int        `json:"routes"`
+	Stops           int        `json:"stops"`
+	// From the feeds feed_info.txt, once the zip has been read
+	FeedVersion   string `json:"feed_version,omitempty"`
+	FeedStartDate string `json:"feed_start_date,omitempty"`
+	FeedEndDate   string `json:"feed_end_date,omitempty"`
+	// The zips Last-Modified and ETag headers, only when it doesn't have a feed_info.txt
+	LastModified string `json:"last_modified,omitempty"`
+	ETag         string `json:"etag,omitempty"`
+}
+
+type ProviderStatus struct {
+	Prefix        string                        `json:"prefix"`
+	Name          string                        `json:"name"`
+	State         ProviderState                 `json:"state"`
+	Reason        string                        `json:"reason,omitempty"`
+	Static        *StaticStatus                 `json:"static,omitempty"`
+	Realtime      map[FeedKind]FeedStatus       `json:"realtime,omitempty"`
+	Notifications *notifications.NotifierStatus `json:"notifications,omitempty"`
+}
+
+func (p *Provider) Status() ProviderStatus {
+	status := ProviderStatus{
+		Prefix: p.Config.Prefix,
+		Name:   p.Config.DisplayName(),
+		State:  p.State,
+		Reason: p.Reason,
+	}
+
+	if p.State == ProviderDisabled {
+		return status
+	}
+
+	routes := len(p.caches.GetRouteCache())
+	stops := len(p.caches.GetParentStopsCache())
+	status.Static = &StaticStatus{
+		Loaded: routes > 0 && stops > 0,
+		Routes: routes,
+		Stops:  stops,
+	}
+	if !p.StaticLoadedAt.IsZero() {
+		loadedAt := p.StaticLoadedAt
+		status.Static.LoadedAt = &loadedAt
+	}
+	if rebuiltAt := p.caches.RebuiltAt(); !rebuiltAt.IsZero() {
+		status.Static.CachesRebuiltAt = &rebuiltAt
+	}
+	if version := p.staticFeed.Feed().Version(); version.HasFeedInfo() {
+		status.Static.FeedVersion = version.FeedVersion
+		status.Static.FeedStartDate = version.FeedStartDate
+		status.Static.FeedEndDate = version.FeedEndDate
+	} else {
+		status.Static.LastModified = version.LastModified
+		status.Static.ETag = version.ETag
+	}
+
+	if p.feeds != nil {
+		now := time.Now()
+		staleAfter := p.feeds.staleAfter()
+		status.Realtime = make(map[FeedKind]FeedStatus, len(feedKinds))
+
+		for _, kind := range feedKinds {
+			health := p.feeds.Feed(kind)
+			feed := FeedStatus{
+				Entities: health.Entities,
+				Error:    health.LastError,
+				Stale:    true,
+			}
+
+			if !health.LastSuccess.IsZero() {
+				lastSuccess := health.LastSuccess
+				age := now.Sub(lastSuccess).Seconds()
+				feed.LastSuccess = &lastSuccess
+				feed.LastSuccessAge = &age
+				feed.Stale = now.Sub(lastSuccess) > staleAfter
+			}
+
+			if !health.NewestEntity.IsZero() {
+				dataAge := now.Sub(health.NewestEntity).Seconds()
+				feed.DataAge = &dataAge
+				if now.Sub(health.NewestEntity) > staleAfter {
+					feed.Stale = true
+				}
+			}
+
+			status.Realtime[kind] = feed
+		}
+	}
+
+	if p.notifier != nil {
+		notifierStatus := p.notifier.Status()
+		status.Notifications = &notifierStatus
+	}
+
+	return status
+}
+
+func setupStatusRoutes(primaryRoute *echo.Group, provider *Provider) {
+	primaryRoute.GET("/status", func(c echo.Context) error {
+		return JsonApiResponse(c, http.StatusOK, "", provider.Status())
+	})
+}
+
+/*
+Registers the process wide health endpoints
+
+/healthz is liveness, it only checks the api is serving requests
+
+/readyz is readiness, it is ready once at least one provider is mounted (ready or degraded)
+*/
+func SetupHealthRoutes(e *echo.Echo, providers []*Provider) {
+	e.GET("/healthz", func(c echo.Context) error {
+		return JsonApiResponse(c, http.StatusOK, "ok", nil)
+	})
+
+	e.GET("/readyz", func(c echo.Context) error {
+		statuses := make([]ProviderStatus, 0, len(providers))
+		mounted := 0
+
+		for _, provider := range providers {
+			status := provider.Status()
+			if status.State != ProviderDisabled {
+				mounted++
+			}
+			statuses = append(statuses, status)
+		}
+
+		if mounted == 0 {
+			return JsonApiResponse(c, http.StatusServiceUnavailable, "no providers available", statuses)
+		}
+
+		return JsonApiResponse(c, http.StatusOK, "ready", statuses)
+	})
+}
@@ -1,11 +1,16 @@
 package providers
 
 import (
+	"errors"
 	"math"
+	"slices"
 	"time"
 
+	"github.com/jfmow/at-trains-api/providers/delays"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
 	"github.com/jfmow/gtfs"
 	realtime "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
 )
 
 func pointInBounds(lat, lng float64, sw, ne LatLng) bool {
@@ -42,6 +47,7 @@ type RealtimeTripData struct {
 	TripUpdateTracking bool
 
 	ArrivalTime     string
+	ArrivalSource   string // ArrivalSourceScheduled, ArrivalSourceTripUpdate, ArrivalSourcePropagated, ArrivalSourcePosition or ArrivalSourceBlock
 	TimeTillArrival int
 	StopsAway       int
 	StopState       string
@@ -56,42 +62,103 @@ type RealtimeTripData struct {
 
 	Occupancy          int
 	WheelchairsAllowed int
+
+	TrackingConfidence string // TrackingHigh, TrackingMedium, TrackingLow, TrackingScheduled or TrackingUnavailable
+}
+
+/*
+Stop times for trips in stop sequence order and their shapes, each trip is only read from the database once.
+
+One is made per request, like the realtime feeds it reads, so departures for several stops don't read the same trips
+again and nothing is kept past a schedule reload.
+*/
+type tripStopTimesCache struct {
+	gtfsData gtfs.Database
+	trips    map[string][]gtfs.TripStopTime
+	shapes   map[string]*TripShapeDistance
+}
+
+func newTripStopTimesCache(gtfsData gtfs.Database) *tripStopTimesCache {
+	return &tripStopTimesCache{
+		gtfsData: gtfsData,
+		trips:    make(map[string][]gtfs.TripStopTime),
+		shapes:   make(map[string]*TripShapeDistance),
+	}
+}
+
+// nil if the trip doesn't have a shape
+func (t *tripStopTimesCache) shape(tripId string) *TripShapeDistance {
+	if shape, found := t.shapes[tripId]; found {
+		return shape
+	}
+	shape, err := NewTripShapeDistance(tripId, t.gtfsData)
+	if err != nil {
+		shape = nil
+	}
+	t.shapes[tripId] = shape
+	return shape
+}
+
+// Empty if the trips stop times can't be read
+func (t *tripStopTimesCache) get(tripId string) []gtfs.TripStopTime {
+	if stopTimes, found := t.trips[tripId]; found {
+		return stopTimes
+	}
+	stopTimes, err := t.gtfsData.GetStopTimesForTripID(tripId)
+	if err != nil {
+		stopTimes = nil
+	}
+	slices.SortFunc(stopTimes, func(a, b gtfs.TripStopTime) int {
+		return a.Sequence - b.Sequence
+	})
+	t.trips[tripId] = stopTimes
+	return stopTimes
+}
+
+/*
+Realtime data for a trip id is for it running on one day, the same trip id runs again the next day.
+startDate and serviceDate (YYYYMMDD) can be empty when they aren't known.
+*/
+func forServiceDate(startDate, serviceDate string) bool {
+	return startDate == "" || serviceDate == "" || startDate == serviceDate
 }
 
+var errOtherServiceDate = errors.New("realtime data is for the trip on another service day")
+
+/*
+serviceDate (YYYYMMDD) is the service day of the departure, it can be empty to work it out from the realtime data or the
+time. Realtime data for the trip running on another day is ignored.
+*/
 func GetRealtimeTripData(
 	service gtfs.StopTimes,
+	serviceDate string,
 	tripUpdatesData realtime.TripUpdatesMap,
 	vehicleLocations realtime.VehiclesMap,
 	gtfsData gtfs.Database,
+	realtimeAvailable bool,
+	sightings *realtimeSightings,
+	stopTimesCache *tripStopTimesCache,
+	blocks *vehicleBlocks,
 ) RealtimeTripData {
 	localTimeZone := gtfsData.LocalTimeZone()
 	now := time.Now().In(localTimeZone)
+	stopTimes := stopTimesCache.get(service.TripID)
 
 	result := RealtimeTripData{
 		TripID:             service.TripID,
 		ArrivalTime:        service.ArrivalTime,
+		ArrivalSource:      ArrivalSourceScheduled,
 		Platform:           service.Platform,
 		StopsAway:          service.StopSequence,
 		WheelchairsAllowed: service.StopData.WheelChairBoarding,
 		TripStarted:        true,
 	}
 
-	defaultArrivalTime, err := time.ParseInLocation("15:04:05", service.ArrivalTime, localTimeZone)
-	if err == nil {
-		defaultArrivalTime = time.Date(
-			now.Year(),
-			now.Month(),
-			now.Day(),
-			defaultArrivalTime.Hour(),
-			defaultArrivalTime.Minute(),
-			defaultArrivalTime.Second(),
-			0,
-			localTimeZone,
-		)
-		result.TimeTillArrival = int(defaultArrivalTime.Sub(now).Minutes())
+	foundVehicle, err := vehicleLocations.ByTripID(service.TripID)
+	if err == nil && !forServiceDate(foundVehicle.GetTrip().GetStartDate(), serviceDate) {
+		err = errOtherServiceDate
 	}
-
-	if foundVehicle, err := vehicleLocations.ByTripID(service.TripID); err == nil {
+	if err == nil {
 		result.LocationTracking = true
 		result.Occupancy = int(foundVehicle.GetOccupancyStatus().Number())
 
@@ -106,7 +173,35 @@ func GetRealtimeTripData(
 		}
 	}
 
-	if tripUpdate, err := tripUpdatesData.ByTripID(service.TripID); err == nil {
+	tripUpdate, err := tripUpdatesData.ByTripID(service.TripID)
+	if err == nil && !forServiceDate(tripUpdate.GetTrip().GetStartDate(), serviceDate) {
+		err = errOtherServiceDate
+	}
+
+	/*
+		The service day the trip is running on, so times past midnight (25:10:00) and trips that started
+		yesterday count down to the right time. The trips start_date is used if realtime has it, then the departures
+		service date
+	*/
+	startDate := ""
+	if err == nil {
+		startDate = tripUpdate.GetTrip().GetStartDate()
+	}
+	if startDate == "" && result.LocationTracking {
+		startDate = foundVehicle.GetTrip().GetStartDate()
+	}
+	if startDate == "" {
+		startDate = serviceDate
+	}
+	serviceDay, hasServiceDay := servicetime.TripDay(startDate, service.ArrivalTime, now, localTimeZone)
+	if hasServiceDay {
+		if scheduledArrival, ok := servicetime.At(service.ArrivalTime, serviceDay); ok {
+			result.ArrivalTime = scheduledArrival.Format("15:04:05")
+			result.TimeTillArrival = int(scheduledArrival.Sub(now).Minutes())
+		}
+	}
+
+	if err == nil {
 		result.TripUpdateTracking = true
 
 		result.TripStarted = checkIfTripStarted(
@@ -116,15 +211,22 @@ func GetRealtimeTripData(
 		)
 
 		stopUpdates := tripUpdate.GetStopTimeUpdate()
-		predictedArrivalTimes := getPredictedStopArrivalTimesForTrip(stopUpdates, localTimeZone)
 
-		if predictedArrival, ok := predictedArrivalTimes[service.StopId]; ok {
-			result.ArrivalTime = predictedArrival.ArrivalTime.Format("15:04:05")
-			result.TimeTillArrival = int(predictedArrival.ArrivalTime.Sub(now).Minutes())
+		// Updates often only cover the next stop, so the delay is carried on from the last stop before this one that has one
+		if len(stopTimes) > 0 && hasServiceDay {
+			predictions := delays.Propagate(delays.ScheduledStops(stopTimes, serviceDay), tripUpdate)
+			if prediction, ok := predictions[service.StopData.Sequence]; ok && prediction.Known {
+				result.ArrivalTime = prediction.Arrival.Format("15:04:05")
+				result.ArrivalSource = ArrivalSourcePropagated
+				if prediction.Explicit {
+					result.ArrivalSource = ArrivalSourceTripUpdate
+				}
+				result.TimeTillArrival = int(prediction.Arrival.Sub(now).Minutes())
+			}
 		}
 
-		_, lowestSequence, err := gtfsData.GetStopsForTripID(service.TripID)
-		if err == nil {
+		if len(stopTimes) > 0 {
+			lowestSequence := stopTimes[0].Sequence
 			nextStopSeq, _, simpleState := getNextStopSequence(stopUpdates, lowestSequence, localTimeZone)
 			result.StopsAway = service.StopData.Sequence - lowestSequence - nextStopSeq
 			result.StopState = simpleState
@@ -162,27 +264,91 @@ func GetRealtimeTripData(
 				result.Skipped = true
 			}
 		}
-	} else if result.TimeTillArrival <= -2 {
+	}
+
+	// Nothing from the trip update for this stop, use where the vehicle is
+	if result.LocationTracking && result.ArrivalSource == ArrivalSourceScheduled && !result.Canceled {
+		arrival, passed, ok := estimateArrivalFromPosition(service.StopData.Sequence, stopTimes, stopTimesCache.shape(service.TripID), foundVehicle, now)
+		switch {
+		case ok && passed:
+			result.Departed = true
+		case ok:
+			result.ArrivalTime = arrival.Format("15:04:05")
+			result.ArrivalSource = ArrivalSourcePosition
+			result.TimeTillArrival = int(arrival.Sub(now).Minutes())
+		}
+	}
+
+	// Not running yet, the vehicle doing the trip before it in its block can make it start late
+	if !result.TripUpdateTracking && !result.LocationTracking && hasServiceDay && len(stopTimes) > 0 {
+		if late, ok := blocks.inboundDelay(service.TripID, serviceDay, vehicleLocations, tripUpdatesData, stopTimesCache, now); ok && late > 0 {
+			delay := int32(late.Seconds())
+			predictions := delays.Propagate(delays.ScheduledStops(stopTimes, serviceDay), &proto.TripUpdate{Delay: &delay})
+			if prediction, ok := predictions[service.StopData.Sequence]; ok && prediction.Known {
+				result.ArrivalTime = prediction.Arrival.Format("15:04:05")
+				result.ArrivalSource = ArrivalSourceBlock
+				result.TimeTillArrival = int(prediction.Arrival.Sub(now).Minutes())
+			}
+		}
+	}
+
+	if !result.TripUpdateTracking && result.ArrivalSource == ArrivalSourceScheduled && result.TimeTillArrival <= -2 {
 		result.Departed = true
 	}
 
+	if !result.LocationTracking {
+		foundVehicle = nil
+	}
+	if !result.TripUpdateTracking {
+		tripUpdate = nil
+	}
+	result.TrackingConfidence = trackingConfidence(realtimeAvailable, foundVehicle, tripUpdate, sightings.LastSeen(service.TripID), func() time.Time {
+		if len(stopTimes) == 0 || !hasServiceDay {
+			return time.Time{}
+		}
+		departure := stopTimes[0].DepartureTime
+		if departure == "" {
+			departure = stopTimes[0].ArrivalTime
+		}
+		start, _ := servicetime.At(departure, serviceDay)
+		return start
+	}, now)
+
 	return result
 }
 
+/*
+serviceDates is the service date of each service, or nil if they aren't known.
+stopTimesCache can be shared by every call made for one request.
+*/
 func GetRealtimeTripDataForServices(
 	services []gtfs.StopTimes,
+	serviceDates []string,
 	tripUpdatesData realtime.TripUpdatesMap,
 	vehicleLocations realtime.VehiclesMap,
 	gtfsData gtfs.Database,
+	realtimeAvailable bool,
+	sightings *realtimeSightings,
+	stopTimesCache *tripStopTimesCache,
+	blocks *vehicleBlocks,
 ) []RealtimeTripData {
 	result := make([]RealtimeTripData, 0, len(services))
 
-	for _, service := range services {
+	for i, service := range services {
+		serviceDate := ""
+		if i < len(serviceDates) {
+			serviceDate = serviceDates[i]
+		}
 		result = append(result, GetRealtimeTripData(
 			service,
+			serviceDate,
 			tripUpdatesData,
 			vehicleLocations,
 			gtfsData,
+			realtimeAvailable,
+			sightings,
+			stopTimesCache,
+			blocks,
 		))
 	}
 
@@ -193,6 +359,7 @@ func (r RealtimeTripData) Apply(response *ServicesResponse2) {
 	response.LocationTracking = r.LocationTracking
 	response.TripUpdateTracking = r.TripUpdateTracking
 	response.ArrivalTime = r.ArrivalTime
+	response.ArrivalSource = r.ArrivalSource
 	response.TimeTillArrival = r.TimeTillArrival
 	response.StopsAway = r.StopsAway
 	response.StopState = r.StopState
@@ -203,5 +370,6 @@ func (r RealtimeTripData) Apply(response *ServicesResponse2) {
 	response.Platform = r.Platform
 	response.PlatformChanged = r.PlatformChanged
 	response.Occupancy = r.Occupancy
+	response.TrackingConfidence = r.TrackingConfidence
 	response.WheelchairsAllowed = r.WheelchairsAllowed
 }
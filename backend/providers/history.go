@@ -0,0 +1,104 @@
+package providers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/jfmow/at-trains-api/providers/history"
+	"github.com/jfmow/gtfs"
+	"github.com/labstack/echo/v5"
+)
+
+func setupHistoryRoutes(primaryRouter *echo.Group, gtfsData gtfs.Database, hsdb *history.Database) {
+	primaryRouter.GET("/hs/:trip", func(c echo.Context) error {
+		encodedtripId := c.PathParam("trip")
+		tripId, err := url.PathUnescape(encodedtripId)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip", nil, ResponseDetails("tripId", encodedtripId, "details", "Invalid trip ID format", "error", err.Error()))
+		}
+		updates, positions, err := hsdb.GetHistoricTrip(tripId)
+		if err != nil {
+			log.Printf("error getting historic trip: %v", err)
+			return JsonApiResponse(c, 500, "Database Error", nil)
+		}
+		return JsonApiResponse(c, 200, "OK", map[string]any{
+			"updates":   updates,
+			"positions": positions,
+		})
+	})
+
+	primaryRouter.GET("/hs", func(c echo.Context) error {
+		pageParam := c.QueryParam("page")
+		sizeParam := c.QueryParam("size")
+
+		page := 1
+		size := 10
+
+		if pageParam != "" {
+			fmt.Sscanf(pageParam, "%d", &page)
+		}
+		if sizeParam != "" {
+			fmt.Sscanf(sizeParam, "%d", &size)
+		}
+
+		if size > 100 {
+			size = 100
+		}
+
+		trips, totalCount, totalPages, err := hsdb.GetRecentTrips(page, size)
+		if err != nil {
+			log.Printf("error getting recent trips: %v", err)
+			return JsonApiResponse(c, 500, "Database Error", nil)
+		}
+
+		response := map[string]any{
+			"page":        page,
+			"page_size":   size,
+			"total_count": totalCount,
+			"total_pages": totalPages,
+			"trips":       trips,
+		}
+
+		return JsonApiResponse(c, 200, "OK", response)
+	})
+
+	// GET historic trips by route id with optional start/end timestamp query params
+	// Example: /hs/route/ROUTE123?start=1690000000&end=1690100000
+	primaryRouter.GET("/hs/route/:route", func(c echo.Context) error {
+		encodedrouteId := c.PathParam("route")
+		routeId, err := url.PathUnescape(encodedrouteId)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid route", nil, ResponseDetails("routeId", encodedrouteId, "details", "Invalid route ID format", "error", err.Error()))
+		}
+
+		var startPtr *int64
+		var endPtr *int64
+
+		if s := c.QueryParam("start"); s != "" {
+			if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+				startPtr = &v
+			}
+		}
+		if e := c.QueryParam("end"); e != "" {
+			if v, err := strconv.ParseInt(e, 10, 64); err == nil {
+				endPtr = &v
+			}
+		}
+
+		updates, err := hsdb.GetHistoricTripsByRoute(routeId, startPtr, endPtr)
+		if err != nil {
+			fmt.Println(err)
+			return JsonApiResponse(c, 500, "Error", nil, map[string]any{"error": err.Error()})
+		}
+
+		trips, err := gtfsData.GetTripsByIDs(updates)
+		if err != nil {
+			return JsonApiResponse(c, 500, "Error", nil, map[string]any{"error": err.Error()})
+		}
+
+		return JsonApiResponse(c, 200, "OK", trips)
+	})
+}
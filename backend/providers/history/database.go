@@ -0,0 +1,186 @@
+package history
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	rt "github.com/jfmow/gtfs/realtime"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	defaultQueryTimeout = 5 * time.Second
+	// How often rows older than the retention period are removed
+	pruneInterval = time.Hour
+)
+
+/*
+Database stores a providers realtime trip updates and vehicle positions so they can be looked at after the fact.
+
+Each provider gets its own sqlite file in {workdir}/history/{name}.db
+*/
+type Database struct {
+	db        *sql.DB
+	retention time.Duration
+
+	// Feed reads waiting to be saved, so a slow write doesn't hold up the feed monitor
+	tripUpdates chan rt.TripUpdatesMap
+	vehicles    chan rt.VehiclesMap
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newDatabase(name string, retention time.Duration) (*Database, error) {
+	if retention <= 0 {
+		return nil, errors.New("retention must be positive")
+	}
+
+	dir := filepath.Join(getWorkDir(), "history")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create history dir: %w", err)
+	}
+
+	dbPath := filepath.Join(dir, name+".db")
+	if !filepath.IsAbs(dbPath) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("get cwd: %w", err)
+		}
+		dbPath = filepath.Join(cwd, dbPath)
+	}
+
+	sqlDB, err := sql.Open("sqlite3", fmt.Sprintf("%s?_journal_mode=WAL&_busy_timeout=5000", dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("open history database: %w", err)
+	}
+
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("ping history database: %w", err)
+	}
+
+	database := &Database{
+		db:          sqlDB,
+		retention:   retention,
+		tripUpdates: make(chan rt.TripUpdatesMap, 1),
+		vehicles:    make(chan rt.VehiclesMap, 1),
+		stop:        make(chan struct{}),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	if err := database.ensureSchema(ctx); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return database, nil
+}
+
+/*
+Stops recording and closes the database.
+
+Waits for a write that is already in progress to finish first.
+*/
+func (d *Database) Close() error {
+	if d == nil || d.db == nil {
+		return nil
+	}
+	d.stopOnce.Do(func() {
+		close(d.stop)
+	})
+	d.wg.Wait()
+	return d.db.Close()
+}
+
+func (d *Database) ensureSchema(ctx context.Context) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS trip_updates (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            trip_id TEXT NOT NULL,
+            route_id TEXT NOT NULL,
+            schedule_relationship TEXT NOT NULL,
+            timestamp INTEGER NOT NULL,
+            stop_time_updates TEXT NOT NULL DEFAULT '[]',
+            UNIQUE(trip_id, timestamp)
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_trip_updates_route ON trip_updates(route_id, timestamp);`,
+		`CREATE INDEX IF NOT EXISTS idx_trip_updates_timestamp ON trip_updates(timestamp);`,
+		`CREATE TABLE IF NOT EXISTS vehicle_positions (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            trip_id TEXT NOT NULL,
+            route_id TEXT NOT NULL,
+            vehicle_id TEXT NOT NULL,
+            vehicle_label TEXT NOT NULL,
+            license_plate TEXT NOT NULL,
+            timestamp INTEGER NOT NULL,
+            latitude REAL NOT NULL,
+            longitude REAL NOT NULL,
+            bearing REAL NOT NULL,
+            speed REAL NOT NULL,
+            odometer REAL NOT NULL,
+            current_stop_sequence INTEGER NOT NULL,
+            stop_id TEXT NOT NULL,
+            vehicle_stop_status TEXT NOT NULL,
+            congestion_level TEXT NOT NULL,
+            occupancy_status TEXT NOT NULL,
+            occupancy_percentage INTEGER NOT NULL,
+            UNIQUE(vehicle_id, timestamp)
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_vehicle_positions_trip ON vehicle_positions(trip_id, timestamp);`,
+		`CREATE INDEX IF NOT EXISTS idx_vehicle_positions_timestamp ON vehicle_positions(timestamp);`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := d.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("ensure schema: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (d *Database) queryContext(query string, args ...any) (*sql.Rows, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return rows, cancel, nil
+}
+
+func (d *Database) queryRowContext(query string, args ...any) (*sql.Row, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	return d.db.QueryRowContext(ctx, query, args...), cancel
+}
+
+func (d *Database) execContext(query string, args ...any) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	return d.db.ExecContext(ctx, query, args...)
+}
+
+func getWorkDir() string {
+	ex, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	dir := filepath.Dir(ex)
+
+	if strings.Contains(dir, "go-build") {
+		return "."
+	}
+	return filepath.Dir(ex)
+}
@@ -0,0 +1,510 @@
+package history
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	rt "github.com/jfmow/gtfs/realtime"
+)
+
+type TripUpdate struct {
+	TripID               string
+	RouteID              string
+	ScheduleRelationship string
+	Timestamp            int64
+	StopTimeUpdates      []StopTimeUpdate
+}
+
+type StopTimeUpdate struct {
+	StopID               string
+	StopSequence         uint32
+	ArrivalDelay         int32
+	ArrivalTime          int64
+	ArrivalUncertainty   int32
+	DepartureDelay       int32
+	DepartureTime        int64
+	DepartureUncertainty int32
+	ScheduleRelationship string
+	// Whether the update had an arrival/departure, a delay of 0 on one that's there means on time
+	HasArrival   bool
+	HasDeparture bool
+}
+
+type VehiclePosition struct {
+	TripID              string
+	RouteID             string
+	VehicleID           string
+	VehicleLabel        string
+	LicensePlate        string
+	Timestamp           int64
+	Latitude            float32
+	Longitude           float32
+	Bearing             float32
+	Speed               float32
+	Odometer            float64
+	CurrentStopSequence uint32
+	StopID              string
+	VehicleStopStatus   string
+	CongestionLevel     string
+	OccupancyStatus     string
+	OccupancyPercentage uint32
+}
+
+// The latest update we have for a trip
+type RecentTrip struct {
+	TripID               string
+	RouteID              string
+	ScheduleRelationship string
+	Timestamp            int64
+}
+
+/*
+Opens the history database for a provider.
+
+The realtime feeds are recorded as they're read, by registering RecordTripUpdates and RecordVehicles with the
+providers feed monitor. Rows older than retention are removed hourly.
+*/
+func SetupHistoricalDataStorage(name string, retention time.Duration) (*Database, error) {
+	database, err := newDatabase(name, retention)
+	if err != nil {
+		return nil, err
+	}
+
+	database.wg.Add(1)
+	go func() {
+		defer database.wg.Done()
+
+		pruneTicker := time.NewTicker(pruneInterval)
+		defer pruneTicker.Stop()
+
+		database.prune()
+		for {
+			select {
+			case <-database.stop:
+				return
+			case updates := <-database.tripUpdates:
+				if err := database.saveTripUpdates(updates, time.Now().Unix()); err != nil {
+					log.Printf("history: failed to save trip updates: %v", err)
+				}
+			case vehicles := <-database.vehicles:
+				if err := database.saveVehiclePositions(vehicles, time.Now().Unix()); err != nil {
+					log.Printf("history: failed to save vehicle positions: %v", err)
+				}
+			case <-pruneTicker.C:
+				database.prune()
+			}
+		}
+	}()
+
+	return database, nil
+}
+
+// Queues a trip updates feed read to be saved, it's dropped if the last one still hasn't been
+func (d *Database) RecordTripUpdates(updates rt.TripUpdatesMap) {
+	select {
+	case d.tripUpdates <- updates:
+	default:
+	}
+}
+
+// Queues a vehicle positions feed read to be saved, it's dropped if the last one still hasn't been
+func (d *Database) RecordVehicles(vehicles rt.VehiclesMap) {
+	select {
+	case d.vehicles <- vehicles:
+	default:
+	}
+}
+
+func (d *Database) saveTripUpdates(updates rt.TripUpdatesMap, now int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*defaultQueryTimeout)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO trip_updates
+        (trip_id, route_id, schedule_relationship, timestamp, stop_time_updates)
+        VALUES (?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, update := range updates {
+		tripId := update.GetTrip().GetTripId()
+		if tripId == "" {
+			continue
+		}
+
+		timestamp := int64(update.GetTimestamp())
+		if timestamp == 0 {
+			timestamp = now
+		}
+
+		stopTimeUpdates := make([]StopTimeUpdate, 0, len(update.GetStopTimeUpdate()))
+		for _, stu := range update.GetStopTimeUpdate() {
+			stopTimeUpdates = append(stopTimeUpdates, StopTimeUpdate{
+				StopID:               stu.GetStopId(),
+				StopSequence:         stu.GetStopSequence(),
+				ArrivalDelay:         stu.GetArrival().GetDelay(),
+				ArrivalTime:          stu.GetArrival().GetTime(),
+				ArrivalUncertainty:   stu.GetArrival().GetUncertainty(),
+				DepartureDelay:       stu.GetDeparture().GetDelay(),
+				DepartureTime:        stu.GetDeparture().GetTime(),
+				DepartureUncertainty: stu.GetDeparture().GetUncertainty(),
+				ScheduleRelationship: stu.GetScheduleRelationship().String(),
+				HasArrival:           stu.Arrival != nil,
+				HasDeparture:         stu.Departure != nil,
+			})
+		}
+		encoded, err := json.Marshal(stopTimeUpdates)
+		if err != nil {
+			return err
+		}
+
+		if _, err := stmt.ExecContext(ctx,
+			tripId,
+			update.GetTrip().GetRouteId(),
+			update.GetTrip().GetScheduleRelationship().String(),
+			timestamp,
+			string(encoded),
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (d *Database) saveVehiclePositions(vehicles rt.VehiclesMap, now int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*defaultQueryTimeout)
+	defer cancel()
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO vehicle_positions
+        (trip_id, route_id, vehicle_id, vehicle_label, license_plate, timestamp, latitude, longitude, bearing, speed, odometer,
+         current_stop_sequence, stop_id, vehicle_stop_status, congestion_level, occupancy_status, occupancy_percentage)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, vehicle := range vehicles {
+		tripId := vehicle.GetTrip().GetTripId()
+		vehicleId := vehicle.GetVehicle().GetId()
+		if tripId == "" || vehicleId == "" {
+			continue
+		}
+
+		timestamp := int64(vehicle.GetTimestamp())
+		if timestamp == 0 {
+			timestamp = now
+		}
+
+		position := vehicle.GetPosition()
+		if _, err := stmt.ExecContext(ctx,
+			tripId,
+			vehicle.GetTrip().GetRouteId(),
+			vehicleId,
+			vehicle.GetVehicle().GetLabel(),
+			vehicle.GetVehicle().GetLicensePlate(),
+			timestamp,
+			position.GetLatitude(),
+			position.GetLongitude(),
+			position.GetBearing(),
+			position.GetSpeed(),
+			position.GetOdometer(),
+			vehicle.GetCurrentStopSequence(),
+			vehicle.GetStopId(),
+			vehicle.GetCurrentStatus().String(),
+			vehicle.GetCongestionLevel().String(),
+			vehicle.GetOccupancyStatus().String(),
+			vehicle.GetOccupancyPercentage(),
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Removes everything older than the retention period
+func (d *Database) prune() {
+	cutoff := time.Now().Add(-d.retention).Unix()
+	for _, table := range []string{"trip_updates", "vehicle_positions"} {
+		if _, err := d.execContext(fmt.Sprintf(`DELETE FROM %s WHERE timestamp < ?`, table), cutoff); err != nil {
+			log.Printf("history: failed to prune %s: %v", table, err)
+		}
+	}
+}
+
+/*
+Every stored update and position for a trip, oldest first
+*/
+func (d *Database) GetHistoricTrip(tripId string) ([]TripUpdate, []VehiclePosition, error) {
+	updates := []TripUpdate{}
+	positions := []VehiclePosition{}
+
+	rows, cancel, err := d.queryContext(`SELECT trip_id, route_id, schedule_relationship, timestamp, stop_time_updates
+        FROM trip_updates WHERE trip_id = ? ORDER BY timestamp ASC`, tripId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query trip updates: %w", err)
+	}
+	defer cancel()
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			update          TripUpdate
+			stopTimeUpdates string
+		)
+		if err := rows.Scan(&update.TripID, &update.RouteID, &update.ScheduleRelationship, &update.Timestamp, &stopTimeUpdates); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan trip update: %w", err)
+		}
+		if err := json.Unmarshal([]byte(stopTimeUpdates), &update.StopTimeUpdates); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode stop time updates: %w", err)
+		}
+		updates = append(updates, update)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating trip updates: %w", err)
+	}
+
+	positionRows, positionCancel, err := d.queryContext(`SELECT trip_id, route_id, vehicle_id, vehicle_label, license_plate, timestamp,
+        latitude, longitude, bearing, speed, odometer, current_stop_sequence, stop_id, vehicle_stop_status,
+        congestion_level, occupancy_status, occupancy_percentage
+        FROM vehicle_positions WHERE trip_id = ? ORDER BY timestamp ASC`, tripId)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query vehicle positions: %w", err)
+	}
+	defer positionCancel()
+	defer positionRows.Close()
+
+	for positionRows.Next() {
+		var p VehiclePosition
+		if err := positionRows.Scan(&p.TripID, &p.RouteID, &p.VehicleID, &p.VehicleLabel, &p.LicensePlate, &p.Timestamp,
+			&p.Latitude, &p.Longitude, &p.Bearing, &p.Speed, &p.Odometer, &p.CurrentStopSequence, &p.StopID, &p.VehicleStopStatus,
+			&p.CongestionLevel, &p.OccupancyStatus, &p.OccupancyPercentage); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan vehicle position: %w", err)
+		}
+		positions = append(positions, p)
+	}
+	if err := positionRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating vehicle positions: %w", err)
+	}
+
+	return updates, positions, nil
+}
+
+/*
+Trips with the most recent updates first, paginated.
+
+Returns the trips, the total number of trips and the total number of pages.
+*/
+func (d *Database) GetRecentTrips(page, size int) ([]RecentTrip, int, int, error) {
+	if page < 1 {
+		page = 1
+	}
+	if size < 1 {
+		size = 1
+	}
+
+	row, cancel := d.queryRowContext(`SELECT COUNT(DISTINCT trip_id) FROM trip_updates`)
+	var totalCount int
+	err := row.Scan(&totalCount)
+	cancel()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to count trips: %w", err)
+	}
+
+	totalPages := (totalCount + size - 1) / size
+
+	// sqlite fills the bare columns from the row that has the max(timestamp)
+	rows, queryCancel, err := d.queryContext(`SELECT trip_id, route_id, schedule_relationship, MAX(timestamp) AS latest
+        FROM trip_updates GROUP BY trip_id ORDER BY latest DESC LIMIT ? OFFSET ?`, size, (page-1)*size)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to query recent trips: %w", err)
+	}
+	defer queryCancel()
+	defer rows.Close()
+
+	trips := []RecentTrip{}
+	for rows.Next() {
+		var trip RecentTrip
+		if err := rows.Scan(&trip.TripID, &trip.RouteID, &trip.ScheduleRelationship, &trip.Timestamp); err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to scan recent trip: %w", err)
+		}
+		trips = append(trips, trip)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, 0, fmt.Errorf("error iterating recent trips: %w", err)
+	}
+
+	return trips, totalCount, totalPages, nil
+}
+
+/*
+The ids of the trips on a route that have updates between start and end (unix seconds), either can be nil
+*/
+func (d *Database) GetHistoricTripsByRoute(routeId string, start, end *int64) ([]string, error) {
+	var (
+		conditions = []string{"route_id = ?"}
+		args       = []any{routeId}
+	)
+	if start != nil {
+		conditions = append(conditions, "timestamp >= ?")
+		args = append(args, *start)
+	}
+	if end != nil {
+		conditions = append(conditions, "timestamp <= ?")
+		args = append(args, *end)
+	}
+
+	rows, cancel, err := d.queryContext(`SELECT trip_id, MIN(timestamp) AS first_seen FROM trip_updates
+        WHERE `+strings.Join(conditions, " AND ")+` GROUP BY trip_id ORDER BY first_seen ASC`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trips for route: %w", err)
+	}
+	defer cancel()
+	defer rows.Close()
+
+	tripIds := []string{}
+	for rows.Next() {
+		var (
+			tripId    string
+			firstSeen int64
+		)
+		if err := rows.Scan(&tripId, &firstSeen); err != nil {
+			return nil, fmt.Errorf("failed to scan trip id: %w", err)
+		}
+		tripIds = append(tripIds, tripId)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trips for route: %w", err)
+	}
+
+	return tripIds, nil
+}
+
+// Trips are rerun under the same trip id every service day, updates further apart than this are treated as separate runs
+const tripRunGap = 6 * time.Hour
+
+/*
+Everything we recorded about one run of a trip.
+
+StopTimeUpdates holds, for each stop, the stop time update from the most recent trip update that included it,
+which is the closest we have to what actually happened at that stop.
+*/
+type TripObservation struct {
+	TripID          string
+	RouteID         string
+	Cancelled       bool
+	FirstSeen       int64
+	LastSeen        int64
+	StopTimeUpdates []StopTimeUpdate
+}
+
+/*
+Collects the trip runs that have updates between start and end (unix seconds).
+
+routeId is optional, "" returns every route
+*/
+func (d *Database) GetTripObservations(start, end int64, routeId string) ([]TripObservation, error) {
+	query := `SELECT trip_id, route_id, schedule_relationship, timestamp, stop_time_updates
+        FROM trip_updates WHERE timestamp >= ? AND timestamp <= ?`
+	args := []any{start, end}
+	if routeId != "" {
+		query += ` AND route_id = ?`
+		args = append(args, routeId)
+	}
+	query += ` ORDER BY trip_id, timestamp ASC`
+
+	// Scans a lot more rows than the other queries
+	ctx, cancel := context.WithTimeout(context.Background(), 12*defaultQueryTimeout)
+	defer cancel()
+
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query trip updates: %w", err)
+	}
+	defer rows.Close()
+
+	var (
+		observations []TripObservation
+		current      *TripObservation
+		stops        map[string]StopTimeUpdate
+	)
+
+	finish := func() {
+		if current == nil {
+			return
+		}
+		current.StopTimeUpdates = make([]StopTimeUpdate, 0, len(stops))
+		for _, stu := range stops {
+			current.StopTimeUpdates = append(current.StopTimeUpdates, stu)
+		}
+		slices.SortFunc(current.StopTimeUpdates, func(a, b StopTimeUpdate) int {
+			return cmp.Compare(a.StopSequence, b.StopSequence)
+		})
+		observations = append(observations, *current)
+	}
+
+	for rows.Next() {
+		var (
+			update          TripUpdate
+			stopTimeUpdates string
+		)
+		if err := rows.Scan(&update.TripID, &update.RouteID, &update.ScheduleRelationship, &update.Timestamp, &stopTimeUpdates); err != nil {
+			return nil, fmt.Errorf("failed to scan trip update: %w", err)
+		}
+		if err := json.Unmarshal([]byte(stopTimeUpdates), &update.StopTimeUpdates); err != nil {
+			return nil, fmt.Errorf("failed to decode stop time updates: %w", err)
+		}
+
+		if current == nil || current.TripID != update.TripID || update.Timestamp-current.LastSeen > int64(tripRunGap.Seconds()) {
+			finish()
+			current = &TripObservation{
+				TripID:    update.TripID,
+				RouteID:   update.RouteID,
+				FirstSeen: update.Timestamp,
+			}
+			stops = make(map[string]StopTimeUpdate)
+		}
+
+		current.LastSeen = update.Timestamp
+		// The latest update wins, a trip can be reinstated after being cancelled
+		current.Cancelled = update.ScheduleRelationship == "CANCELED"
+		for _, stu := range update.StopTimeUpdates {
+			stops[stopTimeUpdateKey(stu)] = stu
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating trip updates: %w", err)
+	}
+	finish()
+
+	return observations, nil
+}
+
+// Feeds identify a stop by sequence, id or both
+func stopTimeUpdateKey(stu StopTimeUpdate) string {
+	if stu.StopSequence != 0 {
+		return fmt.Sprintf("seq:%d", stu.StopSequence)
+	}
+	return "stop:" + stu.StopID
+}
@@ -0,0 +1,211 @@
+package providers
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+const (
+	// Faster than this between two observations is gps noise, not the vehicle moving (~200km/h)
+	maxPlausibleSpeed = 55.0
+	// A vehicle further than this from its shape makes the estimate less trustworthy
+	offShapeDistance = 50.0
+)
+
+// An estimate of where a vehicle is now, worked out from where it was last seen
+type InterpolatedPosition struct {
+	Lat     float64 `json:"lat"`
+	Lon     float64 `json:"lon"`
+	Bearing float64 `json:"bearing"`
+	// 0-1, how much the estimate can be trusted. Falls as the last observation gets older
+	Confidence float64 `json:"confidence"`
+	// Unix ms the estimate is for
+	At int64 `json:"at"`
+}
+
+type observedPosition struct {
+	lat, lon float64
+	at       time.Time
+}
+
+type tripPositions struct {
+	previous, last observedPosition
+	hasPrevious    bool
+	shape          *TripShapeDistance // loaded the first time the trip is interpolated
+}
+
+/*
+vehiclePositions remembers the last two positions reported for every trip in the vehicle feed,
+so a vehicle can be moved along its shape between feed refreshes (dead reckoning).
+
+It is fed by the FeedMonitor every poll.
+*/
+type vehiclePositions struct {
+	gtfsData             gtfs.Database
+	getStopsForTripCache caches.StopsForTripCache
+	localTimeZone        *time.Location
+	// Estimates are never made further than this past the last observation
+	maxExtrapolation time.Duration
+
+	mu    sync.Mutex
+	trips map[string]*tripPositions
+}
+
+func newVehiclePositions(gtfsData gtfs.Database, getStopsForTripCache caches.StopsForTripCache, localTimeZone *time.Location, pollInterval time.Duration) *vehiclePositions {
+	return &vehiclePositions{
+		gtfsData:             gtfsData,
+		getStopsForTripCache: getStopsForTripCache,
+		localTimeZone:        localTimeZone,
+		maxExtrapolation:     2 * pollInterval,
+		trips:                make(map[string]*tripPositions),
+	}
+}
+
+// Records the positions in a vehicle feed read, trips no longer in the feed are forgotten
+func (v *vehiclePositions) observe(vehicles rt.VehiclesMap) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	seen := make(map[string]struct{}, len(vehicles))
+	for _, vehicle := range vehicles {
+		tripID := vehicle.GetTrip().GetTripId()
+		position := vehicle.GetPosition()
+		if tripID == "" || position == nil || vehicle.GetTimestamp() == 0 {
+			continue
+		}
+		seen[tripID] = struct{}{}
+
+		observation := observedPosition{
+			lat: float64(position.GetLatitude()),
+			lon: float64(position.GetLongitude()),
+			at:  time.Unix(int64(vehicle.GetTimestamp()), 0),
+		}
+
+		trip, found := v.trips[tripID]
+		if !found {
+			v.trips[tripID] = &tripPositions{last: observation}
+			continue
+		}
+		// The feed is often re-read before the vehicle reports again
+		if !observation.at.After(trip.last.at) {
+			continue
+		}
+		trip.previous, trip.last, trip.hasPrevious = trip.last, observation, true
+	}
+
+	for tripID := range v.trips {
+		if _, found := seen[tripID]; !found {
+			delete(v.trips, tripID)
+		}
+	}
+}
+
+/*
+Estimates where the vehicle running a trip is at a time, by moving it along the trip shape at the speed
+it covered between its last two observations (or the speed it reports, if there is only one).
+
+The estimate never goes past the next stop, the vehicle may be waiting there. Returns false if the trip
+hasn't been seen or has no shape.
+*/
+func (v *vehiclePositions) interpolate(tripID string, tripUpdate *proto.TripUpdate, reportedSpeed float32, at time.Time) (*InterpolatedPosition, bool) {
+	v.mu.Lock()
+	trip, found := v.trips[tripID]
+	var (
+		previous, last observedPosition
+		hasPrevious    bool
+		shape          *TripShapeDistance
+	)
+	if found {
+		previous, last, hasPrevious, shape = trip.previous, trip.last, trip.hasPrevious, trip.shape
+	}
+	v.mu.Unlock()
+	if !found {
+		return nil, false
+	}
+
+	if shape == nil {
+		loaded, err := NewTripShapeDistance(tripID, v.gtfsData)
+		if err != nil || len(loaded.Line) < 2 {
+			return nil, false
+		}
+		shape = loaded
+		v.mu.Lock()
+		if trip, found := v.trips[tripID]; found {
+			trip.shape = shape
+		}
+		v.mu.Unlock()
+	}
+
+	lastDistance := shape.DistanceAlong(last.lat, last.lon)
+
+	// Meters per second along the shape, and how much it is trusted
+	var speed, confidence float64
+	if hasPrevious {
+		speed = (lastDistance - shape.DistanceAlong(previous.lat, previous.lon)) / last.at.Sub(previous.at).Seconds()
+		confidence = 1
+	}
+	if speed <= 0 || speed > maxPlausibleSpeed {
+		speed, confidence = float64(reportedSpeed), 0.6
+	}
+	if speed <= 0 || speed > maxPlausibleSpeed {
+		speed, confidence = 0, 0.3
+	}
+
+	elapsed := min(max(at.Sub(last.at), 0), v.maxExtrapolation)
+	if v.maxExtrapolation > 0 {
+		confidence *= 1 - 0.5*elapsed.Seconds()/v.maxExtrapolation.Seconds()
+	}
+
+	if offShape, err := shape.DistanceFromLine(last.lat, last.lon); err == nil && offShape > offShapeDistance {
+		confidence *= 0.5
+	}
+
+	estimatedDistance := lastDistance + speed*elapsed.Seconds()
+	if nextStopDistance, found := v.nextStopDistance(tripID, tripUpdate, shape); found {
+		estimatedDistance = min(estimatedDistance, max(nextStopDistance, lastDistance))
+	} else {
+		// Without knowing where the next stop is the vehicle could be anywhere past it
+		estimatedDistance = lastDistance
+		confidence *= 0.5
+	}
+
+	lat, lon, bearing := shape.PointAt(estimatedDistance)
+	return &InterpolatedPosition{
+		Lat:        lat,
+		Lon:        lon,
+		Bearing:    bearing,
+		Confidence: confidence,
+		At:         at.UnixMilli(),
+	}, true
+}
+
+// Distance along the shape to the stop the vehicle is heading to
+func (v *vehiclePositions) nextStopDistance(tripID string, tripUpdate *proto.TripUpdate, shape *TripShapeDistance) (float64, bool) {
+	if tripUpdate == nil {
+		return 0, false
+	}
+
+	stopsData, ok := v.getStopsForTripCache()[tripID]
+	if !ok || len(stopsData.Stops) == 0 || stopsData.LowestSequence == -1 {
+		return 0, false
+	}
+
+	stops := slices.Clone(stopsData.Stops)
+	slices.SortFunc(stops, func(a, b gtfs.Stop) int {
+		return a.Sequence - b.Sequence
+	})
+
+	nextSeq, _, state := getNextStopSequence(tripUpdate.GetStopTimeUpdate(), stopsData.LowestSequence, v.localTimeZone)
+	if state == "Unknown" {
+		return 0, false
+	}
+
+	nextStop := stops[min(max(nextSeq, 0), len(stops)-1)]
+	return shape.DistanceAlong(nextStop.StopLat, nextStop.StopLon), true
+}
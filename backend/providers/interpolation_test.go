@@ -0,0 +1,99 @@
+package providers
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime/proto"
+	"github.com/paulmach/orb"
+)
+
+// A trip heading north in a straight line, last seen 20 seconds after the one before, 27.8m/s
+func newTestVehiclePositions(nextStopLat float64) (*vehiclePositions, time.Time) {
+	lastSeen := time.Now().Add(-30 * time.Second)
+	stops := []gtfs.Stop{
+		{StopId: "first", Sequence: 1, StopLat: -37.0, StopLon: 174.0},
+		{StopId: "next", Sequence: 2, StopLat: nextStopLat, StopLon: 174.0},
+		{StopId: "last", Sequence: 3, StopLat: -36.9, StopLon: 174.0},
+	}
+
+	// The shape is already loaded, so the database isn't used
+	var gtfsData gtfs.Database
+	positions := newVehiclePositions(gtfsData, func() map[string]caches.StopsForTripId {
+		return map[string]caches.StopsForTripId{"trip": {Stops: stops, LowestSequence: 1}}
+	}, time.UTC, time.Minute)
+	positions.trips["trip"] = &tripPositions{
+		previous:    observedPosition{lat: -37.0, lon: 174.0, at: lastSeen.Add(-20 * time.Second)},
+		last:        observedPosition{lat: -36.995, lon: 174.0, at: lastSeen},
+		hasPrevious: true,
+		shape:       &TripShapeDistance{TripID: "trip", Line: orb.LineString{{174.0, -37.0}, {174.0, -36.9}}},
+	}
+	return positions, lastSeen
+}
+
+// Heading for the second stop, arriving in 5 minutes
+func approachingSecondStop() *proto.TripUpdate {
+	sequence := uint32(2)
+	arrival := time.Now().Add(5 * time.Minute).Unix()
+	return &proto.TripUpdate{StopTimeUpdate: []*proto.TripUpdate_StopTimeUpdate{
+		{StopSequence: &sequence, Arrival: &proto.TripUpdate_StopTimeEvent{Time: &arrival}},
+	}}
+}
+
+func TestInterpolateNeverPassesNextStop(t *testing.T) {
+	tests := []struct {
+		name        string
+		nextStopLat float64
+		tripUpdate  *proto.TripUpdate
+		wantLat     float64
+	}{
+		{
+			// 30 seconds at 27.8m/s is 834m, the stop is 111m ahead
+			name:        "stops at the next stop",
+			nextStopLat: -36.994,
+			tripUpdate:  approachingSecondStop(),
+			wantLat:     -36.994,
+		},
+		{
+			name:        "moves freely before a far away stop",
+			nextStopLat: -36.95,
+			tripUpdate:  approachingSecondStop(),
+			wantLat:     -36.995 + 834.0/111195.0,
+		},
+		{
+			name:        "doesn't go backwards to a stop it has passed",
+			nextStopLat: -36.996,
+			tripUpdate:  approachingSecondStop(),
+			wantLat:     -36.995,
+		},
+		{
+			name:        "stays put without knowing the next stop",
+			nextStopLat: -36.95,
+			tripUpdate:  nil,
+			wantLat:     -36.995,
+		},
+	}
+
+	for _, test := range tests {
+		positions, lastSeen := newTestVehiclePositions(test.nextStopLat)
+		estimate, ok := positions.interpolate("trip", test.tripUpdate, 0, lastSeen.Add(30*time.Second))
+		if !ok {
+			t.Errorf("%s: no estimate", test.name)
+			continue
+		}
+		// ~10m
+		if math.Abs(estimate.Lat-test.wantLat) > 0.0001 || math.Abs(estimate.Lon-174.0) > 0.0001 {
+			t.Errorf("%s: estimate at %f,%f, want %f,174.0", test.name, estimate.Lat, estimate.Lon, test.wantLat)
+		}
+	}
+}
+
+func TestInterpolateUnknownTrip(t *testing.T) {
+	positions, lastSeen := newTestVehiclePositions(-36.994)
+	if _, ok := positions.interpolate("other", approachingSecondStop(), 0, lastSeen); ok {
+		t.Errorf("a trip that hasn't been seen shouldn't have an estimate")
+	}
+}
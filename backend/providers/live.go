@@ -0,0 +1,574 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+	"github.com/labstack/echo/v5"
+	protobuf "google.golang.org/protobuf/proto"
+)
+
+// The query filters shared by /realtime/live and /realtime/live/stream
+type liveVehicleFilters struct {
+	tripID      string
+	vehicleType string
+	hasBounds   bool
+	boundA      LatLng
+	boundB      LatLng
+}
+
+/*
+Reads the tripId, type and bounds query params.
+
+If they are invalid the returned func writes the bad request response.
+*/
+func parseLiveVehicleFilters(c echo.Context) (liveVehicleFilters, func() error) {
+	var filters liveVehicleFilters
+
+	// All params are URL-escaped by default, so unescape first.
+	tripID, err := url.PathUnescape(c.QueryParam("tripId"))
+	if err != nil {
+		return filters, func() error {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip id", nil,
+				ResponseDetails("tripId", c.QueryParam("tripId"), "error", err.Error()))
+		}
+	}
+
+	vehicleType, err := url.PathUnescape(c.QueryParam("type"))
+	if err != nil {
+		return filters, func() error {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid vehicle type", nil,
+				ResponseDetails("vehicle_type", c.QueryParam("type"), "error", err.Error()))
+		}
+	}
+
+	boundsStr, err := url.PathUnescape(c.QueryParam("bounds"))
+	if err != nil {
+		return filters, func() error {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid bounds", nil,
+				ResponseDetails("bounds", c.QueryParam("bounds"), "error", err.Error()))
+		}
+	}
+
+	// Bounds restrict vehicles to a visible map area.
+	// If omitted, all vehicles are returned.
+	hasBounds := boundsStr != ""
+	var boundA, boundB LatLng
+
+	if hasBounds {
+		boundA, boundB, err = parseBounds(boundsStr)
+		if err != nil {
+			return filters, func() error {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid bounds format", nil,
+					ResponseDetails("bounds", boundsStr, "details", "Expected [[lat1,lng1],[lat2,lng2]]"))
+			}
+		}
+	}
+
+	filters = liveVehicleFilters{
+		tripID:      tripID,
+		vehicleType: vehicleType,
+		hasBounds:   hasBounds,
+		boundA:      boundA,
+		boundB:      boundB,
+	}
+
+	return filters, nil
+}
+
+// Parses a bounds query param, [[lat1,lng1],[lat2,lng2]]
+func parseBounds(boundsStr string) (LatLng, LatLng, error) {
+	var rawBounds [][]float64
+	if err := json.Unmarshal([]byte(boundsStr), &rawBounds); err != nil {
+		return LatLng{}, LatLng{}, err
+	}
+	if len(rawBounds) != 2 || len(rawBounds[0]) != 2 || len(rawBounds[1]) != 2 {
+		return LatLng{}, LatLng{}, errors.New("expected [[lat1,lng1],[lat2,lng2]]")
+	}
+	// Normalize bounds into LatLng structs for easy reuse
+	return LatLng{Lat: rawBounds[0][0], Lng: rawBounds[0][1]}, LatLng{Lat: rawBounds[1][0], Lng: rawBounds[1][1]}, nil
+}
+
+// Checks an already built vehicle against the filters
+func (f liveVehicleFilters) matches(vehicle VehiclesResponse) bool {
+	if f.hasBounds && !pointInBounds(float64(vehicle.Position.Lat), float64(vehicle.Position.Lon), f.boundA, f.boundB) {
+		return false
+	}
+	if f.tripID != "" && vehicle.TripId != f.tripID {
+		return false
+	}
+	if f.vehicleType != "" && f.vehicleType != "all" && !strings.EqualFold(vehicle.Route.VehicleType, f.vehicleType) {
+		return false
+	}
+	return true
+}
+
+// Builds the /realtime/live vehicle list from the realtime feeds
+type liveVehicleBuilder struct {
+	gtfsData                  gtfs.Database
+	localTimeZone             *time.Location
+	getRouteCache             caches.RouteCache
+	getStopsForTripCache      caches.StopsForTripCache
+	getParentStopByChildCache caches.ParentStopsByChildCache
+	blocks                    *vehicleBlocks // can be nil
+}
+
+/*
+Returns the in service vehicles that match the filters.
+
+Trip details (stops, state, off course) are only worked out when filtering to a single trip.
+*/
+func (b liveVehicleBuilder) build(vehicles rt.VehiclesMap, tripUpdates rt.TripUpdatesMap, filters liveVehicleFilters) []VehiclesResponse {
+	// ==================================================================
+	// Preload caches to avoid repeated DB / file access
+	// ==================================================================
+	routeCache := b.getRouteCache()
+	stopsForTripCache := b.getStopsForTripCache()
+
+	response := make([]VehiclesResponse, 0)
+
+	// ==================================================================
+	// Main vehicle processing loop
+	// ==================================================================
+	for _, vehicle := range vehicles {
+		pos := vehicle.GetPosition()
+		lat, lng := float64(pos.GetLatitude()), float64(pos.GetLongitude())
+
+		// Skip vehicles outside the requested map bounds
+		if filters.hasBounds && !pointInBounds(lat, lng, filters.boundA, filters.boundB) {
+			continue
+		}
+
+		trip := vehicle.GetTrip()
+		tripIDCur := trip.GetTripId()
+		routeID := trip.GetRouteId()
+
+		// Skip vehicles without valid trip or route data
+		if tripIDCur == "" || routeID == "" {
+			continue
+		}
+
+		// If a specific trip is requested, only include that trip
+		if filters.tripID != "" && tripIDCur != filters.tripID {
+			continue
+		}
+
+		// ------------------------------------------------------------------
+		// Trip update validation
+		// ------------------------------------------------------------------
+		// Ensure the trip has started and is currently in service
+		tripUpdate, err := tripUpdates.ByTripID(tripIDCur)
+		if err != nil || !checkIfTripStarted(
+			tripUpdate.GetTrip().GetStartTime(),
+			tripUpdate.GetTrip().GetStartDate(),
+			b.localTimeZone,
+		) {
+			continue
+		}
+
+		// ------------------------------------------------------------------
+		// Route lookup + vehicle type filtering
+		// ------------------------------------------------------------------
+		routeData, err := getVehicleRouteData(routeID, routeCache)
+		if err != nil {
+			continue
+		}
+
+		// Allow filtering by vehicle type (bus, rail, etc.)
+		if filters.vehicleType != "" &&
+			filters.vehicleType != "all" &&
+			!strings.EqualFold(routeData.VehicleType, filters.vehicleType) {
+			continue
+		}
+
+		// ------------------------------------------------------------------
+		// Base response payload
+		// ------------------------------------------------------------------
+		resp := VehiclesResponse{
+			TripId:       tripIDCur,
+			Route:        *routeData,
+			VehicleType:  strings.ToLower(routeData.VehicleType),
+			Position:     VehiclesPosition{Lat: pos.GetLatitude(), Lon: pos.GetLongitude()},
+			Occupancy:    int8(vehicle.GetOccupancyStatus()),
+			LicensePlate: vehicle.GetVehicle().GetLicensePlate(),
+		}
+
+		// ------------------------------------------------------------------
+		// Detailed trip information (only when a single trip is requested)
+		// ------------------------------------------------------------------
+		// This is intentionally skipped for list views for performance.
+		if filters.tripID != "" {
+			currentTrip, err := b.gtfsData.GetTripByID(tripIDCur)
+			if err != nil {
+				continue
+			}
+
+			stopsData, ok := stopsForTripCache[tripIDCur]
+			if !ok || len(stopsData.Stops) == 0 || stopsData.LowestSequence == -1 {
+				continue
+			}
+
+			// Ensure stops are ordered by sequence
+			sort.Slice(stopsData.Stops, func(i, j int) bool {
+				return stopsData.Stops[i].Sequence < stopsData.Stops[j].Sequence
+			})
+
+			// Determine next stop and trip state (in-transit, stopped, etc.)
+			nextSeq, _, state := getNextStopSequence(
+				tripUpdate.GetStopTimeUpdate(),
+				stopsData.LowestSequence,
+				b.localTimeZone,
+			)
+
+			resp.State = state
+			resp.Trip = &VehiclesTrip{
+				Headsign:    currentTrip.TripHeadsign,
+				FirstStop:   getStopBySequenceNumber(stopsData.Stops, 0, b.getParentStopByChildCache),
+				CurrentStop: getStopBySequenceNumber(stopsData.Stops, min(nextSeq-1, len(stopsData.Stops)-1), b.getParentStopByChildCache),
+				NextStop:    getStopBySequenceNumber(stopsData.Stops, min(nextSeq, len(stopsData.Stops)-1), b.getParentStopByChildCache),
+				FinalStop:   getStopBySequenceNumber(stopsData.Stops, len(stopsData.Stops)-1, b.getParentStopByChildCache),
+			}
+			resp.Trip.NextTrip = b.nextTrip(tripIDCur, tripUpdate, vehicle)
+
+			// Detect vehicles that have deviated significantly from the route shape
+			if line, err := NewTripShapeDistance(tripIDCur, b.gtfsData); err == nil {
+				if dist, err := line.DistanceFromLine(lat, lng); err == nil && dist > offCourseDistance {
+					resp.OffCourse = true
+				}
+			}
+		}
+
+		response = append(response, resp)
+	}
+
+	return response
+}
+
+// The trip the vehicle runs after tripId, nil if it isn't known
+func (b liveVehicleBuilder) nextTrip(tripId string, tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition) *NextTrip {
+	_, _, next := b.blocks.forVehicle(tripId, tripUpdate, vehicle, newTripStopTimesCache(b.gtfsData), 1, time.Now())
+	if len(next) == 0 {
+		return nil
+	}
+	return &next[0]
+}
+
+const liveKeepAliveInterval = 20 * time.Second
+
+// One refresh of the vehicle feed, shared by every stream client
+type liveSnapshot struct {
+	vehicles    []VehiclesResponse // Every vehicle, without trip details
+	rawVehicles rt.VehiclesMap
+	tripUpdates rt.TripUpdatesMap
+	alerts      rt.AlertMap // nil until the alerts feed has been read
+
+	mu           sync.Mutex
+	tripDetails  map[string][]VehiclesResponse
+	trackedTrips map[string]trackedTrip // by trip id and alert languages
+}
+
+// Vehicles for a single trip, with trip details. Built once per snapshot per trip
+func (s *liveSnapshot) forTrip(tripID string, builder liveVehicleBuilder) []VehiclesResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if vehicles, found := s.tripDetails[tripID]; found {
+		return vehicles
+	}
+	vehicles := builder.build(s.rawVehicles, s.tripUpdates, liveVehicleFilters{tripID: tripID})
+	s.tripDetails[tripID] = vehicles
+	return vehicles
+}
+
+/*
+liveVehicleStream gets the realtime feeds from the providers feed monitor and, while anyone is connected to
+/realtime/live/stream or /realtime/track, builds one snapshot per feed refresh which every client then filters for itself.
+*/
+type liveVehicleStream struct {
+	builder liveVehicleBuilder
+
+	mu          sync.Mutex
+	subscribers map[chan *liveSnapshot]struct{}
+	running     bool
+	latest      *liveSnapshot
+
+	// The last feed reads from the feed monitor, refreshed is signalled whenever one comes in
+	vehicles    rt.VehiclesMap
+	tripUpdates rt.TripUpdatesMap
+	alerts      rt.AlertMap
+	refreshed   chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newLiveVehicleStream(builder liveVehicleBuilder) *liveVehicleStream {
+	return &liveVehicleStream{
+		builder:     builder,
+		subscribers: make(map[chan *liveSnapshot]struct{}),
+		refreshed:   make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+}
+
+// Disconnects every client, used on shutdown as streams never finish by themselves
+func (s *liveVehicleStream) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// Feed monitor observers
+func (s *liveVehicleStream) observeVehicles(vehicles rt.VehiclesMap) {
+	s.mu.Lock()
+	s.vehicles = vehicles
+	s.mu.Unlock()
+	s.signalRefresh()
+}
+
+func (s *liveVehicleStream) observeTripUpdates(tripUpdates rt.TripUpdatesMap) {
+	s.mu.Lock()
+	s.tripUpdates = tripUpdates
+	s.mu.Unlock()
+	s.signalRefresh()
+}
+
+func (s *liveVehicleStream) observeAlerts(alerts rt.AlertMap) {
+	s.mu.Lock()
+	s.alerts = alerts
+	s.mu.Unlock()
+	s.signalRefresh()
+}
+
+func (s *liveVehicleStream) signalRefresh() {
+	select {
+	case s.refreshed <- struct{}{}:
+	default:
+	}
+}
+
+func (s *liveVehicleStream) subscribe() (chan *liveSnapshot, *liveSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	updates := make(chan *liveSnapshot, 1)
+	s.subscribers[updates] = struct{}{}
+	if !s.running {
+		s.running = true
+		go s.watch()
+	}
+	return updates, s.latest
+}
+
+func (s *liveVehicleStream) unsubscribe(updates chan *liveSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subscribers, updates)
+}
+
+// Builds a snapshot from the feed monitors reads whenever they change, until the last client disconnects
+func (s *liveVehicleStream) watch() {
+	var version string
+	for {
+		s.mu.Lock()
+		if len(s.subscribers) == 0 {
+			s.running = false
+			s.latest = nil
+			s.mu.Unlock()
+			return
+		}
+		vehicles, tripUpdates, alerts := s.vehicles, s.tripUpdates, s.alerts
+		s.mu.Unlock()
+
+		if vehicles != nil && tripUpdates != nil {
+			if current := liveFeedVersion(vehicles, tripUpdates, alerts); current != version {
+				version = current
+				s.publish(&liveSnapshot{
+					vehicles:     s.builder.build(vehicles, tripUpdates, liveVehicleFilters{}),
+					rawVehicles:  vehicles,
+					tripUpdates:  tripUpdates,
+					alerts:       alerts,
+					tripDetails:  make(map[string][]VehiclesResponse),
+					trackedTrips: make(map[string]trackedTrip),
+				})
+			}
+		}
+
+		// The last client leaving is only noticed on the next refresh, which is at most a poll interval away
+		select {
+		case <-s.done:
+			return
+		case <-s.refreshed:
+		}
+	}
+}
+
+func (s *liveVehicleStream) publish(snapshot *liveSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latest = snapshot
+	for updates := range s.subscribers {
+		// Slow clients only ever get the newest snapshot
+		select {
+		case <-updates:
+		default:
+		}
+		updates <- snapshot
+	}
+}
+
+/*
+The feeds don't say when they were refreshed, so compare the entity timestamps instead.
+
+Alerts don't have timestamps, so their contents are hashed.
+*/
+func liveFeedVersion(vehicles rt.VehiclesMap, tripUpdates rt.TripUpdatesMap, alerts rt.AlertMap) string {
+	var newest, sum uint64
+	for _, vehicle := range vehicles {
+		timestamp := vehicle.GetTimestamp()
+		newest = max(newest, timestamp)
+		sum += timestamp
+	}
+	for _, tripUpdate := range tripUpdates {
+		timestamp := tripUpdate.GetTimestamp()
+		newest = max(newest, timestamp)
+		sum += timestamp
+	}
+
+	alertIds := make([]string, 0, len(alerts))
+	for id := range alerts {
+		alertIds = append(alertIds, id)
+	}
+	sort.Strings(alertIds)
+	alertsHash := fnv.New64a()
+	for _, id := range alertIds {
+		encoded, _ := protobuf.MarshalOptions{Deterministic: true}.Marshal(alerts[id])
+		alertsHash.Write([]byte(id))
+		alertsHash.Write(encoded)
+	}
+
+	return fmt.Sprintf("%d:%d:%d:%d:%x", len(vehicles), len(tripUpdates), newest, sum, alertsHash.Sum64())
+}
+
+type liveStreamDiff struct {
+	Updated []VehiclesResponse `json:"updated"`
+	Removed []string           `json:"removed"`
+}
+
+/*
+Serves a text/event-stream of vehicles matching filters.
+
+The first event is a "snapshot" ({"vehicles": [...]}), after that each feed refresh sends a "diff"
+({"updated": [...], "removed": [trip ids]}) if anything the client can see changed.
+*/
+func (s *liveVehicleStream) serve(c echo.Context, filters liveVehicleFilters) error {
+	updates, latest := s.subscribe()
+	defer s.unsubscribe(updates)
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, "text/event-stream")
+	response.Header().Set(echo.HeaderCacheControl, "no-cache")
+	response.Header().Set(echo.HeaderConnection, "keep-alive")
+	response.Header().Set("X-Accel-Buffering", "no")
+	response.WriteHeader(http.StatusOK)
+	response.Flush()
+
+	keepAlive := time.NewTicker(liveKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	// trip id -> last json sent for it
+	var sent map[string]string
+
+	send := func(snapshot *liveSnapshot) error {
+		var vehicles []VehiclesResponse
+		if filters.tripID != "" {
+			vehicles = snapshot.forTrip(filters.tripID, s.builder)
+		} else {
+			vehicles = snapshot.vehicles
+		}
+
+		current := make(map[string]string)
+		diff := liveStreamDiff{Updated: []VehiclesResponse{}, Removed: []string{}}
+		matched := make([]VehiclesResponse, 0)
+		for _, vehicle := range vehicles {
+			if !filters.matches(vehicle) {
+				continue
+			}
+			encoded, err := json.Marshal(vehicle)
+			if err != nil {
+				continue
+			}
+			current[vehicle.TripId] = string(encoded)
+			matched = append(matched, vehicle)
+			if sent != nil && sent[vehicle.TripId] != string(encoded) {
+				diff.Updated = append(diff.Updated, vehicle)
+			}
+		}
+
+		if sent == nil {
+			sent = current
+			return writeServerSentEvent(response, "snapshot", map[string]any{"vehicles": matched})
+		}
+
+		for tripID := range sent {
+			if _, found := current[tripID]; !found {
+				diff.Removed = append(diff.Removed, tripID)
+			}
+		}
+		sent = current
+
+		if len(diff.Updated) == 0 && len(diff.Removed) == 0 {
+			return nil
+		}
+		return writeServerSentEvent(response, "diff", diff)
+	}
+
+	if latest != nil {
+		if err := send(latest); err != nil {
+			return nil
+		}
+	}
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.done:
+			return nil
+		case snapshot := <-updates:
+			if err := send(snapshot); err != nil {
+				return nil
+			}
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(response, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			response.Flush()
+		}
+	}
+}
+
+func writeServerSentEvent(response *echo.Response, event string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(response, "event: %s\ndata: %s\n\n", event, encoded); err != nil {
+		return err
+	}
+	response.Flush()
+	return nil
+}
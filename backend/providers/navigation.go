@@ -389,6 +389,11 @@ func NewTripShapeDistance(tripId string, gtfsData gtfs.Database) (*TripShapeDist
 		return nil, fmt.Errorf("error generating GeoJSON for trip %q: %w", tripId, err)
 	}
 
+	return tripShapeFromGeoJSON(tripId, shapeGeoJSONMap)
+}
+
+// For when the trips shape GeoJSON has already been made
+func tripShapeFromGeoJSON(tripId string, shapeGeoJSONMap map[string]any) (*TripShapeDistance, error) {
 	geojsonBytes, err := json.Marshal(shapeGeoJSONMap)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal shape GeoJSON: %w", err)
@@ -437,6 +442,21 @@ func (t *TripShapeDistance) Dist(vehicleLat, vehicleLon, stopLat, stopLon float6
 	}, nil
 }
 
+// Distance in meters along the shape to the point on it closest to lat, lon
+func (t *TripShapeDistance) DistanceAlong(lat, lon float64) float64 {
+	distance, _ := computeShapeDistance(t.Line, orb.Point{lon, lat})
+	return distance
+}
+
+// The point a distance in meters along the shape, with the bearing of the shape there (0-360, clockwise from north)
+func (t *TripShapeDistance) PointAt(distance float64) (lat, lon, bearing float64) {
+	if len(t.Line) == 0 {
+		return 0, 0, 0
+	}
+	point, bearing := geo.PointAtDistanceAlongLine(t.Line, distance)
+	return point[1], point[0], math.Mod(bearing+360, 360)
+}
+
 func projectPointOntoSegment(p, a, b orb.Point) (orb.Point, float64) {
 	// Vector from a to b
 	ax, ay := a[0], a[1]
@@ -0,0 +1,398 @@
+package notifications
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/alerttext"
+	"github.com/jfmow/gtfs"
+	"github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+)
+
+// Archived alerts not seen for this long are deleted
+const alertArchiveRetention = 400 * 24 * time.Hour
+
+var ErrArchiveUnavailable = errors.New("alerts archive unavailable")
+
+// An alert as it was last seen in the realtime feed, text is the english translation
+type ArchivedAlert struct {
+	AlertId          string                `json:"alert_id"`
+	FirstSeen        int64                 `json:"first_seen"`
+	LastSeen         int64                 `json:"last_seen"`
+	Cause            string                `json:"cause"`
+	Effect           string                `json:"effect"`
+	Severity         string                `json:"severity"`
+	Title            string                `json:"title"`
+	Description      string                `json:"description"`
+	URL              string                `json:"url"`
+	ActivePeriods    []ArchivedAlertPeriod `json:"active_periods"`
+	InformedEntities []ArchivedAlertEntity `json:"informed_entities"`
+}
+
+// Unix seconds, 0 means open ended
+type ArchivedAlertPeriod struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// Names are looked up from the schedule when the alert is archived, so they stay right after the schedule changes
+type ArchivedAlertEntity struct {
+	AgencyId       string  `json:"agency_id,omitempty"`
+	RouteId        string  `json:"route_id,omitempty"`
+	RouteShortName string  `json:"route_short_name,omitempty"`
+	DirectionId    *uint32 `json:"direction_id,omitempty"`
+	TripId         string  `json:"trip_id,omitempty"`
+	StopId         string  `json:"stop_id,omitempty"`
+	StopName       string  `json:"stop_name,omitempty"`
+}
+
+/*
+Filters for searching the archive, zero values match everything.
+
+From and To are unix seconds, an alert matches if it was in the feed at any point between them.
+Query is matched against the title and description.
+*/
+type AlertHistoryQuery struct {
+	RouteId string
+	StopIds []string
+	From    int64
+	To      int64
+	Query   string
+	Page    int
+	Size    int
+}
+
+type AlertHistoryPage struct {
+	Page       int             `json:"page"`
+	PageSize   int             `json:"page_size"`
+	TotalCount int             `json:"total_count"`
+	TotalPages int             `json:"total_pages"`
+	Alerts     []ArchivedAlert `json:"alerts"`
+}
+
+func (n *Notifier) AlertHistory(query AlertHistoryQuery) (AlertHistoryPage, error) {
+	if n.db == nil || n.db.db == nil {
+		return AlertHistoryPage{}, ErrArchiveUnavailable
+	}
+	return n.db.SearchArchivedAlerts(query)
+}
+
+// The default language (or untagged) translation, falling back to the first one
+func defaultText(text *proto.TranslatedString) string {
+	translated, _ := alerttext.Translation(text, alerttext.Languages[:1])
+	return translated
+}
+
+func newArchivedAlert(alertId string, alert *proto.Alert, gtfsDB gtfs.Database, names *archiveNames) ArchivedAlert {
+	archived := ArchivedAlert{
+		AlertId:          alertId,
+		Cause:            alert.GetCause().String(),
+		Effect:           alert.GetEffect().String(),
+		Severity:         alert.GetSeverityLevel().String(),
+		Title:            defaultText(alert.GetHeaderText()),
+		Description:      defaultText(alert.GetDescriptionText()),
+		URL:              defaultText(alert.GetUrl()),
+		ActivePeriods:    []ArchivedAlertPeriod{},
+		InformedEntities: []ArchivedAlertEntity{},
+	}
+
+	for _, period := range alert.GetActivePeriod() {
+		archived.ActivePeriods = append(archived.ActivePeriods, ArchivedAlertPeriod{
+			Start: int64(period.GetStart()),
+			End:   int64(period.GetEnd()),
+		})
+	}
+
+	for _, entity := range alert.GetInformedEntity() {
+		archivedEntity := ArchivedAlertEntity{
+			AgencyId:    entity.GetAgencyId(),
+			RouteId:     entity.GetRouteId(),
+			DirectionId: entity.DirectionId,
+			TripId:      entity.GetTrip().GetTripId(),
+			StopId:      entity.GetStopId(),
+		}
+		// Trip alerts are searched by route too
+		if archivedEntity.RouteId == "" {
+			archivedEntity.RouteId = entity.GetTrip().GetRouteId()
+		}
+		if archivedEntity.RouteId == "" && archivedEntity.TripId != "" {
+			archivedEntity.RouteId = names.tripRoute(archivedEntity.TripId, gtfsDB)
+		}
+		if archivedEntity.RouteId != "" {
+			archivedEntity.RouteShortName = names.routeName(archivedEntity.RouteId, gtfsDB)
+		}
+		if archivedEntity.StopId != "" {
+			archivedEntity.StopName = names.stopName(archivedEntity.StopId, gtfsDB)
+		}
+		archived.InformedEntities = append(archived.InformedEntities, archivedEntity)
+	}
+
+	return archived
+}
+
+// Schedule lookups for one archive run, the same routes and stops come up in a lot of alerts
+type archiveNames struct {
+	routes     map[string]string
+	stops      map[string]string
+	tripRoutes map[string]string
+}
+
+func (a *archiveNames) routeName(routeId string, gtfsDB gtfs.Database) string {
+	if name, found := a.routes[routeId]; found {
+		return name
+	}
+	var name string
+	if route, err := gtfsDB.GetRouteByID(routeId); err == nil {
+		name = route.RouteShortName
+	}
+	a.routes[routeId] = name
+	return name
+}
+
+func (a *archiveNames) stopName(stopId string, gtfsDB gtfs.Database) string {
+	if name, found := a.stops[stopId]; found {
+		return name
+	}
+	var name string
+	if stop, err := gtfsDB.GetStopByStopID(stopId); err == nil {
+		name = strings.TrimSpace(stop.StopName + " " + stop.StopCode)
+	}
+	a.stops[stopId] = name
+	return name
+}
+
+func (a *archiveNames) tripRoute(tripId string, gtfsDB gtfs.Database) string {
+	if routeId, found := a.tripRoutes[tripId]; found {
+		return routeId
+	}
+	var routeId string
+	if trip, err := gtfsDB.GetTripByID(tripId); err == nil {
+		routeId = trip.RouteID
+	}
+	a.tripRoutes[tripId] = routeId
+	return routeId
+}
+
+/*
+Saves every alert in the feed, new alerts are added and ones already archived get their last seen time
+(and content, if the agency edited them) updated.
+
+Alerts that haven't been seen in alertArchiveRetention are deleted.
+*/
+func (v *Database) ArchiveAlerts(alerts realtime.AlertMap, gtfsDB gtfs.Database, now time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 4*defaultQueryTimeout)
+	defer cancel()
+
+	tx, err := v.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// alert id -> content hash of what's archived now
+	existing := make(map[string]string)
+	rows, err := tx.QueryContext(ctx, `SELECT alert_id, content_hash FROM archived_alerts WHERE provider = ?`, v.provider)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var alertId, hash string
+		if err := rows.Scan(&alertId, &hash); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[alertId] = hash
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	seenAt := now.Unix()
+	names := &archiveNames{routes: map[string]string{}, stops: map[string]string{}, tripRoutes: map[string]string{}}
+
+	for alertId, alert := range alerts {
+		archived := newArchivedAlert(alertId, alert, gtfsDB, names)
+		encodedPeriods, err := json.Marshal(archived.ActivePeriods)
+		if err != nil {
+			return err
+		}
+		encoded, err := json.Marshal(archived)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(encoded)
+		hash := hex.EncodeToString(sum[:])
+
+		if existingHash, found := existing[alertId]; found && existingHash == hash {
+			if _, err := tx.ExecContext(ctx, `UPDATE archived_alerts SET last_seen = ? WHERE provider = ? AND alert_id = ?`, seenAt, v.provider, alertId); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var id int64
+		if err := tx.QueryRowContext(ctx, `INSERT INTO archived_alerts
+            (provider, alert_id, first_seen, last_seen, cause, effect, severity, title, description, url, active_periods, content_hash)
+            VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+            ON CONFLICT(provider, alert_id) DO UPDATE SET
+                last_seen = excluded.last_seen,
+                cause = excluded.cause,
+                effect = excluded.effect,
+                severity = excluded.severity,
+                title = excluded.title,
+                description = excluded.description,
+                url = excluded.url,
+                active_periods = excluded.active_periods,
+                content_hash = excluded.content_hash
+            RETURNING id`,
+			v.provider, alertId, seenAt, seenAt,
+			archived.Cause, archived.Effect, archived.Severity,
+			archived.Title, archived.Description, archived.URL,
+			string(encodedPeriods), hash,
+		).Scan(&id); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, `DELETE FROM archived_alert_entities WHERE alert = ?`, id); err != nil {
+			return err
+		}
+		for _, entity := range archived.InformedEntities {
+			var directionId sql.NullInt64
+			if entity.DirectionId != nil {
+				directionId = sql.NullInt64{Int64: int64(*entity.DirectionId), Valid: true}
+			}
+			if _, err := tx.ExecContext(ctx, `INSERT INTO archived_alert_entities
+                (alert, agency_id, route_id, route_short_name, direction_id, trip_id, stop_id, stop_name)
+                VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+				id, entity.AgencyId, entity.RouteId, entity.RouteShortName, directionId, entity.TripId, entity.StopId, entity.StopName,
+			); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM archived_alerts WHERE provider = ? AND last_seen < ?`, v.provider, now.Add(-alertArchiveRetention).Unix()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Most recently seen first
+func (v *Database) SearchArchivedAlerts(query AlertHistoryQuery) (AlertHistoryPage, error) {
+	page := AlertHistoryPage{Page: max(query.Page, 1), PageSize: min(max(query.Size, 1), 100), Alerts: []ArchivedAlert{}}
+
+	where := []string{"a.provider = ?"}
+	args := []any{v.provider}
+	if query.RouteId != "" {
+		where = append(where, "EXISTS (SELECT 1 FROM archived_alert_entities e WHERE e.alert = a.id AND e.route_id = ?)")
+		args = append(args, query.RouteId)
+	}
+	if len(query.StopIds) > 0 {
+		placeholders := strings.TrimSuffix(strings.Repeat("?,", len(query.StopIds)), ",")
+		where = append(where, "EXISTS (SELECT 1 FROM archived_alert_entities e WHERE e.alert = a.id AND e.stop_id IN ("+placeholders+"))")
+		for _, stopId := range query.StopIds {
+			args = append(args, stopId)
+		}
+	}
+	if query.From > 0 {
+		where = append(where, "a.last_seen >= ?")
+		args = append(args, query.From)
+	}
+	if query.To > 0 {
+		where = append(where, "a.first_seen <= ?")
+		args = append(args, query.To)
+	}
+	if query.Query != "" {
+		escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(query.Query)
+		where = append(where, `(a.title LIKE ? ESCAPE '\' OR a.description LIKE ? ESCAPE '\')`)
+		args = append(args, "%"+escaped+"%", "%"+escaped+"%")
+	}
+	whereClause := strings.Join(where, " AND ")
+
+	row, cancel := v.queryRowContext(`SELECT COUNT(*) FROM archived_alerts a WHERE `+whereClause, args...)
+	err := row.Scan(&page.TotalCount)
+	cancel()
+	if err != nil {
+		return page, fmt.Errorf("count archived alerts: %w", err)
+	}
+	page.TotalPages = (page.TotalCount + page.PageSize - 1) / page.PageSize
+	if page.TotalCount == 0 {
+		return page, nil
+	}
+
+	rows, cancel, err := v.queryContext(`SELECT a.id, a.alert_id, a.first_seen, a.last_seen, a.cause, a.effect, a.severity, a.title, a.description, a.url, a.active_periods
+        FROM archived_alerts a WHERE `+whereClause+`
+        ORDER BY a.last_seen DESC, a.id DESC LIMIT ? OFFSET ?`,
+		append(args, page.PageSize, (page.Page-1)*page.PageSize)...)
+	if err != nil {
+		return page, fmt.Errorf("search archived alerts: %w", err)
+	}
+
+	var ids []any
+	byId := make(map[int64]int)
+	for rows.Next() {
+		var (
+			id            int64
+			alert         ArchivedAlert
+			activePeriods string
+		)
+		if err := rows.Scan(&id, &alert.AlertId, &alert.FirstSeen, &alert.LastSeen, &alert.Cause, &alert.Effect, &alert.Severity, &alert.Title, &alert.Description, &alert.URL, &activePeriods); err != nil {
+			rows.Close()
+			cancel()
+			return page, err
+		}
+		if err := json.Unmarshal([]byte(activePeriods), &alert.ActivePeriods); err != nil || alert.ActivePeriods == nil {
+			alert.ActivePeriods = []ArchivedAlertPeriod{}
+		}
+		alert.InformedEntities = []ArchivedAlertEntity{}
+		byId[id] = len(page.Alerts)
+		ids = append(ids, id)
+		page.Alerts = append(page.Alerts, alert)
+	}
+	rows.Close()
+	cancel()
+	if err := rows.Err(); err != nil {
+		return page, err
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+	rows, cancel, err = v.queryContext(`SELECT alert, agency_id, route_id, route_short_name, direction_id, trip_id, stop_id, stop_name
+        FROM archived_alert_entities WHERE alert IN (`+placeholders+`) ORDER BY id`, ids...)
+	if err != nil {
+		return page, fmt.Errorf("get archived alert entities: %w", err)
+	}
+	defer cancel()
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			alertRow    int64
+			entity      ArchivedAlertEntity
+			directionId sql.NullInt64
+		)
+		if err := rows.Scan(&alertRow, &entity.AgencyId, &entity.RouteId, &entity.RouteShortName, &directionId, &entity.TripId, &entity.StopId, &entity.StopName); err != nil {
+			return page, err
+		}
+		if directionId.Valid {
+			direction := uint32(directionId.Int64)
+			entity.DirectionId = &direction
+		}
+		index := byId[alertRow]
+		page.Alerts[index].InformedEntities = append(page.Alerts[index].InformedEntities, entity)
+	}
+
+	return page, rows.Err()
+}
@@ -0,0 +1,257 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var ErrClientNotFound = errors.New("notification client not found")
+
+const (
+	defaultDBFileName   = "notifications.db"
+	defaultQueryTimeout = 5 * time.Second
+)
+
+type Database struct {
+	db          *sql.DB
+	provider    string // Archived alerts are kept per provider
+	timeZone    *time.Location
+	mailToEmail string
+	mailToName  string
+}
+
+func newDatabase(provider string, timeZone *time.Location, mailToEmail, mailToName string) (*Database, error) {
+	if timeZone == nil {
+		return nil, errors.New("time zone is required")
+	}
+
+	dbPath := path.Join(getWorkDir(), "notifications", defaultDBFileName)
+
+	if !filepath.IsAbs(dbPath) {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("get cwd: %w", err)
+		}
+		dbPath = filepath.Join(cwd, dbPath)
+	}
+
+	sqlDB, err := sql.Open("sqlite3", fmt.Sprintf("%s?_foreign_keys=on", dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("open notifications database: %w", err)
+	}
+
+	if err := sqlDB.Ping(); err != nil {
+		sqlDB.Close()
+		return nil, fmt.Errorf("ping notifications database: %w", err)
+	}
+
+	database := &Database{
+		db:          sqlDB,
+		provider:    provider,
+		timeZone:    timeZone,
+		mailToEmail: mailToEmail,
+		mailToName:  mailToName,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+
+	if err := database.ensureSchema(ctx); err != nil {
+		sqlDB.Close()
+		return nil, err
+	}
+
+	return database, nil
+}
+
+func (d *Database) Close() error {
+	if d == nil || d.db == nil {
+		return nil
+	}
+	return d.db.Close()
+}
+
+func (d *Database) ensureSchema(ctx context.Context) error {
+	stmts := []string{
+		`CREATE TABLE IF NOT EXISTS notifications (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            endpoint TEXT NOT NULL,
+            p256dh TEXT NOT NULL,
+            auth TEXT NOT NULL,
+            recent_notifications TEXT NOT NULL DEFAULT '[]',
+            created INTEGER NOT NULL,
+            expiry_warning_sent INTEGER NOT NULL DEFAULT 0,
+            UNIQUE(endpoint, p256dh, auth)
+        );`,
+		`CREATE TABLE IF NOT EXISTS stops (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            clientId INTEGER NOT NULL,
+            parent_stop TEXT NOT NULL,
+            routes TEXT,
+            UNIQUE(clientId, parent_stop),
+            FOREIGN KEY(clientId) REFERENCES notifications(id) ON DELETE CASCADE
+        );`,
+		`CREATE TABLE IF NOT EXISTS reminders (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            clientId INTEGER NOT NULL,
+            trip_id TEXT NOT NULL,
+            stop_sequence INTEGER NOT NULL,
+            type TEXT NOT NULL,
+            created INTEGER NOT NULL,
+            UNIQUE(clientId, type),
+            FOREIGN KEY(clientId) REFERENCES notifications(id) ON DELETE CASCADE
+        );`,
+		`CREATE TABLE IF NOT EXISTS archived_alerts (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            provider TEXT NOT NULL,
+            alert_id TEXT NOT NULL,
+            first_seen INTEGER NOT NULL,
+            last_seen INTEGER NOT NULL,
+            cause TEXT NOT NULL,
+            effect TEXT NOT NULL,
+            severity TEXT NOT NULL,
+            title TEXT NOT NULL,
+            description TEXT NOT NULL,
+            url TEXT NOT NULL,
+            active_periods TEXT NOT NULL DEFAULT '[]',
+            content_hash TEXT NOT NULL,
+            UNIQUE(provider, alert_id)
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_archived_alerts_seen ON archived_alerts(provider, last_seen);`,
+		`CREATE TABLE IF NOT EXISTS archived_alert_entities (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            alert INTEGER NOT NULL,
+            agency_id TEXT NOT NULL DEFAULT '',
+            route_id TEXT NOT NULL DEFAULT '',
+            route_short_name TEXT NOT NULL DEFAULT '',
+            direction_id INTEGER,
+            trip_id TEXT NOT NULL DEFAULT '',
+            stop_id TEXT NOT NULL DEFAULT '',
+            stop_name TEXT NOT NULL DEFAULT '',
+            FOREIGN KEY(alert) REFERENCES archived_alerts(id) ON DELETE CASCADE
+        );`,
+		`CREATE INDEX IF NOT EXISTS idx_archived_alert_entities_alert ON archived_alert_entities(alert);`,
+		`CREATE INDEX IF NOT EXISTS idx_archived_alert_entities_route ON archived_alert_entities(route_id);`,
+		`CREATE INDEX IF NOT EXISTS idx_archived_alert_entities_stop ON archived_alert_entities(stop_id);`,
+	}
+
+	for _, stmt := range stmts {
+		if _, err := d.db.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("ensure schema: %w", err)
+		}
+	}
+
+	return nil
+}
+
+type Notification struct {
+	Id                  int
+	Endpoint            string
+	P256dh              string
+	Auth                string
+	RecentNotifications []RecentNotificationEntry
+	Created             int
+	ExpiryWarningSent   int
+}
+
+type Reminder struct {
+	Id           int
+	ClientId     int
+	TripId       string
+	StopSequence int
+	Type         string
+	Created      time.Time
+}
+
+type RecentNotificationEntry struct {
+	ID     string `json:"id"`
+	SeenAt int64  `json:"seen_at,omitempty"`
+}
+
+func decodeRecentNotifications(raw sql.NullString) ([]RecentNotificationEntry, error) {
+	if !raw.Valid || raw.String == "" || raw.String == "[]" {
+		return nil, nil
+	}
+
+	var entries []RecentNotificationEntry
+	if err := json.Unmarshal([]byte(raw.String), &entries); err == nil {
+		var cleaned []RecentNotificationEntry
+		for _, entry := range entries {
+			if entry.ID == "" {
+				continue
+			}
+			cleaned = append(cleaned, entry)
+		}
+		return cleaned, nil
+	}
+
+	var legacy []string
+	if err := json.Unmarshal([]byte(raw.String), &legacy); err != nil {
+		return nil, err
+	}
+
+	entries = make([]RecentNotificationEntry, 0, len(legacy))
+	for _, id := range legacy {
+		if id == "" {
+			continue
+		}
+		entries = append(entries, RecentNotificationEntry{ID: id})
+	}
+
+	return entries, nil
+}
+
+func encodeRecentNotifications(entries []RecentNotificationEntry) ([]byte, error) {
+	if len(entries) == 0 {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(entries)
+}
+
+func encodeRoutes(routes []string) ([]byte, error) {
+	if len(routes) == 0 {
+		return nil, nil
+	}
+	return json.Marshal(routes)
+}
+
+func decodeRoutes(raw sql.NullString) ([]string, error) {
+	if !raw.Valid || raw.String == "" || raw.String == "[]" {
+		return nil, nil
+	}
+	var routes []string
+	if err := json.Unmarshal([]byte(raw.String), &routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+func (d *Database) queryContext(query string, args ...any) (*sql.Rows, context.CancelFunc, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	rows, err := d.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		cancel()
+		return nil, nil, err
+	}
+	return rows, cancel, nil
+}
+
+func (d *Database) queryRowContext(query string, args ...any) (*sql.Row, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	return d.db.QueryRowContext(ctx, query, args...), cancel
+}
+
+func (d *Database) execContext(query string, args ...any) (sql.Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultQueryTimeout)
+	defer cancel()
+	return d.db.ExecContext(ctx, query, args...)
+}
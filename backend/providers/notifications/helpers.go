@@ -0,0 +1,39 @@
+package notifications
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var base64UrlRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+={0,2}$`)
+
+func getWorkDir() string {
+	ex, err := os.Executable()
+	if err != nil {
+		panic(err)
+	}
+
+	dir := filepath.Dir(ex)
+
+	if strings.Contains(dir, "go-build") {
+		return "."
+	}
+	return filepath.Dir(ex)
+}
+
+// Push endpoints are always absolute https urls
+func isValidURL(raw string) bool {
+	parsed, err := url.ParseRequestURI(raw)
+	if err != nil {
+		return false
+	}
+	return parsed.Scheme == "https" && parsed.Host != ""
+}
+
+// p256dh and auth keys are url safe base64 (padding optional)
+func isBase64Url(raw string) bool {
+	return base64UrlRegex.MatchString(raw)
+}
@@ -1,16 +1,20 @@
 package providers
 
 import (
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"net/url"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/delays"
+	"github.com/jfmow/at-trains-api/providers/notifications"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
 	"github.com/jfmow/gtfs"
 	rt "github.com/jfmow/gtfs/realtime"
 	"github.com/jfmow/gtfs/realtime/proto"
@@ -22,65 +26,42 @@ type LatLng struct {
 	Lng float64
 }
 
-func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, localTimeZone *time.Location, getStopsForTripCache caches.StopsForTripCache, getRouteCache caches.RouteCache, getParentStopByChildCache caches.ParentStopsByChildCache) {
+func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, realtimeAvailable bool, localTimeZone *time.Location, positions *vehiclePositions, detours *detourDetector, sightings *realtimeSightings, blocks *vehicleBlocks, feeds *FeedMonitor, getStopsForTripCache caches.StopsForTripCache, getRouteCache caches.RouteCache, getParentStopByChildCache caches.ParentStopsByChildCache, getAllStopsCache caches.AllStopsCache, notifier *notifications.Notifier) *liveVehicleStream {
 	realtimeRoute := primaryRoute.Group("/realtime")
 
-	//Returns all the locations of vehicles from the AT api
-	realtimeRoute.GET("/live", func(c echo.Context) error {
-		// ==================================================================
-		// Read and decode query parameters
-		// ==================================================================
-		// All params are URL-escaped by default, so unescape first.
-		tripID, err := url.PathUnescape(c.QueryParam("tripId"))
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip id", nil,
-				ResponseDetails("tripId", c.QueryParam("tripId"), "error", err.Error()))
-		}
+	//Degraded providers have no realtime client, so every realtime route is unavailable
+	if !realtimeAvailable {
+		realtimeRoute.Use(realtimeUnavailableMiddleware())
+	}
 
-		vehicleTypeFilter, err := url.PathUnescape(c.QueryParam("type"))
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid vehicle type", nil,
-				ResponseDetails("vehicle_type", c.QueryParam("type"), "error", err.Error()))
-		}
+	liveVehicles := liveVehicleBuilder{
+		gtfsData:                  gtfsData,
+		localTimeZone:             localTimeZone,
+		getRouteCache:             getRouteCache,
+		getStopsForTripCache:      getStopsForTripCache,
+		getParentStopByChildCache: getParentStopByChildCache,
+		blocks:                    blocks,
+	}
+	liveStream := newLiveVehicleStream(liveVehicles)
 
-		boundsStr, err := url.PathUnescape(c.QueryParam("bounds"))
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid bounds", nil,
-				ResponseDetails("bounds", c.QueryParam("bounds"), "error", err.Error()))
+	//Returns all the locations of vehicles from the AT api
+	realtimeRoute.GET("/live", func(c echo.Context) error {
+		filters, errorResponse := parseLiveVehicleFilters(c)
+		if errorResponse != nil {
+			return errorResponse()
 		}
 
-		// ==================================================================
-		// Parse bounds (optional)
-		// ==================================================================
-		// Bounds restrict vehicles to a visible map area.
-		// If omitted, all vehicles are returned.
-		hasBounds := boundsStr != ""
-		rawBounds := [][]float64{{0, 0}, {0, 0}}
-
-		if hasBounds {
-			// Expect [[lat1,lng1],[lat2,lng2]]
-			if err := json.Unmarshal([]byte(boundsStr), &rawBounds); err != nil ||
-				len(rawBounds) != 2 || len(rawBounds[0]) != 2 || len(rawBounds[1]) != 2 {
-
-				return JsonApiResponse(
-					c,
-					http.StatusBadRequest,
-					"invalid bounds format",
-					nil,
-					ResponseDetails(
-						"bounds",
-						boundsStr,
-						"details",
-						"Expected [[lat1,lng1],[lat2,lng2]]",
-					),
-				)
+		// interpolated=true adds an estimate of where each vehicle is at (unix ms, default now) to the response
+		interpolated := c.QueryParam("interpolated") == "true"
+		interpolateAt := time.Now()
+		if atStr := c.QueryParam("at"); atStr != "" {
+			atMillis, err := strconv.ParseInt(atStr, 10, 64)
+			if err != nil {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid at", nil, ResponseDetails("at", atStr, "details", "Expected a unix timestamp in milliseconds", "error", err.Error()))
 			}
+			interpolateAt = time.UnixMilli(atMillis)
 		}
 
-		// Normalize bounds into LatLng structs for easy reuse
-		boundA := LatLng{Lat: rawBounds[0][0], Lng: rawBounds[0][1]}
-		boundB := LatLng{Lat: rawBounds[1][0], Lng: rawBounds[1][1]}
-
 		// ==================================================================
 		// Load realtime GTFS feeds
 		// ==================================================================
@@ -98,145 +79,199 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 				ResponseDetails("error", "No trip updates found", "details", err.Error()))
 		}
 
-		// ==================================================================
-		// Preload caches to avoid repeated DB / file access
-		// ==================================================================
-		routeCache := getRouteCache()
-		stopsForTripCache := getStopsForTripCache()
+		response := liveVehicles.build(vehicles, tripUpdates, filters)
 
-		response := make([]VehiclesResponse, 0)
+		if interpolated {
+			for i := range response {
+				tripUpdate, _ := tripUpdates.ByTripID(response[i].TripId)
+				vehicle, _ := vehicles.ByTripID(response[i].TripId)
+				if estimate, ok := positions.interpolate(response[i].TripId, tripUpdate, vehicle.GetPosition().GetSpeed(), interpolateAt); ok {
+					response[i].Interpolated = estimate
+				}
+			}
+		}
 
 		// ==================================================================
-		// Main vehicle processing loop
+		// Final response
 		// ==================================================================
-		for _, vehicle := range vehicles {
-			pos := vehicle.GetPosition()
-			lat, lng := float64(pos.GetLatitude()), float64(pos.GetLongitude())
+		if len(response) == 0 {
+			return JsonApiResponse(c, http.StatusNotFound, "no vehicles found", nil,
+				ResponseDetails("error", "No vehicles found matching the given criteria"))
+		}
 
-			// Skip vehicles outside the requested map bounds
-			if hasBounds && !pointInBounds(lat, lng, boundA, boundB) {
-				continue
-			}
+		return JsonApiResponse(c, http.StatusOK, "", response)
+	})
 
-			trip := vehicle.GetTrip()
-			tripIDCur := trip.GetTripId()
-			routeID := trip.GetRouteId()
+	//Streams vehicle locations to the client as the realtime feed refreshes
+	realtimeRoute.GET("/live/stream", func(c echo.Context) error {
+		filters, errorResponse := parseLiveVehicleFilters(c)
+		if errorResponse != nil {
+			return errorResponse()
+		}
+		return liveStream.serve(c, filters)
+	})
 
-			// Skip vehicles without valid trip or route data
-			if tripIDCur == "" || routeID == "" {
-				continue
-			}
+	//Vehicles that are currently away from their trip shape, and routes where that keeps happening
+	realtimeRoute.GET("/detours", func(c echo.Context) error {
+		return JsonApiResponse(c, http.StatusOK, "", detours.Detours())
+	})
 
-			// If a specific trip is requested, only include that trip
-			if tripID != "" && tripIDCur != tripID {
-				continue
-			}
+	/*
+		The trips a vehicle runs after its current one, from its block in the static feed, with the lateness it's
+		predicted to finish its current trip with carried over. limit defaults to 5
+	*/
+	realtimeRoute.GET("/vehicle/:vehicleId/next-trips", func(c echo.Context) error {
+		vehicleIdEncoded := c.PathParam("vehicleId")
+		vehicleId, err := url.PathUnescape(vehicleIdEncoded)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid vehicle id", nil, ResponseDetails("vehicleId", vehicleIdEncoded, "details", "Invalid vehicle ID format", "error", err.Error()))
+		}
 
-			// ------------------------------------------------------------------
-			// Trip update validation
-			// ------------------------------------------------------------------
-			// Ensure the trip has started and is currently in service
-			tripUpdate, err := tripUpdates.ByTripID(tripIDCur)
-			if err != nil || !checkIfTripStarted(
-				tripUpdate.GetTrip().GetStartTime(),
-				tripUpdate.GetTrip().GetStartDate(),
-				localTimeZone,
-			) {
-				continue
+		limit := 5
+		if limitStr := c.QueryParam("limit"); limitStr != "" {
+			limit, err = strconv.Atoi(limitStr)
+			if err != nil || limit < 1 {
+				return JsonApiResponse(c, http.StatusBadRequest, "invalid limit", nil, ResponseDetails("limit", limitStr, "details", "Expected a positive number"))
 			}
+		}
 
-			// ------------------------------------------------------------------
-			// Route lookup + vehicle type filtering
-			// ------------------------------------------------------------------
-			routeData, err := getVehicleRouteData(routeID, routeCache)
-			if err != nil {
-				continue
-			}
+		if !blocks.loaded() {
+			return JsonApiResponse(c, http.StatusServiceUnavailable, "block data isn't loaded yet", nil, ResponseDetails("vehicleId", vehicleId, "details", "The static feed hasn't been read yet"))
+		}
 
-			// Allow filtering by vehicle type (bus, rail, etc.)
-			if vehicleTypeFilter != "" &&
-				vehicleTypeFilter != "all" &&
-				!strings.EqualFold(routeData.VehicleType, vehicleTypeFilter) {
-				continue
-			}
+		vehicles, err := realtime.GetVehicles()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No vehicles found", "details", err.Error()))
+		}
+		tripUpdates, err := realtime.GetTripUpdates()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No trip updates found", "details", err.Error()))
+		}
 
-			// ------------------------------------------------------------------
-			// Base response payload
-			// ------------------------------------------------------------------
-			resp := VehiclesResponse{
-				TripId:       tripIDCur,
-				Route:        *routeData,
-				VehicleType:  strings.ToLower(routeData.VehicleType),
-				Position:     VehiclesPosition{Lat: pos.GetLatitude(), Lon: pos.GetLongitude()},
-				Occupancy:    int8(vehicle.GetOccupancyStatus()),
-				LicensePlate: vehicle.GetVehicle().GetLicensePlate(),
+		var foundVehicle *proto.VehiclePosition
+		for _, vehicle := range vehicles {
+			if vehicle.GetVehicle().GetId() == vehicleId && vehicle.GetTrip().GetTripId() != "" {
+				foundVehicle = vehicle
+				break
 			}
+		}
+		if foundVehicle == nil {
+			return JsonApiResponse(c, http.StatusNotFound, "vehicle not found", nil, ResponseDetails("vehicleId", vehicleId, "details", "No vehicle with that id is running a trip"))
+		}
 
-			// ------------------------------------------------------------------
-			// Detailed trip information (only when a single trip is requested)
-			// ------------------------------------------------------------------
-			// This is intentionally skipped for list views for performance.
-			if tripID != "" {
-				currentTrip, err := gtfsData.GetTripByID(tripIDCur)
-				if err != nil {
-					continue
-				}
+		tripId := foundVehicle.GetTrip().GetTripId()
+		tripUpdate, err := tripUpdates.ByTripID(tripId)
+		if err != nil {
+			tripUpdate = nil
+		}
+		serviceDay, endDelay, nextTrips := blocks.forVehicle(tripId, tripUpdate, foundVehicle, newTripStopTimesCache(gtfsData), limit, time.Now())
 
-				stopsData, ok := stopsForTripCache[tripIDCur]
-				if !ok || len(stopsData.Stops) == 0 || stopsData.LowestSequence == -1 {
-					continue
-				}
+		response := VehicleNextTripsResponse{
+			VehicleId: vehicleId,
+			TripId:    tripId,
+			Delay:     int(endDelay.Seconds()),
+			NextTrips: nextTrips,
+		}
+		if !serviceDay.IsZero() {
+			response.ServiceDate = servicetime.Date(serviceDay)
+		}
+		if response.NextTrips == nil {
+			response.NextTrips = []NextTrip{}
+		}
+		return JsonApiResponse(c, http.StatusOK, "", response)
+	})
 
-				// Ensure stops are ordered by sequence
-				sort.Slice(stopsData.Stops, func(i, j int) bool {
-					return stopsData.Stops[i].Sequence < stopsData.Stops[j].Sequence
-				})
-
-				// Determine next stop and trip state (in-transit, stopped, etc.)
-				nextSeq, _, state := getNextStopSequence(
-					tripUpdate.GetStopTimeUpdate(),
-					stopsData.LowestSequence,
-					localTimeZone,
-				)
-
-				resp.State = state
-				resp.Trip = &VehiclesTrip{
-					Headsign:    currentTrip.TripHeadsign,
-					FirstStop:   getStopBySequenceNumber(stopsData.Stops, 0, getParentStopByChildCache),
-					CurrentStop: getStopBySequenceNumber(stopsData.Stops, min(nextSeq-1, len(stopsData.Stops)-1), getParentStopByChildCache),
-					NextStop:    getStopBySequenceNumber(stopsData.Stops, min(nextSeq, len(stopsData.Stops)-1), getParentStopByChildCache),
-					FinalStop:   getStopBySequenceNumber(stopsData.Stops, len(stopsData.Stops)-1, getParentStopByChildCache),
-				}
+	coverage := &coverageReport{
+		gtfsData:             gtfsData,
+		realtime:             realtime,
+		localTimeZone:        localTimeZone,
+		sightings:            sightings,
+		getAllStopsCache:     getAllStopsCache,
+		getStopsForTripCache: getStopsForTripCache,
+		getRouteCache:        getRouteCache,
+	}
 
-				// Detect vehicles that have deviated significantly from the route shape
-				if line, err := NewTripShapeDistance(tripIDCur, gtfsData); err == nil {
-					if dist, err := line.DistanceFromLine(lat, lng); err == nil && dist > 500 {
-						resp.OffCourse = true
-					}
-				}
-			}
+	//Trips the timetable says are running compared against the realtime feeds, per route tracking and the trips with no (or no more) realtime
+	realtimeRoute.GET("/coverage", func(c echo.Context) error {
+		return JsonApiResponse(c, http.StatusOK, "", coverage.build(time.Now()))
+	})
 
-			response = append(response, resp)
+	//Re-serves the realtime feeds as standard gtfs-realtime protobuf, optionally filtered by tripId, routeId and bounds
+	realtimeRoute.GET("/feed/vehicle-positions.pb", func(c echo.Context) error {
+		filters, errorResponse := parseFeedFilters(c)
+		if errorResponse != nil {
+			return errorResponse()
 		}
+		vehicles, err := realtime.GetVehicles()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No vehicles found", "details", err.Error()))
+		}
+		if filters.routeID != "" {
+			// Vehicles usually name their route, the trip updates fill in for the ones that don't
+			tripUpdates, _ := realtime.GetTripUpdates()
+			filters.loadTripRoutes(vehicles, tripUpdates)
+		}
+		return writeFeedMessage(c, vehiclePositionsFeed(vehicles, gtfsData, filters), newestVehicleTimestamp(vehicles))
+	})
 
-		// ==================================================================
-		// Final response
-		// ==================================================================
-		if len(response) == 0 {
-			return JsonApiResponse(c, http.StatusNotFound, "no vehicles found", nil,
-				ResponseDetails("error", "No vehicles found matching the given criteria"))
+	realtimeRoute.GET("/feed/trip-updates.pb", func(c echo.Context) error {
+		filters, errorResponse := parseFeedFilters(c)
+		if errorResponse != nil {
+			return errorResponse()
+		}
+		tripUpdates, err := realtime.GetTripUpdates()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No trip updates found", "details", err.Error()))
 		}
+		var vehicles rt.VehiclesMap
+		if filters.hasBounds {
+			vehicles, err = realtime.GetVehicles()
+			if err != nil {
+				return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No vehicles found", "details", err.Error()))
+			}
+		}
+		if filters.routeID != "" {
+			// Trip updates often leave the route out, the vehicles running them usually have it
+			if vehicles == nil {
+				vehicles, _ = realtime.GetVehicles()
+			}
+			filters.loadTripRoutes(vehicles, tripUpdates)
+		}
+		return writeFeedMessage(c, tripUpdatesFeed(tripUpdates, vehicles, gtfsData, filters), newestTripUpdateTimestamp(tripUpdates))
+	})
 
-		return JsonApiResponse(c, http.StatusOK, "", response)
+	realtimeRoute.GET("/feed/alerts.pb", func(c echo.Context) error {
+		filters, errorResponse := parseFeedFilters(c)
+		if errorResponse != nil {
+			return errorResponse()
+		}
+		alerts, err := realtime.GetAlerts()
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", "No alerts found", "details", err.Error()))
+		}
+		// Alerts don't have timestamps, the header is when the alerts feed was last read
+		var readAt time.Time
+		if feeds != nil {
+			readAt = feeds.Feed(FeedAlerts).LastSuccess
+		}
+		return writeFeedMessage(c, alertsFeed(alerts, gtfsData, filters), readAt)
+	})
+
+	//Websocket that pushes vehicle, stop time and alert changes for the trips a client is tracking
+	realtimeRoute.GET("/track", func(c echo.Context) error {
+		return liveStream.serveTracking(c)
 	})
 
-	//Returns alerts from AT for a stop
+	setupAlertsRoutes(realtimeRoute, gtfsData, realtime, notifier, getRouteCache)
+
+	//Returns alerts from AT for a stop. With a .ics suffix the alerts are an icalendar feed
 	realtimeRoute.GET("/alerts/:stopName", func(c echo.Context) error {
 		stopNameEncoded := c.PathParam("stopName")
 		stopName, err := url.PathUnescape(stopNameEncoded)
 		if err != nil {
 			return JsonApiResponse(c, http.StatusBadRequest, "invalid stop name", nil, ResponseDetails("stopName", stopNameEncoded, "details", "Invalid stop name format", "error", err.Error()))
 		}
+		stopName, calendar := strings.CutSuffix(stopName, ".ics")
 
 		var filterByToday = false
 		if today := c.QueryParam("today"); today == "true" {
@@ -254,6 +289,8 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			return JsonApiResponse(c, http.StatusBadRequest, "", nil, ResponseDetails("stopName", stopName, "details", "No child stops found for the given stop", "error", err.Error()))
 		}
 
+		languages := acceptedAlertLanguages(c)
+
 		alerts, err := realtime.GetAlerts()
 		if err != nil {
 			return JsonApiResponse(c, http.StatusNotFound, "", nil, ResponseDetails("stopName", stopName, "details", "No alerts found for the given stop", "error", err.Error()))
@@ -282,6 +319,25 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("details", "no routes found for stop: "+stopName))
 		}
 
+		if calendar {
+			stopIds := map[string]struct{}{stop.StopId: {}}
+			for _, child := range childStops {
+				stopIds[child.StopId] = struct{}{}
+			}
+			routeOf := newEntityRouteResolver(gtfsData)
+			builder := newAlertDetailsBuilder(gtfsData, getRouteCache, languages)
+			stopAlerts := builder.matching(alerts, func(entity *proto.EntitySelector) bool {
+				// Route alerts limited to a stop are only for that stop
+				if stopID := entity.GetStopId(); stopID != "" {
+					_, found := stopIds[stopID]
+					return found
+				}
+				_, found := foundRoutes[routeOf(entity)]
+				return found
+			})
+			return writeAlertsCalendar(c, "Alerts for "+stop.StopName, stop.StopName, stopAlerts)
+		}
+
 		// Make sure this is initialised somewhere before the loop
 		foundAlerts := make(map[string][]AlertResponseData)
 
@@ -308,34 +364,12 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 					}
 				}
 
-				activePeriods := alert.GetActivePeriod()
-				if len(activePeriods) == 0 {
+				parsedAlert, ok := newAlertResponseData(alert, languages)
+				if !ok {
 					// no start or end
 					continue
 				}
 
-				smallestStart := activePeriods[0].GetStart()
-				biggestEnd := activePeriods[0].GetEnd()
-
-				for _, period := range activePeriods {
-					if period.GetStart() < smallestStart {
-						smallestStart = period.GetStart()
-					}
-					if period.GetEnd() > biggestEnd {
-						biggestEnd = period.GetEnd()
-					}
-				}
-
-				parsedAlert := AlertResponseData{
-					StartDate:   int(smallestStart),
-					EndDate:     int(biggestEnd),
-					Cause:       alert.GetCause().String(),
-					Effect:      alert.GetEffect().String(),
-					Title:       alert.GetHeaderText().GetTranslation()[0].GetText(),
-					Description: alert.GetDescriptionText().GetTranslation()[0].GetText(),
-					Severity:    alert.GetSeverityLevel().String(),
-				}
-
 				// 🔑 append to the slice for this route
 				foundAlerts[route.RouteId] = append(foundAlerts[route.RouteId], parsedAlert)
 			}
@@ -359,156 +393,34 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 		return JsonApiResponse(c, http.StatusOK, "", response)
 	})
 
+	//Stop times for a trip, date (YYYYMMDD) is the service date to use when the trip has no realtime data
 	realtimeRoute.GET("/stop-times", func(c echo.Context) error {
 		filterTripId := c.QueryParam("tripId")
 		if filterTripId == "" {
 			return JsonApiResponse(c, http.StatusBadRequest, "Missing trip id", ResponseDetails("details", "no trip id provided"))
 		}
-
-		stopsForTrip, err := gtfsData.GetStopTimesForTripID(filterTripId)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusInternalServerError, "", ResponseDetails(
-				"details", "no stops found for trip",
-				"error", err.Error(),
-			))
-		}
-
-		_, lowestSequence, err := gtfsData.GetStopsForTripID(filterTripId)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", err.Error()))
-		}
-
-		line, err := NewTripShapeDistance(filterTripId, gtfsData)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", err.Error()))
-		}
-
-		type StopTimes struct {
-			ParentStopId  string  `json:"parent_stop_id"`
-			ChildStopId   string  `json:"child_stop_id"`
-			ArrivalTime   int64   `json:"arrival_time"`
-			DepartureTime int64   `json:"departure_time"`
-			ScheduledTime int64   `json:"scheduled_time"`
-			Skipped       bool    `json:"skipped"`
-			Passed        bool    `json:"passed"`
-			DistanceAway  float64 `json:"dist"`
-		}
-
-		var result []StopTimes
-		now := time.Now().In(localTimeZone)
-
-		// Realtime trip updates are optional.
-		stopTimesForStops := getPredictedStopArrivalTimesForTrip(nil, localTimeZone)
-		nextStopSequenceNumber := 0
-		var tripDelay int32 = 0
-		hasTripUpdate := false
-
-		if tripUpdates, err := realtime.GetTripUpdates(); err == nil {
-			if updatesForTrip, err := tripUpdates.ByTripID(filterTripId); err == nil && updatesForTrip != nil {
-				hasTripUpdate = true
-				stopTimesForStops = getPredictedStopArrivalTimesForTrip(
-					updatesForTrip.GetStopTimeUpdate(),
-					localTimeZone,
-				)
-				nextStopSequenceNumber, _, _ = getNextStopSequence(
-					updatesForTrip.GetStopTimeUpdate(),
-					lowestSequence,
-					localTimeZone,
-				)
-				tripDelay = updatesForTrip.GetDelay()
-			}
+		serviceDate := c.QueryParam("date")
+		if _, ok := servicetime.ParseDate(serviceDate, localTimeZone); serviceDate != "" && !ok {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid date", nil, ResponseDetails("date", serviceDate, "details", "Expected YYYYMMDD"))
 		}
 
-		// Vehicle positions are optional.
+		// Realtime trip updates and vehicle positions are optional.
 		var (
-			vLat float32
-			vLon float32
+			tripUpdate *proto.TripUpdate
+			vehicle    *proto.VehiclePosition
 		)
-
-		if vehicles, err := realtime.GetVehicles(); err == nil {
-			if vehicleForTrip, err := vehicles.ByTripID(filterTripId); err == nil && vehicleForTrip != nil {
-				pos := vehicleForTrip.GetPosition()
-				if pos != nil {
-					vLat = pos.GetLatitude()
-					vLon = pos.GetLongitude()
-				}
-			}
+		if tripUpdates, err := realtime.GetTripUpdates(); err == nil {
+			tripUpdate, _ = tripUpdates.ByTripID(filterTripId)
 		}
-
-		// Fallback to first stop if no vehicle position is available.
-		if vLat == 0 && vLon == 0 {
-			for _, stop := range stopsForTrip {
-				vLat = float32(stop.StopLat)
-				vLon = float32(stop.StopLon)
-				break
-			}
+		if vehicles, err := realtime.GetVehicles(); err == nil {
+			vehicle, _ = vehicles.ByTripID(filterTripId)
 		}
 
-		for _, stop := range stopsForTrip {
-			var data StopTimes
-
-			if stop.ParentStation != "" {
-				data.ParentStopId = stop.ParentStation
-			} else {
-				data.ParentStopId = stop.StopId
-			}
-			data.ChildStopId = stop.StopId
-
-			if hasTripUpdate && nextStopSequenceNumber > (stop.Sequence-lowestSequence) {
-				data.Passed = true
-			}
-
-			defaultArrivalTime, err := time.ParseInLocation("15:04:05", stop.ArrivalTime, localTimeZone)
-			if err != nil {
-				continue
-			}
-
-			defaultDepartureTime, err := time.ParseInLocation("15:04:05", stop.DepartureTime, localTimeZone)
-			if err != nil {
-				defaultDepartureTime = defaultArrivalTime
-			}
-
-			scheduledArrival := time.Date(
-				now.Year(), now.Month(), now.Day(),
-				defaultArrivalTime.Hour(), defaultArrivalTime.Minute(), defaultArrivalTime.Second(),
-				0, localTimeZone,
-			)
-			scheduledDeparture := time.Date(
-				now.Year(), now.Month(), now.Day(),
-				defaultDepartureTime.Hour(), defaultDepartureTime.Minute(), defaultDepartureTime.Second(),
-				0, localTimeZone,
-			)
-
-			data.ScheduledTime = scheduledArrival.UnixMilli()
-
-			update, found := stopTimesForStops[stop.StopId]
-			if found {
-				data.Skipped = update.Skipped
-			}
-
-			switch {
-			case found && !update.ArrivalTime.IsZero():
-				data.ArrivalTime = update.ArrivalTime.UnixMilli()
-			case !data.Passed:
-				data.ArrivalTime = scheduledArrival.UnixMilli() + int64(tripDelay)*1000
-			default:
-				data.ArrivalTime = scheduledArrival.UnixMilli()
-			}
-
-			switch {
-			case found && !update.DepartureTime.IsZero():
-				data.DepartureTime = update.DepartureTime.UnixMilli()
-			case !data.Passed:
-				data.DepartureTime = scheduledDeparture.UnixMilli() + int64(tripDelay)*1000
-			default:
-				data.DepartureTime = scheduledDeparture.UnixMilli()
-			}
-
-			if dist, err := line.Dist(float64(vLat), float64(vLon), stop.StopLat, stop.StopLon); err == nil {
-				data.DistanceAway = dist.DistanceToStop
-			}
-
-			result = append(result, data)
+		// nil if the trip doesn't have a shape
+		line, _ := NewTripShapeDistance(filterTripId, gtfsData)
+		result, err := getTripStopTimes(gtfsData, filterTripId, line, tripUpdate, vehicle, serviceDate, localTimeZone)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("error", err.Error()))
 		}
 
 		return JsonApiResponse(c, http.StatusOK, "", result)
@@ -580,6 +492,16 @@ func setupRealtimeRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 		// Always return an array
 		return JsonApiResponse(c, http.StatusOK, "Closest vehicles", results)
 	})
+
+	return liveStream
+}
+
+func realtimeUnavailableMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			return JsonApiResponse(c, http.StatusServiceUnavailable, "realtime data unavailable", nil, ResponseDetails("details", "Realtime feeds are not available for this provider, only scheduled data is served"))
+		}
+	}
 }
 
 // getNextStopSequence inspects a trip's StopTimeUpdates (which may include
@@ -718,58 +640,149 @@ func getVehicleRouteData(currentRouteId string, routeCache map[string]gtfs.Route
 	return &routeData, nil
 }
 
-type DelayTimes struct {
-	ArrivalTime   time.Time
-	DepartureTime time.Time
-	Skipped       bool
-	ScheduledTime time.Time
+type TripStopTimes struct {
+	ParentStopId    string  `json:"parent_stop_id"`
+	ChildStopId     string  `json:"child_stop_id"`
+	ArrivalTime     int64   `json:"arrival_time"`
+	DepartureTime   int64   `json:"departure_time"`
+	ScheduledTime   int64   `json:"scheduled_time"`
+	Skipped         bool    `json:"skipped"`
+	Passed          bool    `json:"passed"`
+	DistanceAway    float64 `json:"dist"`
+	Platform        string  `json:"platform"`
+	PlatformChanged bool    `json:"platform_changed"`
 }
 
-func getPredictedStopArrivalTimesForTrip(stopUpdates []*proto.TripUpdate_StopTimeUpdate, localTimeZone *time.Location) map[string]DelayTimes {
-	results := make(map[string]DelayTimes)
+/*
+Predicted arrival/departure times for every stop of a trip.
 
-	for _, update := range stopUpdates {
-		stopId := update.GetStopId()
+tripUpdate and vehicle are optional, without them the scheduled times are used and distances are measured from the first stop.
+
+Scheduled times are resolved on the trips start_date from its realtime data, then on serviceDate (YYYYMMDD, can be empty),
+then on the service day that puts the trips first departure closest to now.
+*/
+func getTripStopTimes(gtfsData gtfs.Database, tripId string, line *TripShapeDistance, tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition, serviceDate string, localTimeZone *time.Location) ([]TripStopTimes, error) {
+	stopsForTrip, err := gtfsData.GetStopTimesForTripID(tripId)
+	if err != nil {
+		return nil, fmt.Errorf("no stops found for trip: %w", err)
+	}
+	// In the order the trip visits them
+	slices.SortFunc(stopsForTrip, func(a, b gtfs.TripStopTime) int {
+		return a.Sequence - b.Sequence
+	})
 
-		var arrivalTime, departureTime time.Time
+	_, lowestSequence, err := gtfsData.GetStopsForTripID(tripId)
+	if err != nil {
+		return nil, err
+	}
 
-		// GTFS-RT: If time is 0, it means no update is available for that field.
-		if update.Arrival != nil && update.Arrival.Time != nil && update.GetArrival().GetTime() > 0 {
-			arrivalTime = time.Unix(update.GetArrival().GetTime(), 0).In(localTimeZone)
-		}
-		if update.Departure != nil && update.Departure.Time != nil && update.GetDeparture().GetTime() > 0 {
-			departureTime = time.Unix(update.GetDeparture().GetTime(), 0).In(localTimeZone)
+	var result []TripStopTimes
+	now := time.Now().In(localTimeZone)
+
+	// Every stop is on the same service day, even once the trip runs past midnight
+	serviceDay := delays.TripServiceDay(stopsForTrip, tripStartDate(tripUpdate, vehicle, serviceDate), now, localTimeZone)
+	scheduledStops := delays.ScheduledStops(stopsForTrip, serviceDay)
+	// Stops without an update of their own get the delay from the stop before them
+	predictions := delays.Propagate(scheduledStops, tripUpdate)
+
+	nextStopSequenceNumber := 0
+	hasTripUpdate := tripUpdate != nil
+	// stop sequence -> stop id the vehicle will actually use
+	realtimeStopIds := make(map[int]string)
+
+	if hasTripUpdate {
+		nextStopSequenceNumber, _, _ = getNextStopSequence(
+			tripUpdate.GetStopTimeUpdate(),
+			lowestSequence,
+			localTimeZone,
+		)
+		for _, update := range tripUpdate.GetStopTimeUpdate() {
+			if update.GetStopId() != "" {
+				realtimeStopIds[int(update.GetStopSequence())] = update.GetStopId()
+			}
 		}
+	}
 
-		// If only one of arrival/departure is set, use that for both (fallback)
-		if arrivalTime.IsZero() && !departureTime.IsZero() {
-			arrivalTime = departureTime
+	var (
+		vLat float32
+		vLon float32
+	)
+
+	if pos := vehicle.GetPosition(); pos != nil {
+		vLat = pos.GetLatitude()
+		vLon = pos.GetLongitude()
+	}
+
+	// Fallback to first stop if no vehicle position is available.
+	if vLat == 0 && vLon == 0 {
+		for _, stop := range stopsForTrip {
+			vLat = float32(stop.StopLat)
+			vLon = float32(stop.StopLon)
+			break
 		}
-		if departureTime.IsZero() && !arrivalTime.IsZero() {
-			departureTime = arrivalTime
+	}
+
+	for _, stop := range stopsForTrip {
+		var data TripStopTimes
+
+		if stop.ParentStation != "" {
+			data.ParentStopId = stop.ParentStation
+		} else {
+			data.ParentStopId = stop.StopId
 		}
+		data.ChildStopId = stop.StopId
+		data.Platform = stop.PlatformNumber
 
-		var stopSkipped = false
+		if hasTripUpdate && nextStopSequenceNumber > (stop.Sequence-lowestSequence) {
+			data.Passed = true
+		}
 
-		switch update.GetScheduleRelationship().Enum().String() {
-		case "SKIPPED":
-			stopSkipped = true
-		case "NO_DATA":
-		case "UNSCHEDULED":
-			//skip
+		prediction, ok := predictions[stop.Sequence]
+		if !ok {
 			continue
 		}
 
-		if stopId != "" {
-			results[stopId] = DelayTimes{
-				ArrivalTime:   arrivalTime,
-				DepartureTime: departureTime,
-				Skipped:       stopSkipped,
+		data.ScheduledTime = prediction.Scheduled.Arrival.UnixMilli()
+
+		// The vehicle is using a different platform of the same station
+		if realtimeStopId, found := realtimeStopIds[stop.Sequence]; found && realtimeStopId != stop.StopId && stop.ParentStation != "" {
+			if platform, err := gtfsData.GetStopByStopID(realtimeStopId); err == nil && platform.ParentStation == stop.ParentStation {
+				data.ChildStopId = realtimeStopId
+				if platform.PlatformNumber != stop.PlatformNumber {
+					data.Platform = platform.PlatformNumber
+					data.PlatformChanged = true
+				}
+			}
+		}
+
+		data.Skipped = prediction.Skipped
+
+		// Scheduled times when nothing is known about the stop
+		data.ArrivalTime = prediction.Arrival.UnixMilli()
+		data.DepartureTime = prediction.Departure.UnixMilli()
+
+		// Trips without a shape don't have a distance
+		if line != nil {
+			if dist, err := line.Dist(float64(vLat), float64(vLon), stop.StopLat, stop.StopLon); err == nil {
+				data.DistanceAway = dist.DistanceToStop
 			}
 		}
+
+		result = append(result, data)
 	}
 
-	return results
+	return result, nil
+}
+
+// The start_date (YYYYMMDD) from a trips realtime data, or serviceDate (can be empty) if it doesn't have one
+func tripStartDate(tripUpdate *proto.TripUpdate, vehicle *proto.VehiclePosition, serviceDate string) string {
+	if startDate := tripUpdate.GetTrip().GetStartDate(); startDate != "" {
+		return startDate
+	}
+	if startDate := vehicle.GetTrip().GetStartDate(); startDate != "" {
+		return startDate
+	}
+	return serviceDate
 }
 
 /*
@@ -779,20 +792,15 @@ startDate = YYYYMMDD
 returns true by default
 */
 func checkIfTripStarted(startTime, startDate string, localTimeZone *time.Location) bool {
-	now := time.Now().In(localTimeZone)
-	if startTime != "" && startDate != "" {
-		parsedStartTime, err := time.ParseInLocation("15:04:05", startTime, localTimeZone)
-		if err == nil {
-			parsedStartDate, err := time.ParseInLocation("20060102", startDate, localTimeZone)
-			if err == nil {
-				combinedStartDateTime := time.Date(parsedStartDate.Year(), parsedStartDate.Month(), parsedStartDate.Day(), parsedStartTime.Hour(), parsedStartTime.Minute(), parsedStartTime.Second(), 0, localTimeZone)
-				if now.Before(combinedStartDateTime) {
-					return false
-				}
-			}
-		}
+	day, ok := servicetime.ParseDate(startDate, localTimeZone)
+	if !ok {
+		return true
+	}
+	start, ok := servicetime.At(startTime, day)
+	if !ok {
+		return true
 	}
-	return true
+	return !time.Now().Before(start)
 }
 
 // Vehicles
@@ -806,6 +814,8 @@ type VehiclesResponse struct {
 	VehicleType  string           `json:"type"` // bus, tram, metro
 	State        string           `json:"state,omitempty"`
 	OffCourse    bool             `json:"off_course"`
+	// Only set when asked for with interpolated=true
+	Interpolated *InterpolatedPosition `json:"interpolated,omitempty"`
 }
 
 type VehiclesRoute struct {
@@ -821,6 +831,16 @@ type VehiclesTrip struct {
 	FinalStop   ServicesStop `json:"final_stop"`
 	CurrentStop ServicesStop `json:"current_stop"`
 	Headsign    string       `json:"headsign"`
+	// The trip the vehicle runs after this one, null if it isn't known
+	NextTrip *NextTrip `json:"next_trip"`
+}
+
+type VehicleNextTripsResponse struct {
+	VehicleId   string     `json:"vehicle_id"`
+	TripId      string     `json:"trip_id"`
+	ServiceDate string     `json:"service_date"`
+	Delay       int        `json:"delay"` // Seconds late the vehicle is predicted to finish its current trip
+	NextTrips   []NextTrip `json:"next_trips"`
 }
 
 type VehiclesPosition struct {
@@ -1,21 +1,47 @@
 package providers
 
 import (
+	"cmp"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
 	"github.com/jfmow/gtfs"
 	rt "github.com/jfmow/gtfs/realtime"
 	"github.com/labstack/echo/v5"
 )
 
-func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, localTimeZone *time.Location, getStopsForTripCache caches.StopsForTripCache) {
+const (
+	// Stops that can be asked for in one /services/batch request
+	maxBatchStops = 20
+	// /services/nearby only looks at this many of the closest stops, a big radius in the city has hundreds
+	maxNearbyStops = 25
+	// Streets don't go in straight lines, walking distances are the straight line distance times this
+	walkingDetourFactor = 1.3
+	// The previous service days late night trips are looked for until this long into the day
+	overnightServicesUntil = 6 * time.Hour
+)
+
+// The service days with trips running at a time, the previous day as well early in the morning
+func runningServiceDays(at time.Time, localTimeZone *time.Location) []time.Time {
+	today := servicetime.DayStart(at, localTimeZone)
+	serviceDays := []time.Time{today}
+	if at.Sub(today) < overnightServicesUntil {
+		serviceDays = append(serviceDays, servicetime.DayStart(today.Add(-12*time.Hour), localTimeZone))
+	}
+	return serviceDays
+}
+
+func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, realtimeAvailable bool, localTimeZone *time.Location, sightings *realtimeSightings, blocks *vehicleBlocks, getParentStopsCache caches.ParentStopsCache, getStopsForTripCache caches.StopsForTripCache) {
 	servicesRoute := primaryRoute.Group("/services")
 
 	osrmApiUrl, found := os.LookupEnv("OSRM_URL")
@@ -23,58 +49,57 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 		panic("OSRM_URL env not found")
 	}
 
-	servicesRoute.GET("/:stationName", func(c echo.Context) error {
-		limitStr := c.QueryParam("limit")
-		limit := 20
-
-		if limitStr != "" {
-			l, err := strconv.Atoi(limitStr)
-			if err != nil || l <= 0 || l > 200 {
-				return JsonApiResponse(
-					c,
-					http.StatusBadRequest,
-					"invalid limit",
-					nil,
-					ResponseDetails(
-						"limit", limitStr,
-						"details", "Limit must be a valid integer between 1 and 200",
-						"error", fmt.Sprintf("%v", err),
-					),
-				)
-			}
-			limit = l
-		}
-
-		stopNameEncoded := c.PathParam("stationName")
-		stopName, err := url.PathUnescape(stopNameEncoded)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid stop", nil, ResponseDetails("stopName", stopNameEncoded, "details", "Invalid stop name format", "error", err.Error()))
-		}
+	/*
+		The departures from a stops platforms, starting 10 minutes ago. found is false if there are none.
 
-		stop, err := gtfsData.GetStopByNameOrCode(stopName)
-		if err != nil {
-			fmt.Println(err)
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid stop id", nil, ResponseDetails("stopName", stopName, "details", "Stop not found", "error", err.Error()))
-		}
+		After midnight the previous service days trips are still running on times past 24:00:00 (25:10:00 is 1:10am),
+		so both days are looked at and their departures merged in time order.
 
+		The realtime feeds and stop times are passed in so a request for several stops only reads them once.
+	*/
+	departuresForStop := func(stop *gtfs.Stop, limit int, tripUpdatesData rt.TripUpdatesMap, vehicleLocations rt.VehiclesMap, stopTimesCache *tripStopTimesCache) ([]ServicesResponse2, bool) {
 		nowMinusTenMinutes := time.Now().In(localTimeZone).Add(-10 * time.Minute)
-		currentTimeMinusTenMinutes := nowMinusTenMinutes.Format("15:04:05")
 
-		var services []gtfs.StopTimes
+		serviceDays := runningServiceDays(nowMinusTenMinutes, localTimeZone)
+
+		type departure struct {
+			service     gtfs.StopTimes
+			serviceDate string
+			at          time.Time
+		}
+		var departures []departure
 		childStops, _ := gtfsData.GetChildStopsByParentStopID(stop.StopId)
-		for _, a := range childStops {
-			servicesAtStop, err := gtfsData.GetActiveTrips(a.StopId, currentTimeMinusTenMinutes, nowMinusTenMinutes, limit)
-			if err == nil {
-				services = append(services, servicesAtStop...)
+		for _, serviceDay := range serviceDays {
+			// 10 minutes ago as a time on this service day, past 24:00:00 for the previous day
+			from := servicetime.Format(nowMinusTenMinutes.Sub(serviceDay))
+			// The date to look up the services running on, noon is on the right date even when daylight saving changes
+			date := serviceDay.Add(12 * time.Hour)
+			for _, a := range childStops {
+				servicesAtStop, err := gtfsData.GetActiveTrips(a.StopId, from, date, limit)
+				if err != nil {
+					continue
+				}
+				for _, service := range servicesAtStop {
+					at, _ := servicetime.At(service.ArrivalTime, serviceDay)
+					departures = append(departures, departure{service: service, serviceDate: servicetime.Date(serviceDay), at: at})
+				}
 			}
 		}
 
-		if len(services) == 0 {
-			return JsonApiResponse(c, http.StatusNotFound, "no services found for stop", nil, ResponseDetails("stopName", stopName, "details", "No services found for the given stop"))
+		if len(departures) == 0 {
+			return nil, false
 		}
-		var filteredServices []gtfs.StopTimes
+		slices.SortStableFunc(departures, func(a, b departure) int {
+			return a.at.Compare(b.at)
+		})
+
+		var (
+			filteredServices []gtfs.StopTimes
+			serviceDates     []string
+		)
 		stopsForTripCache := getStopsForTripCache()
-		for _, service := range services {
+		for _, departure := range departures {
+			service := departure.service
 			stopsForService, found := stopsForTripCache[service.TripID]
 			if !found {
 				continue
@@ -86,20 +111,23 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			//Check it is not the last stop for the service because displaying that as a departure is pointless
 			if service.StopSequence != len(stopsForService.Stops)-1 {
 				filteredServices = append(filteredServices, service)
+				serviceDates = append(serviceDates, departure.serviceDate)
 			}
 
 		}
 
 		var resultData []ServicesResponse2 = []ServicesResponse2{}
 
-		tripUpdatesData, _ := realtime.GetTripUpdates()
-		vehicleLocations, _ := realtime.GetVehicles()
-
 		realtimeData := GetRealtimeTripDataForServices(
 			filteredServices,
+			serviceDates,
 			tripUpdatesData,
 			vehicleLocations,
 			gtfsData,
+			realtimeAvailable,
+			sightings,
+			stopTimesCache,
+			blocks,
 		)
 
 		for i, service := range filteredServices {
@@ -115,6 +143,7 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 				TripId:             service.TripID,
 				WheelchairsAllowed: service.StopData.WheelChairBoarding,
 				BikesAllowed:       service.TripData.BikesAllowed,
+				DirectionId:        service.TripData.DirectionID,
 				TripStarted:        true,
 			}
 
@@ -136,9 +165,209 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			resultData = append(resultData, response)
 		}
 
+		return resultData, true
+	}
+
+	servicesRoute.GET("/:stationName", func(c echo.Context) error {
+		limitStr := c.QueryParam("limit")
+		limit := 20
+
+		if limitStr != "" {
+			l, err := strconv.Atoi(limitStr)
+			if err != nil || l <= 0 || l > 200 {
+				return JsonApiResponse(
+					c,
+					http.StatusBadRequest,
+					"invalid limit",
+					nil,
+					ResponseDetails(
+						"limit", limitStr,
+						"details", "Limit must be a valid integer between 1 and 200",
+						"error", fmt.Sprintf("%v", err),
+					),
+				)
+			}
+			limit = l
+		}
+
+		stopNameEncoded := c.PathParam("stationName")
+		stopName, err := url.PathUnescape(stopNameEncoded)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid stop", nil, ResponseDetails("stopName", stopNameEncoded, "details", "Invalid stop name format", "error", err.Error()))
+		}
+
+		stop, err := gtfsData.GetStopByNameOrCode(stopName)
+		if err != nil {
+			fmt.Println(err)
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid stop id", nil, ResponseDetails("stopName", stopName, "details", "Stop not found", "error", err.Error()))
+		}
+
+		var tripUpdatesData rt.TripUpdatesMap
+		var vehicleLocations rt.VehiclesMap
+		if realtimeAvailable {
+			tripUpdatesData, _ = realtime.GetTripUpdates()
+			vehicleLocations, _ = realtime.GetVehicles()
+		}
+
+		resultData, found := departuresForStop(stop, limit, tripUpdatesData, vehicleLocations, newTripStopTimesCache(gtfsData))
+		if !found {
+			return JsonApiResponse(c, http.StatusNotFound, "no services found for stop", nil, ResponseDetails("stopName", stopName, "details", "No services found for the given stop"))
+		}
+
 		return JsonApiResponse(c, http.StatusOK, "", resultData)
 	})
 
+	/*
+		Departures for several stops at once, e.g /services/batch?stops=Britomart,133,Newmarket&limit=10
+
+		Departures are keyed by the stop as it was asked for, stops that don't exist are listed in not_found.
+	*/
+	servicesRoute.GET("/batch", func(c echo.Context) error {
+		limit, err := queryInt(c, "limit", 20)
+		if err != nil || limit <= 0 || limit > 200 {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid limit", nil, ResponseDetails("limit", c.QueryParam("limit"), "details", "Limit must be a valid integer between 1 and 200", "error", fmt.Sprintf("%v", err)))
+		}
+
+		var stopNames []string
+		for _, stopName := range strings.Split(c.QueryParam("stops"), ",") {
+			stopName = strings.TrimSpace(stopName)
+			if stopName != "" && !slices.Contains(stopNames, stopName) {
+				stopNames = append(stopNames, stopName)
+			}
+		}
+		if len(stopNames) == 0 {
+			return JsonApiResponse(c, http.StatusBadRequest, "missing stops", nil, ResponseDetails("stops", c.QueryParam("stops"), "details", "Expected a comma separated list of stop names or codes"))
+		}
+		if len(stopNames) > maxBatchStops {
+			return JsonApiResponse(c, http.StatusBadRequest, "too many stops", nil, ResponseDetails("stops", len(stopNames), "details", fmt.Sprintf("At most %d stops can be requested at once", maxBatchStops)))
+		}
+
+		var tripUpdatesData rt.TripUpdatesMap
+		var vehicleLocations rt.VehiclesMap
+		if realtimeAvailable {
+			tripUpdatesData, _ = realtime.GetTripUpdates()
+			vehicleLocations, _ = realtime.GetVehicles()
+		}
+
+		stopTimesCache := newTripStopTimesCache(gtfsData)
+		response := BatchServicesResponse{
+			Stops:    make(map[string][]ServicesResponse2, len(stopNames)),
+			NotFound: []string{},
+		}
+		for _, stopName := range stopNames {
+			stop, err := gtfsData.GetStopByNameOrCode(stopName)
+			if err != nil {
+				response.NotFound = append(response.NotFound, stopName)
+				continue
+			}
+			departures, found := departuresForStop(stop, limit, tripUpdatesData, vehicleLocations, stopTimesCache)
+			if !found {
+				departures = []ServicesResponse2{}
+			}
+			response.Stops[stopName] = departures
+		}
+
+		return JsonApiResponse(c, http.StatusOK, "", response)
+	})
+
+	/*
+		The next departure of every route (and direction) from the stops around a location, e.g /services/nearby?lat=-36.84&lon=174.76&radius=500
+
+		Each route only has the soonest departure that can still be caught, walking at walkSpeed (km/h) from the location.
+		When a route leaves from more than one stop nearby the one with the sooner departure is used, then the closer one.
+	*/
+	servicesRoute.GET("/nearby", func(c echo.Context) error {
+		lat, err := queryFloat(c, "lat", 0)
+		if err != nil || lat < -90 || lat > 90 || c.QueryParam("lat") == "" {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid lat", nil, ResponseDetails("lat", c.QueryParam("lat"), "details", "Invalid latitude format"))
+		}
+		lon, err := queryFloat(c, "lon", 0)
+		if err != nil || lon < -180 || lon > 180 || c.QueryParam("lon") == "" {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid lon", nil, ResponseDetails("lon", c.QueryParam("lon"), "details", "Invalid longitude format"))
+		}
+		radius, err := queryFloat(c, "radius", 500)
+		if err != nil || radius <= 0 || radius > 2000 {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid radius", nil, ResponseDetails("radius", c.QueryParam("radius"), "details", "Radius must be between 1 and 2000 meters"))
+		}
+		walkSpeed, err := queryFloat(c, "walkSpeed", 4.8)
+		if err != nil || walkSpeed <= 0 {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid walkSpeed", nil, ResponseDetails("walkSpeed", c.QueryParam("walkSpeed"), "details", "Walk speed must be a positive number of km/h"))
+		}
+
+		type nearbyStop struct {
+			stop     gtfs.Stop
+			distance float64
+		}
+		var stops []nearbyStop
+		for _, stop := range getParentStopsCache() {
+			// Straight line, so the walking distance can be longer than the radius
+			if distance := haversine(lat, lon, stop.StopLat, stop.StopLon); distance <= radius {
+				stops = append(stops, nearbyStop{stop: stop, distance: distance})
+			}
+		}
+		slices.SortFunc(stops, func(a, b nearbyStop) int {
+			return cmp.Compare(a.distance, b.distance)
+		})
+		stops = stops[:min(len(stops), maxNearbyStops)]
+
+		var tripUpdatesData rt.TripUpdatesMap
+		var vehicleLocations rt.VehiclesMap
+		if realtimeAvailable {
+			tripUpdatesData, _ = realtime.GetTripUpdates()
+			vehicleLocations, _ = realtime.GetVehicles()
+		}
+
+		stopTimesCache := newTripStopTimesCache(gtfsData)
+		// route id + direction -> soonest departure
+		groups := make(map[string]*NearbyDeparture)
+		for _, nearby := range stops {
+			walkingDistance := nearby.distance * walkingDetourFactor
+			walkingTime := int(walkingDistance / (walkSpeed * 1000 / 3600))
+
+			departures, found := departuresForStop(&nearby.stop, 10, tripUpdatesData, vehicleLocations, stopTimesCache)
+			if !found {
+				continue
+			}
+			for _, departure := range departures {
+				if departure.Departed || departure.Canceled || departure.Skipped || departure.TimeTillArrival*60 < walkingTime {
+					continue
+				}
+
+				key := departure.Route.RouteId + "/" + strconv.Itoa(departure.DirectionId)
+				current, found := groups[key]
+				if found && (current.Departure.TimeTillArrival < departure.TimeTillArrival ||
+					(current.Departure.TimeTillArrival == departure.TimeTillArrival && current.WalkingDistance <= walkingDistance)) {
+					continue
+				}
+				groups[key] = &NearbyDeparture{
+					RouteId:         departure.Route.RouteId,
+					DirectionId:     departure.DirectionId,
+					Headsign:        departure.Headsign,
+					Stop:            NearbyDepartureStop{StopId: nearby.stop.StopId, Name: nearby.stop.StopName, Code: nearby.stop.StopCode, Lat: nearby.stop.StopLat, Lon: nearby.stop.StopLon},
+					WalkingDistance: math.Round(walkingDistance),
+					WalkingTime:     walkingTime,
+					Departure:       departure,
+				}
+			}
+		}
+
+		result := make([]NearbyDeparture, 0, len(groups))
+		for _, group := range groups {
+			result = append(result, *group)
+		}
+		slices.SortFunc(result, func(a, b NearbyDeparture) int {
+			if a.Departure.TimeTillArrival != b.Departure.TimeTillArrival {
+				return a.Departure.TimeTillArrival - b.Departure.TimeTillArrival
+			}
+			if a.WalkingTime != b.WalkingTime {
+				return a.WalkingTime - b.WalkingTime
+			}
+			return strings.Compare(a.RouteId, b.RouteId)
+		})
+
+		return JsonApiResponse(c, http.StatusOK, "", result)
+	})
+
 	servicesRoute.GET("/:stationName/schedule", func(c echo.Context) error {
 		stopNameEncoded := c.PathParam("stationName")
 		stopName, err := url.PathUnescape(stopNameEncoded)
@@ -174,9 +403,14 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			return JsonApiResponse(c, http.StatusNotFound, "no services found", nil, ResponseDetails("stopName", stopName, "details", "No services found for the given stop"))
 		}
 
-		// Sort services by arrival time
-		sort.Slice(services, func(i, j int) bool {
-			return services[i].ArrivalTime < services[j].ArrivalTime
+		// Sort services by arrival time, in the order they run on the service day (25:10:00 is after 23:50:00)
+		serviceDay := servicetime.DayStart(now, localTimeZone)
+		arrivalSeconds := func(service gtfs.StopTimes) int {
+			seconds, _ := servicetime.Seconds(service.ArrivalTime)
+			return seconds
+		}
+		sort.SliceStable(services, func(i, j int) bool {
+			return arrivalSeconds(services[i]) < arrivalSeconds(services[j])
 		})
 
 		var result []ServicesResponse2
@@ -184,6 +418,10 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 		for _, service := range services {
 			var response ServicesResponse2
 			response.ArrivalTime = service.ArrivalTime
+			if arrival, ok := servicetime.At(service.ArrivalTime, serviceDay); ok {
+				response.ArrivalTime = arrival.Format("15:04:05")
+			}
+			response.ArrivalSource = ArrivalSourceScheduled
 			if service.StopHeadsign != "" {
 				response.Headsign = service.StopHeadsign
 			} else {
@@ -203,6 +441,7 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			}
 			response.LocationTracking = false
 			response.TripId = service.TripID
+			response.TrackingConfidence = TrackingScheduled
 
 			result = append(result, response)
 		}
@@ -287,7 +526,11 @@ func setupServicesRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realt
 			MinResults:      3,
 			OsrmURL:         osrmApiUrl,
 			IncludeChildren: true,
-			Realtime:        &realtime,
+		}
+
+		//Plans fall back to the timetable when the provider has no realtime
+		if realtimeAvailable {
+			jplan.Realtime = &realtime
 		}
 
 		switch timeType {
@@ -337,11 +580,36 @@ func queryString(
 	return v
 }
 
+// The next departure of a route in one direction from the stops near a location
+type NearbyDeparture struct {
+	RouteId         string              `json:"route_id"`
+	DirectionId     int                 `json:"direction_id"`
+	Headsign        string              `json:"headsign"`
+	Stop            NearbyDepartureStop `json:"stop"`
+	WalkingDistance float64             `json:"walking_distance"` // Meters, estimated from the straight line distance
+	WalkingTime     int                 `json:"walking_time"`     // Seconds
+	Departure       ServicesResponse2   `json:"departure"`
+}
+
+type NearbyDepartureStop struct {
+	StopId string  `json:"stop_id"`
+	Name   string  `json:"name"`
+	Code   string  `json:"code"`
+	Lat    float64 `json:"lat"`
+	Lon    float64 `json:"lon"`
+}
+
+type BatchServicesResponse struct {
+	Stops    map[string][]ServicesResponse2 `json:"stops"`
+	NotFound []string                       `json:"not_found"`
+}
+
 // Services
 type ServicesResponse2 struct {
 	TripId             string `json:"trip_id"`
 	Headsign           string `json:"headsign"`
 	ArrivalTime        string `json:"arrival_time"`
+	ArrivalSource      string `json:"arrival_source"` // scheduled, trip_update, propagated (delay carried on from an earlier stop) or position (estimated from where the vehicle is)
 	Platform           string `json:"platform"`
 	StopsAway          int    `json:"stops_away"`
 	Occupancy          int    `json:"occupancy"`
@@ -350,7 +618,8 @@ type ServicesResponse2 struct {
 	BikesAllowed       int    `json:"bikes_allowed"`
 	WheelchairsAllowed int    `json:"wheelchairs_allowed"` //0 = unknown 1 = yes 2= no
 
-	Route *ServicesRoute `json:"route"`
+	Route       *ServicesRoute `json:"route"`
+	DirectionId int            `json:"direction_id"`
 
 	Stop *ServicesStop `json:"stop"`
 
@@ -362,6 +631,8 @@ type ServicesResponse2 struct {
 	TripStarted        bool   `json:"trip_started"`
 
 	PlatformChanged bool `json:"platform_changed"`
+
+	TrackingConfidence string `json:"tracking_confidence"` // high, medium, low, scheduled or unavailable (provider has no realtime)
 }
 
 type ServicesRoute struct {
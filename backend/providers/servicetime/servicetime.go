@@ -0,0 +1,139 @@
+/*
+Package servicetime turns gtfs schedule times into real times.
+
+Gtfs times are measured from the start of a service day rather than midnight, and go past 24:00:00 for trips
+that run after midnight (25:10:00 is 1:10am the next morning). A trip that starts at 23:50 on the 1st still
+belongs to the 1st's service day when it reaches its last stop at 00:30 on the 2nd.
+*/
+package servicetime
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Parses a gtfs "HH:MM:SS" time into seconds since the start of the service day.
+
+Unlike time.Parse it accepts hours past 24.
+*/
+func Seconds(value string) (int, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) != 3 {
+		return 0, fmt.Errorf("invalid gtfs time %q", value)
+	}
+	var total int
+	for i, multiplier := range []int{3600, 60, 1} {
+		n, err := strconv.Atoi(strings.TrimSpace(parts[i]))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid gtfs time %q", value)
+		}
+		total += n * multiplier
+	}
+	return total, nil
+}
+
+/*
+The start of the service day for a date, which is noon minus 12 hours.
+
+That's midnight except on the days daylight saving starts or ends, where it keeps the times in the schedule right.
+*/
+func DayStart(date time.Time, localTimeZone *time.Location) time.Time {
+	local := date.In(localTimeZone)
+	return time.Date(local.Year(), local.Month(), local.Day(), 12, 0, 0, 0, localTimeZone).Add(-12 * time.Hour)
+}
+
+// Formats a time since the start of a service day as a gtfs "HH:MM:SS" time, the hours go past 24
+func Format(sinceDayStart time.Duration) string {
+	seconds := max(int(sinceDayStart/time.Second), 0)
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds%3600/60, seconds%60)
+}
+
+/*
+The YYYYMMDD date of a service day (from DayStart).
+
+Not day.Format, on the days daylight saving starts or ends the day starts at 11pm or 1am the day before.
+*/
+func Date(day time.Time) string {
+	return day.Add(12 * time.Hour).Format("20060102")
+}
+
+// Parses a gtfs/realtime YYYYMMDD date into the start of its service day
+func ParseDate(value string, localTimeZone *time.Location) (time.Time, bool) {
+	date, err := time.ParseInLocation("20060102", value, localTimeZone)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return DayStart(date, localTimeZone), true
+}
+
+// Resolves a gtfs time on a service day, day is from DayStart
+func At(value string, day time.Time) (time.Time, bool) {
+	seconds, err := Seconds(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day.Add(time.Duration(seconds) * time.Second), true
+}
+
+// The service days a time could be on: the one before, the same and the one after near
+func candidateDays(near time.Time, localTimeZone *time.Location) []time.Time {
+	local := near.In(localTimeZone)
+	days := make([]time.Time, 0, 3)
+	for _, offset := range []int{-1, 0, 1} {
+		days = append(days, DayStart(time.Date(local.Year(), local.Month(), local.Day()+offset, 12, 0, 0, 0, localTimeZone), localTimeZone))
+	}
+	return days
+}
+
+// The service day that puts a gtfs time closest to near
+func NearestDay(value string, near time.Time, localTimeZone *time.Location) (time.Time, bool) {
+	seconds, err := Seconds(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	var best time.Time
+	var bestDistance time.Duration
+	for i, day := range candidateDays(near, localTimeZone) {
+		distance := day.Add(time.Duration(seconds) * time.Second).Sub(near).Abs()
+		if i == 0 || distance < bestDistance {
+			best, bestDistance = day, distance
+		}
+	}
+	return best, true
+}
+
+// Resolves a gtfs time to the service day that puts it closest to near
+func Near(value string, near time.Time, localTimeZone *time.Location) (time.Time, bool) {
+	day, ok := NearestDay(value, near, localTimeZone)
+	if !ok {
+		return time.Time{}, false
+	}
+	return At(value, day)
+}
+
+// Resolves a gtfs time to the first service day that puts it at or after after
+func After(value string, after time.Time, localTimeZone *time.Location) (time.Time, bool) {
+	for _, day := range candidateDays(after, localTimeZone) {
+		if candidate, ok := At(value, day); ok && !candidate.Before(after) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+/*
+The service day a trip is running on.
+
+startDate (YYYYMMDD) is the start_date from the trips realtime data, or the date asked for. When it's empty the
+day that puts value (a time from the trip, ideally its first departure) closest to near is used.
+*/
+func TripDay(startDate string, value string, near time.Time, localTimeZone *time.Location) (time.Time, bool) {
+	if day, ok := ParseDate(startDate, localTimeZone); ok {
+		return day, true
+	}
+	return NearestDay(value, near, localTimeZone)
+}
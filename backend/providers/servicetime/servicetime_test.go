@@ -0,0 +1,234 @@
+package servicetime
+
+import (
+	"testing"
+	"time"
+)
+
+func auckland(t *testing.T) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation("Pacific/Auckland")
+	if err != nil {
+		t.Skipf("no timezone data: %v", err)
+	}
+	return location
+}
+
+func TestSeconds(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "00:00:00", want: 0},
+		{value: "08:30:15", want: 8*3600 + 30*60 + 15},
+		{value: "25:10:00", want: 25*3600 + 10*60},
+		{value: " 7:05:00", want: 7*3600 + 5*60},
+		{value: "", wantErr: true},
+		{value: "08:30", wantErr: true},
+		{value: "08:-1:00", wantErr: true},
+		{value: "aa:00:00", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := Seconds(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Seconds(%q) error = %v, want error %v", test.value, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("Seconds(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+// The day starts at noon minus 12 hours, which is only midnight when daylight saving doesn't change that day
+func TestDayStart(t *testing.T) {
+	location := auckland(t)
+	tests := []struct {
+		name string
+		date time.Time
+		want time.Time
+	}{
+		{
+			name: "normal day",
+			date: time.Date(2026, 10, 16, 15, 30, 0, 0, location),
+			want: time.Date(2026, 10, 16, 0, 0, 0, 0, location),
+		},
+		{
+			name: "just after midnight",
+			date: time.Date(2026, 10, 16, 0, 5, 0, 0, location),
+			want: time.Date(2026, 10, 16, 0, 0, 0, 0, location),
+		},
+		{
+			// Clocks go forward at 2am, so noon is 11 hours after midnight
+			name: "daylight saving starts",
+			date: time.Date(2026, 9, 27, 9, 0, 0, 0, location),
+			want: time.Date(2026, 9, 26, 23, 0, 0, 0, location),
+		},
+		{
+			// Clocks go back at 3am, so noon is 13 hours after midnight
+			name: "daylight saving ends",
+			date: time.Date(2026, 4, 5, 9, 0, 0, 0, location),
+			want: time.Date(2026, 4, 5, 1, 0, 0, 0, location),
+		},
+	}
+	for _, test := range tests {
+		if got := DayStart(test.date, location); !got.Equal(test.want) {
+			t.Errorf("%s: DayStart(%v) = %v, want %v", test.name, test.date, got, test.want)
+		}
+	}
+}
+
+func TestAt(t *testing.T) {
+	location := auckland(t)
+	tests := []struct {
+		name  string
+		value string
+		day   time.Time
+		want  time.Time
+	}{
+		{
+			name:  "normal day",
+			value: "08:00:00",
+			day:   DayStart(time.Date(2026, 10, 16, 12, 0, 0, 0, location), location),
+			want:  time.Date(2026, 10, 16, 8, 0, 0, 0, location),
+		},
+		{
+			name:  "past 24:00 is the next morning",
+			value: "25:10:00",
+			day:   DayStart(time.Date(2026, 10, 16, 12, 0, 0, 0, location), location),
+			want:  time.Date(2026, 10, 17, 1, 10, 0, 0, location),
+		},
+		{
+			name:  "daylight saving starts",
+			value: "08:00:00",
+			day:   DayStart(time.Date(2026, 9, 27, 12, 0, 0, 0, location), location),
+			want:  time.Date(2026, 9, 27, 8, 0, 0, 0, location),
+		},
+		{
+			name:  "daylight saving ends",
+			value: "08:00:00",
+			day:   DayStart(time.Date(2026, 4, 5, 12, 0, 0, 0, location), location),
+			want:  time.Date(2026, 4, 5, 8, 0, 0, 0, location),
+		},
+		{
+			name:  "past 24:00 on the night daylight saving starts",
+			value: "24:30:00",
+			day:   DayStart(time.Date(2026, 9, 26, 12, 0, 0, 0, location), location),
+			want:  time.Date(2026, 9, 27, 0, 30, 0, 0, location),
+		},
+	}
+	for _, test := range tests {
+		got, ok := At(test.value, test.day)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%s: At(%q) = %v, %v, want %v", test.name, test.value, got, ok, test.want)
+		}
+	}
+
+	if _, ok := At("not a time", time.Now()); ok {
+		t.Errorf("At with an invalid time should fail")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		since time.Duration
+		want  string
+	}{
+		{since: 0, want: "00:00:00"},
+		{since: 8*time.Hour + 5*time.Minute + 9*time.Second, want: "08:05:09"},
+		{since: 25*time.Hour + 10*time.Minute, want: "25:10:00"},
+		{since: -time.Minute, want: "00:00:00"},
+	}
+	for _, test := range tests {
+		if got := Format(test.since); got != test.want {
+			t.Errorf("Format(%v) = %q, want %q", test.since, got, test.want)
+		}
+	}
+}
+
+func TestDate(t *testing.T) {
+	location := auckland(t)
+	for _, date := range []time.Time{
+		time.Date(2026, 10, 16, 12, 0, 0, 0, location),
+		time.Date(2026, 9, 27, 12, 0, 0, 0, location),
+		time.Date(2026, 4, 5, 12, 0, 0, 0, location),
+	} {
+		want := date.Format("20060102")
+		if got := Date(DayStart(date, location)); got != want {
+			t.Errorf("Date(DayStart(%v)) = %q, want %q", date, got, want)
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	location := auckland(t)
+	day, ok := ParseDate("20260927", location)
+	if want := time.Date(2026, 9, 26, 23, 0, 0, 0, location); !ok || !day.Equal(want) {
+		t.Errorf("ParseDate(20260927) = %v, %v, want %v", day, ok, want)
+	}
+	if _, ok := ParseDate("2026-09-27", location); ok {
+		t.Errorf("ParseDate should only accept YYYYMMDD")
+	}
+}
+
+func TestNear(t *testing.T) {
+	location := auckland(t)
+	tests := []struct {
+		name  string
+		value string
+		near  time.Time
+		want  time.Time
+	}{
+		{
+			name:  "later today",
+			value: "14:00:00",
+			near:  time.Date(2026, 10, 16, 13, 0, 0, 0, location),
+			want:  time.Date(2026, 10, 16, 14, 0, 0, 0, location),
+		},
+		{
+			// Yesterday's 24:30 trip, not tonight's
+			name:  "after midnight on the previous service day",
+			value: "24:30:00",
+			near:  time.Date(2026, 10, 17, 0, 20, 0, 0, location),
+			want:  time.Date(2026, 10, 17, 0, 30, 0, 0, location),
+		},
+		{
+			name:  "just before midnight for a trip early tomorrow",
+			value: "00:10:00",
+			near:  time.Date(2026, 10, 16, 23, 50, 0, 0, location),
+			want:  time.Date(2026, 10, 17, 0, 10, 0, 0, location),
+		},
+	}
+	for _, test := range tests {
+		got, ok := Near(test.value, test.near, location)
+		if !ok || !got.Equal(test.want) {
+			t.Errorf("%s: Near(%q, %v) = %v, %v, want %v", test.name, test.value, test.near, got, ok, test.want)
+		}
+	}
+}
+
+func TestAfter(t *testing.T) {
+	location := auckland(t)
+	after := time.Date(2026, 10, 16, 23, 0, 0, 0, location)
+	got, ok := After("07:00:00", after, location)
+	if want := time.Date(2026, 10, 17, 7, 0, 0, 0, location); !ok || !got.Equal(want) {
+		t.Errorf("After(07:00:00, %v) = %v, %v, want %v", after, got, ok, want)
+	}
+}
+
+func TestTripDay(t *testing.T) {
+	location := auckland(t)
+	near := time.Date(2026, 10, 17, 0, 20, 0, 0, location)
+
+	// The start date wins over the closest day
+	day, ok := TripDay("20261017", "24:30:00", near, location)
+	if want := time.Date(2026, 10, 17, 0, 0, 0, 0, location); !ok || !day.Equal(want) {
+		t.Errorf("TripDay with a start date = %v, %v, want %v", day, ok, want)
+	}
+
+	day, ok = TripDay("", "24:30:00", near, location)
+	if want := time.Date(2026, 10, 16, 0, 0, 0, 0, location); !ok || !day.Equal(want) {
+		t.Errorf("TripDay without a start date = %v, %v, want %v", day, ok, want)
+	}
+}
@@ -1,10 +1,16 @@
 package providers
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/history"
 	"github.com/jfmow/at-trains-api/providers/notifications"
+	"github.com/jfmow/at-trains-api/providers/staticfeed"
 	"github.com/jfmow/gtfs"
 	rt "github.com/jfmow/gtfs/realtime"
 	"github.com/labstack/echo/v5"
@@ -13,6 +19,10 @@ import (
 
 var gzipConfig = middleware.GzipConfig{
 	Level: 5,
+	// Compressed event streams get buffered instead of reaching the client, and websockets do their own framing
+	Skipper: func(c echo.Context) bool {
+		return strings.HasSuffix(c.Path(), "/stream") || c.IsWebSocket()
+	},
 }
 
 type Response struct {
@@ -57,103 +67,166 @@ func ResponseDetails(pairs ...any) map[string]any {
 	return m
 }
 
-func SetupProvider(primaryRouter *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, gtfsName string, localTimeZone *time.Location) {
-	primaryRouter.Use(middleware.GzipWithConfig(gzipConfig))
+/*
+The startup state of a provider
 
-	caches := caches.CreateCaches(gtfsData)
+ready = static + realtime data
 
-	setupServicesRoutes(primaryRouter, gtfsData, realtime, localTimeZone, caches.GetStopsForTripCache)
-	setupRoutesRoutes(primaryRouter, gtfsData, caches.GetRouteCache)
-	setupStopsRoutes(primaryRouter, gtfsData, caches.GetParentStopsCache, caches.GetAllStopsCache, caches.GetStopsForTripCache)
-	setupRealtimeRoutes(primaryRouter, gtfsData, realtime, localTimeZone, caches.GetStopsForTripCache, caches.GetRouteCache, caches.GetParentStopsByChildCache)
-	setupNavigationRoutes(primaryRouter, gtfsData)
+degraded = static data only, /realtime/* returns 503
 
-	notifications.SetupNotificationsRoutes(primaryRouter, gtfsData, realtime, localTimeZone, caches.GetParentStopsByChildCache, caches.GetStopsForTripCache)
+disabled = not mounted
+*/
+type ProviderState string
 
-	/*hsdb := history.SetupHistoricalDataStorage(realtime, gtfsName, localTimeZone)
+const (
+	ProviderReady    ProviderState = "ready"
+	ProviderDegraded ProviderState = "degraded"
+	ProviderDisabled ProviderState = "disabled"
+)
 
-	primaryRouter.GET("/hs/:trip", func(c echo.Context) error {
-		encodedtripId := c.PathParam("trip")
-		tripId, err := url.PathUnescape(encodedtripId)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip", nil, ResponseDetails("tripId", encodedtripId, "details", "Invalid trip ID format", "error", err.Error()))
-		}
-		updates, positions := hsdb.GetHistoricTrip(tripId)
-		return JsonApiResponse(c, 200, "OK", map[string]any{
-			"updates":   updates,
-			"positions": positions,
-		})
-	})
+// A provider that has been through startup, mounted or not
+type Provider struct {
+	Config    ProviderConfig
+	State     ProviderState
+	Reason    string // Why the provider isn't ready
+	StartedAt time.Time
+	// When the static gtfs finished loading, zero if it never did
+	StaticLoadedAt time.Time
+
+	caches     caches.Caches
+	feeds      *FeedMonitor
+	notifier   *notifications.Notifier
+	history    *history.Database
+	liveStream *liveVehicleStream
+	detours    *detourDetector
+	staticFeed *staticfeed.Source
+}
 
-	primaryRouter.GET("/hs", func(c echo.Context) error {
-		pageParam := c.QueryParam("page")
-		sizeParam := c.QueryParam("size")
+// Records a provider that was never mounted
+func NewDisabledProvider(config ProviderConfig, reason string) *Provider {
+	return &Provider{
+		Config:    config,
+		State:     ProviderDisabled,
+		Reason:    reason,
+		StartedAt: time.Now(),
+	}
+}
 
-		page := 1
-		size := 10
+// Disconnects the providers long lived streaming clients, so they don't hold up the http server shutting down
+func (p *Provider) CloseStreams() {
+	if p.liveStream != nil {
+		p.liveStream.Close()
+	}
+}
 
-		if pageParam != "" {
-			fmt.Sscanf(pageParam, "%d", &page)
-		}
-		if sizeParam != "" {
-			fmt.Sscanf(sizeParam, "%d", &size)
-		}
+// Stops new notification jobs starting, Shutdown waits for the ones already running
+func (p *Provider) DrainJobs() {
+	if p.notifier != nil {
+		p.notifier.Drain()
+	}
+}
 
-		if size > 100 {
-			size = 100
-		}
+/*
+Stops the providers background work, waiting until ctx is done for running notification jobs to finish.
 
-		trips, totalCount, totalPages, err := hsdb.GetRecentTrips(page, size)
-		if err != nil {
-			log.Printf("error getting recent trips: %v", err)
-			return JsonApiResponse(c, 500, "Database Error", nil)
-		}
+The http routes are left alone, the server should already have been shut down.
+*/
+func (p *Provider) Shutdown(ctx context.Context) error {
+	p.CloseStreams()
+	if p.feeds != nil {
+		p.feeds.Stop()
+	}
+	if p.detours != nil {
+		p.detours.Stop()
+	}
+	p.staticFeed.Stop()
 
-		response := map[string]any{
-			"page":        page,
-			"page_size":   size,
-			"total_count": totalCount,
-			"total_pages": totalPages,
-			"trips":       trips,
+	var err error
+	if p.notifier != nil {
+		err = p.notifier.Stop(ctx)
+	}
+	if p.history != nil {
+		if closeErr := p.history.Close(); closeErr != nil {
+			err = errors.Join(err, fmt.Errorf("close history database: %w", closeErr))
 		}
+	}
+	return err
+}
 
-		return JsonApiResponse(c, 200, "OK", response)
-	})
+func SetupProvider(primaryRouter *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, config ProviderConfig, state ProviderState, reason string) *Provider {
+	primaryRouter.Use(middleware.GzipWithConfig(gzipConfig))
 
-	// GET historic trips by route id with optional start/end timestamp query params
-	// Example: /hs/route/ROUTE123?start=1690000000&end=1690100000
-	primaryRouter.GET("/hs/route/:route", func(c echo.Context) error {
-		encodedrouteId := c.PathParam("route")
-		routeId, err := url.PathUnescape(encodedrouteId)
-		if err != nil {
-			return JsonApiResponse(c, http.StatusBadRequest, "invalid route", nil, ResponseDetails("routeId", encodedrouteId, "details", "Invalid route ID format", "error", err.Error()))
-		}
+	realtimeAvailable := state == ProviderReady
 
-		var startPtr *int64
-		var endPtr *int64
+	// Already checked when the config was loaded
+	localTimeZone, _ := config.Location()
+	pollInterval, _ := config.Realtime.Interval()
 
-		if s := c.QueryParam("start"); s != "" {
-			if v, err := strconv.ParseInt(s, 10, 64); err == nil {
-				startPtr = &v
-			}
-		}
-		if e := c.QueryParam("end"); e != "" {
-			if v, err := strconv.ParseInt(e, 10, 64); err == nil {
-				endPtr = &v
+	caches := caches.CreateCaches(config.Prefix, gtfsData)
+
+	provider := &Provider{
+		Config:    config,
+		State:     state,
+		Reason:    reason,
+		StartedAt: time.Now(),
+		caches:    caches,
+	}
+
+	positions := newVehiclePositions(gtfsData, caches.GetStopsForTripCache, localTimeZone, pollInterval)
+	detours := newDetourDetector(gtfsData)
+	sightings := newRealtimeSightings()
+	blocks := &vehicleBlocks{gtfsData: gtfsData, localTimeZone: localTimeZone}
+
+	// For the blocks trips run in and the feeds version
+	if key, ok := config.Static.AuthKey(); ok {
+		provider.staticFeed = staticfeed.Watch(config.Static.URL, config.Static.AuthHeader, key, staticFeedRefreshInterval)
+		blocks.source = provider.staticFeed
+	}
+
+	if realtimeAvailable {
+		provider.detours = detours
+		provider.detours.Start()
+		provider.feeds = newFeedMonitor(config.Prefix, realtime, pollInterval)
+		provider.feeds.OnVehicles(positions.observe)
+		provider.feeds.OnVehicles(detours.observe)
+		provider.feeds.OnVehicles(sightings.observeVehicles)
+		provider.feeds.OnTripUpdates(sightings.observeTripUpdates)
+		if config.History.Enabled {
+			retention, _ := config.History.RetentionPeriod()
+			hsdb, err := history.SetupHistoricalDataStorage(config.Prefix, retention)
+			if err != nil {
+				fmt.Println("Failed to setup history for", config.Prefix, err)
+			} else {
+				provider.history = hsdb
+				provider.feeds.OnTripUpdates(hsdb.RecordTripUpdates)
+				provider.feeds.OnVehicles(hsdb.RecordVehicles)
 			}
 		}
+	}
 
-		updates, err := hsdb.GetHistoricTripsByRoute(routeId, startPtr, endPtr)
-		if err != nil {
-			fmt.Println(err)
-			return JsonApiResponse(c, 500, "Error", nil, map[string]any{"error": err.Error()})
-		}
+	setupStatusRoutes(primaryRouter, provider)
 
-		trips, err := gtfsData.GetTripsByIDs(updates)
-		if err != nil {
-			return JsonApiResponse(c, 500, "Error", nil, map[string]any{"error": err.Error()})
-		}
+	provider.notifier = notifications.SetupNotificationsRoutes(primaryRouter, config.Prefix, gtfsData, realtime, realtimeAvailable, localTimeZone, caches.GetParentStopsByChildCache, caches.GetStopsForTripCache)
+
+	setupServicesRoutes(primaryRouter, gtfsData, realtime, realtimeAvailable, localTimeZone, sightings, blocks, caches.GetParentStopsCache, caches.GetStopsForTripCache)
+	setupRoutesRoutes(primaryRouter, gtfsData, caches.GetRouteCache)
+	setupStopsRoutes(primaryRouter, gtfsData, caches.GetParentStopsCache, caches.GetAllStopsCache, caches.GetStopsForTripCache)
+	setupTripsRoutes(primaryRouter, gtfsData, realtime, realtimeAvailable, localTimeZone, sightings, blocks, caches.GetRouteCache, caches.GetStopsForTripCache, caches.GetParentStopsByChildCache)
+	provider.liveStream = setupRealtimeRoutes(primaryRouter, gtfsData, realtime, realtimeAvailable, localTimeZone, positions, detours, sightings, blocks, provider.feeds, caches.GetStopsForTripCache, caches.GetRouteCache, caches.GetParentStopsByChildCache, caches.GetAllStopsCache, provider.notifier)
+	setupNavigationRoutes(primaryRouter, gtfsData)
+
+	// Started once everything watching the feeds has been registered
+	if provider.feeds != nil {
+		provider.feeds.OnVehicles(provider.liveStream.observeVehicles)
+		provider.feeds.OnTripUpdates(provider.liveStream.observeTripUpdates)
+		provider.feeds.OnAlerts(provider.liveStream.observeAlerts)
+		provider.feeds.Start()
+	}
+
+	if provider.history != nil {
+		setupHistoryRoutes(primaryRouter, gtfsData, provider.history)
+		setupAnalyticsRoutes(primaryRouter, gtfsData, provider.history, localTimeZone, caches.GetRouteCache)
+	}
 
-		return JsonApiResponse(c, 200, "OK", trips)
-	})*/
+	return provider
 }
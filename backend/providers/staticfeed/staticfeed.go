@@ -0,0 +1,426 @@
+/*
+Package staticfeed reads the parts of a providers static gtfs zip that the gtfs library doesn't give us.
+
+That's the blocks trips are run in (trips.txt block_id): consecutive trips in a block are run by the same vehicle,
+so a vehicle running late on one trip starts the next one late too. And which version of the feed it is.
+*/
+package staticfeed
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+)
+
+// The feed can be big (AT's is ~100MB), downloading it can take a while
+const downloadTimeout = 10 * time.Minute
+
+// A trip that is part of a block
+type Trip struct {
+	TripId    string
+	BlockId   string
+	ServiceId string
+	// Seconds since the start of the service day, of the first departure and the last arrival
+	Start int
+	End   int
+}
+
+type service struct {
+	weekdays   [7]bool // Sunday first, like time.Weekday
+	start, end string  // YYYYMMDD, inclusive
+}
+
+// Which version of a static feed was read
+type Version struct {
+	// From feed_info.txt, empty if the feed doesn't have one
+	FeedVersion   string
+	FeedStartDate string // YYYYMMDD
+	FeedEndDate   string // YYYYMMDD
+	// The response headers the feed was downloaded with
+	LastModified string
+	ETag         string
+}
+
+// Whether the feed had a feed_info.txt with anything in it
+func (v Version) HasFeedInfo() bool {
+	return v.FeedVersion != "" || v.FeedStartDate != "" || v.FeedEndDate != ""
+}
+
+// One read of a static feed
+type Feed struct {
+	version Version
+
+	trips  map[string]*Trip
+	blocks map[string][]*Trip // by block id, in start order
+
+	services map[string]service
+	// service id -> YYYYMMDD -> 1 added, 2 removed
+	exceptions map[string]map[string]int
+}
+
+// Downloads a static gtfs zip and reads it, authHeader and authKey can be empty for a public feed
+func Download(ctx context.Context, url, authHeader, authKey string) (*Feed, error) {
+	ctx, cancel := context.WithTimeout(ctx, downloadTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authHeader != "" && authKey != "" {
+		req.Header.Set(authHeader, authKey)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download static feed: %s", resp.Status)
+	}
+
+	// zip needs to seek, so it goes to a temp file rather than memory
+	file, err := os.CreateTemp("", "static-gtfs-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	size, err := io.Copy(file, resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("download static feed: %w", err)
+	}
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("read static feed zip: %w", err)
+	}
+	feed, err := read(archive)
+	if err != nil {
+		return nil, err
+	}
+	feed.version.LastModified = resp.Header.Get("Last-Modified")
+	feed.version.ETag = resp.Header.Get("ETag")
+	return feed, nil
+}
+
+// Reads a static gtfs zip from disk
+func Open(path string) (*Feed, error) {
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	return read(&archive.Reader)
+}
+
+func read(archive *zip.Reader) (*Feed, error) {
+	feed := &Feed{
+		trips:      make(map[string]*Trip),
+		blocks:     make(map[string][]*Trip),
+		services:   make(map[string]service),
+		exceptions: make(map[string]map[string]int),
+	}
+
+	err := eachRow(archive, "feed_info.txt", false, func(row map[string]string) {
+		// There should only be one row
+		if feed.version.HasFeedInfo() {
+			return
+		}
+		feed.version.FeedVersion = row["feed_version"]
+		feed.version.FeedStartDate = row["feed_start_date"]
+		feed.version.FeedEndDate = row["feed_end_date"]
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(archive, "trips.txt", true, func(row map[string]string) {
+		if row["block_id"] == "" || row["trip_id"] == "" {
+			return
+		}
+		feed.trips[row["trip_id"]] = &Trip{TripId: row["trip_id"], BlockId: row["block_id"], ServiceId: row["service_id"], Start: -1, End: -1}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the first and last stop of each trip in a block are kept, stop_times is by far the biggest file
+	firstSequence := make(map[string]int, len(feed.trips))
+	lastSequence := make(map[string]int, len(feed.trips))
+	err = eachRow(archive, "stop_times.txt", true, func(row map[string]string) {
+		trip, found := feed.trips[row["trip_id"]]
+		if !found {
+			return
+		}
+		sequence, err := strconv.Atoi(row["stop_sequence"])
+		if err != nil {
+			return
+		}
+		if first, seen := firstSequence[trip.TripId]; !seen || sequence < first {
+			if seconds, ok := firstTime(row["departure_time"], row["arrival_time"]); ok {
+				firstSequence[trip.TripId] = sequence
+				trip.Start = seconds
+			}
+		}
+		if last, seen := lastSequence[trip.TripId]; !seen || sequence > last {
+			if seconds, ok := firstTime(row["arrival_time"], row["departure_time"]); ok {
+				lastSequence[trip.TripId] = sequence
+				trip.End = seconds
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(archive, "calendar.txt", false, func(row map[string]string) {
+		var weekdays [7]bool
+		for i, day := range []string{"sunday", "monday", "tuesday", "wednesday", "thursday", "friday", "saturday"} {
+			weekdays[i] = row[day] == "1"
+		}
+		feed.services[row["service_id"]] = service{weekdays: weekdays, start: row["start_date"], end: row["end_date"]}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = eachRow(archive, "calendar_dates.txt", false, func(row map[string]string) {
+		exceptionType, err := strconv.Atoi(row["exception_type"])
+		if err != nil {
+			return
+		}
+		if feed.exceptions[row["service_id"]] == nil {
+			feed.exceptions[row["service_id"]] = make(map[string]int)
+		}
+		feed.exceptions[row["service_id"]][row["date"]] = exceptionType
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id, trip := range feed.trips {
+		if trip.Start == -1 || trip.End == -1 {
+			delete(feed.trips, id)
+			continue
+		}
+		feed.blocks[trip.BlockId] = append(feed.blocks[trip.BlockId], trip)
+	}
+	for _, trips := range feed.blocks {
+		slices.SortFunc(trips, func(a, b *Trip) int {
+			return a.Start - b.Start
+		})
+	}
+
+	return feed, nil
+}
+
+// The first of the gtfs times that can be parsed
+func firstTime(values ...string) (int, bool) {
+	for _, value := range values {
+		if seconds, err := servicetime.Seconds(value); err == nil {
+			return seconds, true
+		}
+	}
+	return 0, false
+}
+
+// Calls fn with every row of a csv file in the zip, by column name. A missing optional file has no rows
+func eachRow(archive *zip.Reader, name string, required bool, fn func(row map[string]string)) error {
+	file, err := archive.Open(name)
+	if err != nil {
+		if !required && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("open %s: %w", name, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("read %s header: %w", name, err)
+	}
+	// Some feeds start their files with a byte order mark
+	columns := make([]string, len(header))
+	for i, column := range header {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(column, "\ufeff"))
+	}
+
+	row := make(map[string]string, len(columns))
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		clear(row)
+		for i, value := range record {
+			if i < len(columns) {
+				row[columns[i]] = strings.TrimSpace(value)
+			}
+		}
+		fn(row)
+	}
+}
+
+// Whether a service runs on a service day (from servicetime.DayStart)
+func (f *Feed) runsOn(serviceId string, day time.Time) bool {
+	date := servicetime.Date(day)
+	switch f.exceptions[serviceId][date] {
+	case 1:
+		return true
+	case 2:
+		return false
+	}
+	service, found := f.services[serviceId]
+	if !found {
+		return false
+	}
+	// Noon is on the right date even when daylight saving changes
+	weekday := day.Add(12 * time.Hour).Weekday()
+	return service.weekdays[weekday] && date >= service.start && date <= service.end
+}
+
+// Which version of the feed this is, empty if the feed hasn't been loaded
+func (f *Feed) Version() Version {
+	if f == nil {
+		return Version{}
+	}
+	return f.version
+}
+
+/*
+The trips in a trips block that run on a service day, in start order. The trip is included.
+
+Empty if the trip isn't part of a block or the feed hasn't been loaded.
+*/
+func (f *Feed) Block(tripId string, day time.Time) []Trip {
+	if f == nil {
+		return nil
+	}
+	trip, found := f.trips[tripId]
+	if !found {
+		return nil
+	}
+	var block []Trip
+	for _, blockTrip := range f.blocks[trip.BlockId] {
+		if blockTrip.TripId == tripId || f.runsOn(blockTrip.ServiceId, day) {
+			block = append(block, *blockTrip)
+		}
+	}
+	return block
+}
+
+// The trips after a trip in its block on a service day, in start order
+func (f *Feed) NextTrips(tripId string, day time.Time) []Trip {
+	block := f.Block(tripId, day)
+	index := slices.IndexFunc(block, func(trip Trip) bool { return trip.TripId == tripId })
+	if index == -1 {
+		return nil
+	}
+	return block[index+1:]
+}
+
+// The trip before a trip in its block on a service day, false if it's the first
+func (f *Feed) PreviousTrip(tripId string, day time.Time) (Trip, bool) {
+	block := f.Block(tripId, day)
+	index := slices.IndexFunc(block, func(trip Trip) bool { return trip.TripId == tripId })
+	if index <= 0 {
+		return Trip{}, false
+	}
+	return block[index-1], true
+}
+
+/*
+Source keeps a providers static feed loaded, reading it again every refresh interval.
+
+A failed read is logged and the last good feed is kept.
+*/
+type Source struct {
+	url, authHeader, authKey string
+
+	feed atomic.Pointer[Feed]
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Starts loading the feed in the background, Feed is nil until it has loaded
+func Watch(url, authHeader, authKey string, refreshInterval time.Duration) *Source {
+	source := &Source{
+		url:        url,
+		authHeader: authHeader,
+		authKey:    authKey,
+		stop:       make(chan struct{}),
+	}
+
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-source.stop
+			cancel()
+		}()
+
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+
+		source.load(ctx)
+		for {
+			select {
+			case <-source.stop:
+				return
+			case <-ticker.C:
+				source.load(ctx)
+			}
+		}
+	}()
+
+	return source
+}
+
+func (s *Source) load(ctx context.Context) {
+	feed, err := Download(ctx, s.url, s.authHeader, s.authKey)
+	if err != nil {
+		log.Printf("staticfeed: failed to read %s: %v", s.url, err)
+		return
+	}
+	s.feed.Store(feed)
+}
+
+// The last feed read, nil if it hasn't been read yet
+func (s *Source) Feed() *Feed {
+	if s == nil {
+		return nil
+	}
+	return s.feed.Load()
+}
+
+func (s *Source) Stop() {
+	if s == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
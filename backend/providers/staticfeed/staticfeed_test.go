@@ -0,0 +1,136 @@
+package staticfeed
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Block 1 runs A then B on weekdays, C only on the 17th. D isn't in a block
+var testFeed = map[string]string{
+	"trips.txt": "\ufefftrip_id,route_id,service_id,block_id\n" +
+		"B,r,weekdays,1\n" +
+		"A,r,weekdays,1\n" +
+		"C,r,extra,1\n" +
+		"D,r,weekdays,\n",
+	"stop_times.txt": "trip_id,arrival_time,departure_time,stop_id,stop_sequence\n" +
+		"A,08:00:00,08:00:00,s1,1\n" +
+		"A,08:30:00,08:30:00,s2,2\n" +
+		"B,09:10:00,09:10:00,s2,2\n" +
+		"B,08:40:00,08:40:00,s1,1\n" +
+		"C,24:10:00,24:10:00,s1,1\n" +
+		"C,24:40:00,24:40:00,s2,2\n" +
+		"D,10:00:00,10:00:00,s1,1\n",
+	"feed_info.txt": "feed_publisher_name,feed_publisher_url,feed_lang,feed_start_date,feed_end_date,feed_version\n" +
+		"Test,https://example.com,en,20261001,20261231,42\n",
+	"calendar.txt": "service_id,monday,tuesday,wednesday,thursday,friday,saturday,sunday,start_date,end_date\n" +
+		"weekdays,1,1,1,1,1,0,0,20260101,20261231\n",
+	"calendar_dates.txt": "service_id,date,exception_type\n" +
+		"extra,20261017,1\n" +
+		"weekdays,20261016,2\n",
+}
+
+func openTestFeed(t *testing.T) *Feed {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gtfs.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	for name, content := range testFeed {
+		writer, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	feed, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func day(year int, month time.Month, date int) time.Time {
+	return time.Date(year, month, date, 0, 0, 0, 0, time.UTC)
+}
+
+func tripIds(trips []Trip) []string {
+	ids := make([]string, 0, len(trips))
+	for _, trip := range trips {
+		ids = append(ids, trip.TripId)
+	}
+	return ids
+}
+
+func TestBlock(t *testing.T) {
+	feed := openTestFeed(t)
+	tests := []struct {
+		name   string
+		tripId string
+		day    time.Time
+		want   []string
+	}{
+		{name: "weekday", tripId: "B", day: day(2026, 10, 15), want: []string{"A", "B"}},
+		{name: "added service", tripId: "C", day: day(2026, 10, 17), want: []string{"C"}},
+		// Trips not running that day are left out, but never the one asked about
+		{name: "removed service", tripId: "A", day: day(2026, 10, 16), want: []string{"A"}},
+		{name: "not in a block", tripId: "D", day: day(2026, 10, 15), want: []string{}},
+	}
+	for _, test := range tests {
+		got := tripIds(feed.Block(test.tripId, test.day))
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%s: Block(%s) = %v, want %v", test.name, test.tripId, got, test.want)
+		}
+	}
+}
+
+func TestNextAndPreviousTrips(t *testing.T) {
+	feed := openTestFeed(t)
+	weekday := day(2026, 10, 15)
+
+	if got := tripIds(feed.NextTrips("A", weekday)); len(got) != 1 || got[0] != "B" {
+		t.Errorf("NextTrips(A) = %v, want [B]", got)
+	}
+	previous, ok := feed.PreviousTrip("B", weekday)
+	if !ok || previous.TripId != "A" {
+		t.Errorf("PreviousTrip(B) = %v, %v, want A", previous.TripId, ok)
+	}
+	if previous.Start != 8*3600 || previous.End != 8*3600+30*60 {
+		t.Errorf("A runs %d-%d, want %d-%d", previous.Start, previous.End, 8*3600, 8*3600+30*60)
+	}
+	if _, ok := feed.PreviousTrip("A", weekday); ok {
+		t.Errorf("A is the first trip in its block")
+	}
+	if got := feed.NextTrips("D", weekday); len(got) != 0 {
+		t.Errorf("D isn't in a block, got %v", tripIds(got))
+	}
+
+	var notLoaded *Feed
+	if got := notLoaded.NextTrips("A", weekday); len(got) != 0 {
+		t.Errorf("a feed that hasn't loaded has no blocks")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	version := openTestFeed(t).Version()
+	if version.FeedVersion != "42" || version.FeedStartDate != "20261001" || version.FeedEndDate != "20261231" {
+		t.Errorf("Version = %+v, want version 42 from 20261001 to 20261231", version)
+	}
+
+	var notLoaded *Feed
+	if notLoaded.Version().HasFeedInfo() {
+		t.Errorf("a feed that hasn't loaded has no version")
+	}
+}
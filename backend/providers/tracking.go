@@ -0,0 +1,294 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v5"
+)
+
+const (
+	// Most trips one connection can track at once
+	maxTrackedTrips = 20
+
+	trackingWriteTimeout = 10 * time.Second
+	trackingPongTimeout  = 60 * time.Second
+	trackingPingInterval = 30 * time.Second
+)
+
+var trackingUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Same as the api CORS config, any origin is allowed
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Everything the tracker page needs for one trip
+type TripTracking struct {
+	TripId          string               `json:"trip_id"`
+	Cancelled       bool                 `json:"cancelled"`
+	Vehicle         *VehiclesResponse    `json:"vehicle"` // nil if no vehicle is running the trip
+	StopTimes       []TripStopTimes      `json:"stop_times"`
+	SkippedStops    []string             `json:"skipped_stops"`
+	PlatformChanges []TripPlatformChange `json:"platform_changes"`
+	Alerts          []AlertResponseData  `json:"alerts"`
+}
+
+type TripPlatformChange struct {
+	ParentStopId string `json:"parent_stop_id"`
+	ChildStopId  string `json:"child_stop_id"`
+	Platform     string `json:"platform"`
+}
+
+type trackedTrip struct {
+	tracking *TripTracking
+	err      error
+}
+
+// Sent by the client to change which trips it is tracking
+type trackingRequest struct {
+	Action  string   `json:"action"` // subscribe or unsubscribe
+	TripIds []string `json:"trip_ids"`
+}
+
+type trackingMessage struct {
+	Type   string        `json:"type"` // trip or error
+	TripId string        `json:"trip_id,omitempty"`
+	Trip   *TripTracking `json:"trip,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+/*
+The tracking state of a trip, built once per snapshot and shared by every connection tracking it.
+
+languages (most preferred first) picks the alert text, so connections wanting the same languages share it.
+*/
+func (s *liveSnapshot) forTracking(tripID string, languages []string, builder liveVehicleBuilder) (*TripTracking, error) {
+	key := tripID + "|" + strings.Join(languages, ",")
+
+	s.mu.Lock()
+	cached, found := s.trackedTrips[key]
+	s.mu.Unlock()
+	if found {
+		return cached.tracking, cached.err
+	}
+
+	tracking, err := s.buildTracking(tripID, languages, builder)
+
+	s.mu.Lock()
+	s.trackedTrips[key] = trackedTrip{tracking: tracking, err: err}
+	s.mu.Unlock()
+
+	return tracking, err
+}
+
+func (s *liveSnapshot) buildTracking(tripID string, languages []string, builder liveVehicleBuilder) (*TripTracking, error) {
+	trip, err := builder.gtfsData.GetTripByID(tripID)
+	if err != nil {
+		return nil, errors.New("trip not found")
+	}
+
+	tripUpdate, _ := s.tripUpdates.ByTripID(tripID)
+	vehicle, _ := s.rawVehicles.ByTripID(tripID)
+
+	// nil if the trip doesn't have a shape
+	line, _ := NewTripShapeDistance(tripID, builder.gtfsData)
+	stopTimes, err := getTripStopTimes(builder.gtfsData, tripID, line, tripUpdate, vehicle, "", builder.localTimeZone)
+	if err != nil {
+		return nil, err
+	}
+
+	tracking := &TripTracking{
+		TripId:          tripID,
+		Cancelled:       tripUpdate.GetTrip().GetScheduleRelationship().String() == "CANCELED",
+		StopTimes:       stopTimes,
+		SkippedStops:    []string{},
+		PlatformChanges: []TripPlatformChange{},
+		Alerts:          []AlertResponseData{},
+	}
+
+	if vehicles := s.forTrip(tripID, builder); len(vehicles) > 0 {
+		tracking.Vehicle = &vehicles[0]
+	}
+
+	for _, stop := range stopTimes {
+		if stop.Skipped {
+			tracking.SkippedStops = append(tracking.SkippedStops, stop.ChildStopId)
+		}
+		if stop.PlatformChanged {
+			tracking.PlatformChanges = append(tracking.PlatformChanges, TripPlatformChange{
+				ParentStopId: stop.ParentStopId,
+				ChildStopId:  stop.ChildStopId,
+				Platform:     stop.Platform,
+			})
+		}
+	}
+
+	// Alerts for the trip, its route or its stops. In id order so an unchanged trip encodes the same every time
+	if len(s.alerts) > 0 {
+		scheduledStops, _ := builder.gtfsData.GetStopTimesForTripID(tripID)
+		matches := tripAlertMatcher(trip, scheduledStops)
+
+		alertIds := make([]string, 0, len(s.alerts))
+		for id, alert := range s.alerts {
+			if slices.ContainsFunc(alert.GetInformedEntity(), matches) {
+				alertIds = append(alertIds, id)
+			}
+		}
+		slices.Sort(alertIds)
+		for _, id := range alertIds {
+			if parsedAlert, ok := newAlertResponseData(s.alerts[id], languages); ok {
+				tracking.Alerts = append(tracking.Alerts, parsedAlert)
+			}
+		}
+	}
+
+	return tracking, nil
+}
+
+/*
+Serves a websocket that tracks trips.
+
+The client sends {"action": "subscribe"|"unsubscribe", "trip_ids": [...]}, after that a {"type": "trip", "trip": {...}}
+message is sent for a tracked trip straight away and again whenever a realtime refresh changes it.
+*/
+func (s *liveVehicleStream) serveTracking(c echo.Context) error {
+	conn, err := trackingUpgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		// The upgrader has already written the error response
+		return nil
+	}
+	defer conn.Close()
+
+	updates, latest := s.subscribe()
+	defer s.unsubscribe(updates)
+
+	// From the Accept-Language of the websocket handshake
+	languages := acceptedAlertLanguages(c)
+
+	requests := make(chan trackingRequest)
+	readDone := make(chan struct{})
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		defer close(readDone)
+		conn.SetReadLimit(4096)
+		conn.SetReadDeadline(time.Now().Add(trackingPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(trackingPongTimeout))
+		})
+		for {
+			var request trackingRequest
+			if err := conn.ReadJSON(&request); err != nil {
+				var syntaxErr *json.SyntaxError
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(err, &syntaxErr) || errors.As(err, &typeErr) {
+					request = trackingRequest{Action: "invalid"}
+				} else {
+					return
+				}
+			}
+			select {
+			case requests <- request:
+			case <-stopped:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(trackingPingInterval)
+	defer ping.Stop()
+
+	var (
+		tracked []string
+		// trip id -> last json sent for it
+		sent = make(map[string]string)
+	)
+
+	write := func(message trackingMessage) error {
+		conn.SetWriteDeadline(time.Now().Add(trackingWriteTimeout))
+		return conn.WriteJSON(message)
+	}
+
+	sendTrip := func(snapshot *liveSnapshot, tripID string) error {
+		tracking, err := snapshot.forTracking(tripID, languages, s.builder)
+		if err != nil {
+			tracked = slices.DeleteFunc(tracked, func(id string) bool { return id == tripID })
+			delete(sent, tripID)
+			return write(trackingMessage{Type: "error", TripId: tripID, Error: err.Error()})
+		}
+
+		encoded, err := json.Marshal(tracking)
+		if err != nil {
+			return nil
+		}
+		if sent[tripID] == string(encoded) {
+			return nil
+		}
+		sent[tripID] = string(encoded)
+		return write(trackingMessage{Type: "trip", TripId: tripID, Trip: tracking})
+	}
+
+	for {
+		select {
+		case <-c.Request().Context().Done():
+			return nil
+		case <-s.done:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"), time.Now().Add(time.Second))
+			return nil
+		case <-readDone:
+			return nil
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(trackingWriteTimeout)); err != nil {
+				return nil
+			}
+		case snapshot := <-updates:
+			latest = snapshot
+			for _, tripID := range slices.Clone(tracked) {
+				if err := sendTrip(snapshot, tripID); err != nil {
+					return nil
+				}
+			}
+		case request := <-requests:
+			switch request.Action {
+			case "subscribe":
+				var added []string
+				for _, tripID := range request.TripIds {
+					if tripID == "" || slices.Contains(tracked, tripID) {
+						continue
+					}
+					if len(tracked) >= maxTrackedTrips {
+						if err := write(trackingMessage{Type: "error", TripId: tripID, Error: "too many tracked trips"}); err != nil {
+							return nil
+						}
+						continue
+					}
+					tracked = append(tracked, tripID)
+					added = append(added, tripID)
+				}
+				// New trips get their current state without waiting for the next refresh
+				if latest != nil {
+					for _, tripID := range added {
+						if err := sendTrip(latest, tripID); err != nil {
+							return nil
+						}
+					}
+				}
+			case "unsubscribe":
+				tracked = slices.DeleteFunc(tracked, func(id string) bool { return slices.Contains(request.TripIds, id) })
+				for _, tripID := range request.TripIds {
+					delete(sent, tripID)
+				}
+			default:
+				if err := write(trackingMessage{Type: "error", Error: "unknown action, expected subscribe or unsubscribe"}); err != nil {
+					return nil
+				}
+			}
+		}
+	}
+}
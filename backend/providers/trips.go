@@ -0,0 +1,190 @@
+package providers
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/jfmow/at-trains-api/providers/caches"
+	"github.com/jfmow/at-trains-api/providers/delays"
+	"github.com/jfmow/at-trains-api/providers/servicetime"
+	"github.com/jfmow/gtfs"
+	rt "github.com/jfmow/gtfs/realtime"
+	"github.com/jfmow/gtfs/realtime/proto"
+	"github.com/labstack/echo/v5"
+)
+
+type TripDetails struct {
+	TripId             string            `json:"trip_id"`
+	ServiceDate        string            `json:"service_date"` // YYYYMMDD
+	Route              VehiclesRoute     `json:"route"`
+	Headsign           string            `json:"headsign"`
+	DirectionId        int               `json:"direction_id"`
+	Canceled           bool              `json:"canceled"`
+	TrackingConfidence string            `json:"tracking_confidence"`
+	WheelchairsAllowed int               `json:"wheelchairs_allowed"` // From the vehicle, 0 = unknown, 1 = yes, 2 = no
+	BikesAllowed       int               `json:"bikes_allowed"`       // 0 = unknown, 1 = yes, 2 = no
+	Stops              []TripDetailsStop `json:"stops"`
+	Shape              any               `json:"shape"`   // GeoJSON, null if the trip doesn't have a shape
+	Vehicle            *VehiclesResponse `json:"vehicle"` // null if no vehicle is running the trip
+	Alerts             []AlertDetails    `json:"alerts"`
+}
+
+type TripDetailsStop struct {
+	TripStopTimes
+	Name               string  `json:"name"`
+	Lat                float64 `json:"lat"`
+	Lon                float64 `json:"lon"`
+	WheelchairBoarding int     `json:"wheelchair_boarding"`
+}
+
+func setupTripsRoutes(primaryRoute *echo.Group, gtfsData gtfs.Database, realtime rt.Realtime, realtimeAvailable bool, localTimeZone *time.Location, sightings *realtimeSightings, blocks *vehicleBlocks, getRouteCache caches.RouteCache, getStopsForTripCache caches.StopsForTripCache, getParentStopByChildCache caches.ParentStopsByChildCache) {
+	tripsRoute := primaryRoute.Group("/trips")
+
+	liveVehicles := liveVehicleBuilder{
+		gtfsData:                  gtfsData,
+		localTimeZone:             localTimeZone,
+		getRouteCache:             getRouteCache,
+		getStopsForTripCache:      getStopsForTripCache,
+		getParentStopByChildCache: getParentStopByChildCache,
+		blocks:                    blocks,
+	}
+
+	/*
+		Everything needed for a trip page in one call: the route, stops with their scheduled and predicted times,
+		the shape, the vehicle and the alerts affecting the trip.
+
+		date (YYYYMMDD) is the service day to show, realtime data is left out if it's for the trip running on another day.
+		The realtime feeds are read once so every part of the response agrees with the others.
+	*/
+	tripsRoute.GET("/:tripId", func(c echo.Context) error {
+		tripIdEncoded := c.PathParam("tripId")
+		tripId, err := url.PathUnescape(tripIdEncoded)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid trip id", nil, ResponseDetails("tripId", tripIdEncoded, "details", "Invalid trip ID format", "error", err.Error()))
+		}
+		serviceDate := c.QueryParam("date")
+		if _, ok := servicetime.ParseDate(serviceDate, localTimeZone); serviceDate != "" && !ok {
+			return JsonApiResponse(c, http.StatusBadRequest, "invalid date", nil, ResponseDetails("date", serviceDate, "details", "Expected YYYYMMDD"))
+		}
+
+		trip, err := gtfsData.GetTripByID(tripId)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusNotFound, "no trip found", nil, ResponseDetails("tripId", tripId, "details", "Trip not found", "error", err.Error()))
+		}
+		stopTimes, err := gtfsData.GetStopTimesForTripID(tripId)
+		if err != nil || len(stopTimes) == 0 {
+			return JsonApiResponse(c, http.StatusNotFound, "no stops found for trip", nil, ResponseDetails("tripId", tripId, "details", "No stops available for the given trip ID"))
+		}
+
+		// One snapshot of the realtime feeds, all optional
+		var (
+			vehicles    rt.VehiclesMap
+			tripUpdates rt.TripUpdatesMap
+			alerts      rt.AlertMap
+			tripUpdate  *proto.TripUpdate
+			vehicle     *proto.VehiclePosition
+		)
+		if realtimeAvailable {
+			vehicles, _ = realtime.GetVehicles()
+			tripUpdates, _ = realtime.GetTripUpdates()
+			alerts, _ = realtime.GetAlerts()
+			tripUpdate, _ = tripUpdates.ByTripID(tripId)
+			vehicle, _ = vehicles.ByTripID(tripId)
+		}
+		lastSeen := sightings.LastSeen(tripId)
+		if startDate := tripStartDate(tripUpdate, vehicle, ""); serviceDate != "" && startDate != "" && startDate != serviceDate {
+			tripUpdate, vehicle, lastSeen = nil, nil, time.Time{}
+		}
+
+		now := time.Now().In(localTimeZone)
+		serviceDay := delays.TripServiceDay(stopTimes, tripStartDate(tripUpdate, vehicle, serviceDate), now, localTimeZone)
+
+		// The shape is read once for the response and the distances to each stop, trips don't have to have one
+		var (
+			shape any
+			line  *TripShapeDistance
+		)
+		if shapes, err := gtfsData.GetShapeByTripID(tripId); err == nil {
+			if geoJson, err := shapes.ToGeoJSON(); err == nil {
+				shape = geoJson
+				line, _ = tripShapeFromGeoJSON(tripId, geoJson)
+			}
+		}
+
+		stopTimesForTrip, err := getTripStopTimes(gtfsData, tripId, line, tripUpdate, vehicle, servicetime.Date(serviceDay), localTimeZone)
+		if err != nil {
+			return JsonApiResponse(c, http.StatusInternalServerError, "", nil, ResponseDetails("tripId", tripId, "error", err.Error()))
+		}
+
+		response := TripDetails{
+			TripId:       tripId,
+			ServiceDate:  servicetime.Date(serviceDay),
+			Route:        VehiclesRoute{RouteId: trip.RouteID},
+			Headsign:     trip.TripHeadsign,
+			DirectionId:  trip.DirectionID,
+			BikesAllowed: trip.BikesAllowed,
+			Stops:        make([]TripDetailsStop, 0, len(stopTimesForTrip)),
+			Shape:        shape,
+			Alerts:       []AlertDetails{},
+		}
+
+		if route, err := getVehicleRouteData(trip.RouteID, getRouteCache()); err == nil {
+			response.Route = *route
+		}
+
+		parentStops := getParentStopByChildCache()
+		scheduledStops := make(map[string]gtfs.TripStopTime, len(stopTimes))
+		for _, stopTime := range stopTimes {
+			scheduledStops[stopTime.StopId] = stopTime
+		}
+		for _, stopTime := range stopTimesForTrip {
+			stop := TripDetailsStop{TripStopTimes: stopTime}
+			if parent, found := parentStops[stopTime.ChildStopId]; found {
+				stop.Name = parent.StopName + " " + parent.StopCode
+				stop.Lat = parent.StopLat
+				stop.Lon = parent.StopLon
+				stop.WheelchairBoarding = parent.WheelChairBoarding
+			} else if scheduled, found := scheduledStops[stopTime.ChildStopId]; found {
+				stop.Name = scheduled.StopName
+				stop.Lat = scheduled.StopLat
+				stop.Lon = scheduled.StopLon
+			}
+			response.Stops = append(response.Stops, stop)
+		}
+
+		if vehicle != nil {
+			if running := liveVehicles.build(vehicles, tripUpdates, liveVehicleFilters{tripID: tripId}); len(running) > 0 {
+				response.Vehicle = &running[0]
+			}
+			switch vehicle.GetVehicle().GetWheelchairAccessible().Number() {
+			case 2:
+				response.WheelchairsAllowed = 1
+			case 3:
+				response.WheelchairsAllowed = 2
+			}
+		}
+
+		response.Canceled = tripUpdate.GetTrip().GetScheduleRelationship() == 3 || vehicle.GetTrip().GetScheduleRelationship() == 3
+
+		response.TrackingConfidence = trackingConfidence(realtimeAvailable, vehicle, tripUpdate, lastSeen, func() time.Time {
+			scheduled := delays.ScheduledStops(stopTimes, serviceDay)
+			if len(scheduled) == 0 {
+				return time.Time{}
+			}
+			return slices.MinFunc(scheduled, func(a, b delays.Stop) int {
+				return a.Sequence - b.Sequence
+			}).Departure
+		}, now)
+
+		if alerts != nil {
+			builder := newAlertDetailsBuilder(gtfsData, getRouteCache, acceptedAlertLanguages(c))
+			if matching := builder.matching(alerts, tripAlertMatcher(trip, stopTimes)); matching != nil {
+				response.Alerts = matching
+			}
+		}
+
+		return JsonApiResponse(c, http.StatusOK, "", response)
+	})
+}